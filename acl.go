@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	rus "github.com/sirupsen/logrus"
+	"path"
+	"strings"
+)
+
+// Permissions of a user on a resource, as returned in pb.Metadata.Permissions.
+const (
+	permRead uint32 = 1 << iota
+	permWrite
+	permDelete
+	permShare
+	permCreate
+
+	permAll = permRead | permWrite | permDelete | permShare | permCreate
+)
+
+// aclAttr is the attribute where the ACL of a resource is kept.
+// The ACL is a comma separated list of entries with the format
+// <grantee_type>:<grantee>:<permissions>, like "user:alice:rwdc,group:friends:r".
+// The permissions are r (read), w (write), d (delete) and c (create children).
+// Sharing is reserved to the owner so an ACL cannot grant it.
+// The entries apply to the resource and all its descendants.
+const aclAttr = "clawio.acl"
+
+// aclEntry is an entry of an ACL.
+type aclEntry struct {
+	granteeType string
+	grantee     string
+	perms       uint32
+}
+
+var aclPerms = map[rune]uint32{
+	'r': permRead,
+	'w': permWrite,
+	'd': permDelete,
+	'c': permCreate,
+}
+
+// parseACL parses the value of the ACL attribute.
+func parseACL(val string) ([]aclEntry, error) {
+	entries := []aclEntry{}
+	for _, token := range strings.Split(val, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+
+		fields := strings.Split(token, ":")
+		if len(fields) != 3 || fields[1] == "" {
+			return nil, fmt.Errorf("acl entry %q is not valid", token)
+		}
+		if fields[0] != granteeTypeUser && fields[0] != granteeTypeGroup {
+			return nil, fmt.Errorf("acl entry %q has an unknown grantee type", token)
+		}
+
+		e := aclEntry{granteeType: fields[0], grantee: fields[1]}
+		for _, r := range fields[2] {
+			perm, ok := aclPerms[r]
+			if !ok {
+				return nil, fmt.Errorf("acl entry %q has an unknown permission %q", token, r)
+			}
+			e.perms |= perm
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// getPermissions returns the permissions of the user on p.
+// Owners can do anything in their home but removing it. Other users get the
+// permissions granted by the shares and the ACLs of p and its ancestors.
+func (s *server) getPermissions(p string, idt *authlib.Identity) uint32 {
+	p = path.Clean(p)
+	switch {
+	case isHiddenPath(p):
+		return 0
+	case p == s.getHome(idt):
+		return permAll &^ permDelete
+	case s.isUnderHome(p, idt):
+		return permAll
+	case s.isCommonDomain(p):
+		return permRead
+	}
+	return s.getSharePermissions(p, idt) | s.getInheritedACLPermissions(p, idt)
+}
+
+// getChildrenPermissions returns a function that computes the permissions of
+// the user on the children of the container p. The ACLs of p and its ancestors
+// are read once for all the children.
+func (s *server) getChildrenPermissions(p string, idt *authlib.Identity) func(cp string) uint32 {
+	p = path.Clean(p)
+	if isHiddenPath(p) || s.isUnderHome(p, idt) || s.getOwner(p) == nil {
+		return func(cp string) uint32 {
+			return s.getPermissions(cp, idt)
+		}
+	}
+
+	inherited := s.getInheritedACLPermissions(p, idt)
+	return func(cp string) uint32 {
+		return s.getSharePermissions(cp, idt) | inherited | s.getACLPermissions(cp, idt)
+	}
+}
+
+// checkPermissions returns a permission denied error if the user
+// has not all the permissions perms on p.
+func (s *server) checkPermissions(p string, idt *authlib.Identity, perms uint32) error {
+	if s.getPermissions(p, idt)&perms != perms {
+		return permissionDenied
+	}
+	return nil
+}
+
+// checkDstPermissions checks the user has the permissions srcPerms on src
+// and can create dst in its parent. Overwriting dst also needs the write
+// permission on it.
+func (s *server) checkDstPermissions(src, dst string, idt *authlib.Identity, srcPerms uint32) error {
+	if err := s.checkPermissions(src, idt, srcPerms); err != nil {
+		return err
+	}
+	if err := s.checkPermissions(path.Dir(dst), idt, permCreate); err != nil {
+		return err
+	}
+	if _, err := s.storage.Stat(dst); err == nil {
+		return s.checkPermissions(dst, idt, permWrite)
+	}
+	return nil
+}
+
+// getSharePermissions returns the permissions granted to the user on p by
+// the shares on p or on one of its ancestors. Read-write shares allow to
+// change anything inside the shared resource but not to remove the resource itself.
+func (s *server) getSharePermissions(p string, idt *authlib.Identity) uint32 {
+	var perms uint32
+	shares := s.shares.list(func(sh *pb.Share) bool {
+		return isUnder(p, sh.Path) && s.isGrantee(sh, idt)
+	})
+	for _, sh := range shares {
+		switch sh.Permission {
+		case sharePermRead:
+			perms |= permRead
+		case sharePermReadWrite:
+			perms |= permRead | permWrite | permCreate
+			if path.Clean(p) != path.Clean(sh.Path) {
+				perms |= permDelete
+			}
+		}
+	}
+	return perms
+}
+
+// getInheritedACLPermissions returns the permissions granted to the user
+// by the ACLs of p and of its ancestors up to the home p is under.
+func (s *server) getInheritedACLPermissions(p string, idt *authlib.Identity) uint32 {
+	owner := s.getOwner(p)
+	if owner == nil {
+		return 0
+	}
+
+	home := s.getHome(owner)
+	var perms uint32
+	for cur := path.Clean(p); isUnder(cur, home); cur = path.Dir(cur) {
+		perms |= s.getACLPermissions(cur, idt)
+	}
+	return perms
+}
+
+// getACLPermissions returns the permissions granted to the user by the ACL of p.
+// Invalid ACLs are logged and grant nothing.
+func (s *server) getACLPermissions(p string, idt *authlib.Identity) uint32 {
+	val, err := s.storage.GetAttr(p, aclAttr)
+	if err != nil {
+		return 0
+	}
+
+	entries, err := parseACL(string(val))
+	if err != nil {
+		rus.WithField("path", p).Error(err)
+		return 0
+	}
+
+	var perms uint32
+	for _, e := range entries {
+		if s.isGrantee(&pb.Share{Grantee: e.grantee, GranteeType: e.granteeType}, idt) {
+			perms |= e.perms
+		}
+	}
+	return perms
+}
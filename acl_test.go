@@ -0,0 +1,148 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestParseACL(t *testing.T) {
+	tests := []struct {
+		val     string
+		entries []aclEntry
+		ok      bool
+	}{
+		{"", []aclEntry{}, true},
+		{"user:alice:rw", []aclEntry{{granteeTypeUser, "alice", permRead | permWrite}}, true},
+		{"user:alice:r, group:friends:rwdc", []aclEntry{
+			{granteeTypeUser, "alice", permRead},
+			{granteeTypeGroup, "friends", permRead | permWrite | permDelete | permCreate},
+		}, true},
+		{"user:alice", nil, false},
+		{"user::r", nil, false},
+		{"link:alice:r", nil, false},
+		{"user:alice:rs", nil, false},
+	}
+
+	for _, tt := range tests {
+		entries, err := parseACL(tt.val)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got error %v", tt.val, err)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(entries, tt.entries) {
+			t.Errorf("%q: got %+v, want %+v", tt.val, entries, tt.entries)
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	other := newTestToken(t, "other")
+
+	h.writeFile(h.home+"/photos/a.jpg", "a")
+	h.writeFile(h.home+"/docs/b.txt", "b")
+	h.share(h.home+"/photos", "other", "user", "read")
+	h.share(h.home+"/docs", "friends", "group", "readwrite")
+
+	stat := func(token, p string) *pb.Metadata {
+		m, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: token, Path: p, Children: true})
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		return m
+	}
+
+	rw := permRead | permWrite | permCreate
+	tests := []struct {
+		name     string
+		token    string
+		path     string
+		perms    uint32
+		children uint32
+	}{
+		{"home", h.token, h.home, permAll &^ permDelete, permAll},
+		{"own dir", h.token, h.home + "/docs", permAll, permAll},
+		{"read share", other, h.home + "/photos", permRead, permRead},
+		{"readwrite share", other, h.home + "/docs", rw, rw | permDelete},
+	}
+
+	for _, tt := range tests {
+		m := stat(tt.token, tt.path)
+		if m.Permissions != tt.perms {
+			t.Errorf("%s: got permissions %05b, want %05b", tt.name, m.Permissions, tt.perms)
+		}
+		for _, c := range m.Children {
+			if c.Permissions != tt.children {
+				t.Errorf("%s: got permissions %05b on %s, want %05b", tt.name, c.Permissions, c.Path, tt.children)
+			}
+		}
+	}
+}
+
+func TestACLAccess(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	other := newTestToken(t, "other")
+	third := newTestToken(t, "third")
+
+	h.writeFile(h.home+"/team/a.txt", "a")
+	h.writeFile(h.home+"/team/sub/b.txt", "b")
+	if err := setXattr(path.Join(h.dataDir, h.home+"/team"), aclAttr, []byte("user:other:rc,user:third:r")); err != nil {
+		t.Skipf("extended attributes are not supported: %v", err)
+	}
+	if err := setXattr(path.Join(h.dataDir, h.home+"/team/sub"), aclAttr, []byte("user:other:wd")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: other, Path: h.home + "/team", Children: true, Sort: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Permissions != permRead|permCreate {
+		t.Errorf("got permissions %05b, want %05b", m.Permissions, permRead|permCreate)
+	}
+	want := map[string]uint32{
+		h.home + "/team/a.txt": permRead | permCreate,
+		h.home + "/team/sub":   permRead | permCreate | permWrite | permDelete,
+	}
+	for _, c := range m.Children {
+		if c.Permissions != want[c.Path] {
+			t.Errorf("got permissions %05b on %s, want %05b", c.Permissions, c.Path, want[c.Path])
+		}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{"mkdir", mkdirErr(h, other, h.home+"/team/new"), codes.OK},
+		{"mkdir read only", mkdirErr(h, third, h.home+"/team/third"), codes.PermissionDenied},
+		{"rm without delete", rmErr(h, other, h.home+"/team/a.txt"), codes.PermissionDenied},
+		{"rm inherited", rmErr(h, other, h.home+"/team/sub/b.txt"), codes.OK},
+		{"rm with delete", rmErr(h, other, h.home+"/team/sub"), codes.OK},
+	}
+
+	for _, tt := range tests {
+		if grpc.Code(tt.err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(tt.err), tt.code, tt.err)
+		}
+	}
+}
+
+func mkdirErr(h *testHarness, token, p string) error {
+	_, err := h.client.Mkdir(h.ctx, &pb.MkdirReq{AccessToken: token, Path: p})
+	return err
+}
+
+func rmErr(h *testHarness, token, p string) error {
+	_, err := h.client.Rm(h.ctx, &pb.RmReq{AccessToken: token, Path: p})
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	authlib "github.com/clawio/service-auth/lib"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"reflect"
+	"strings"
+)
+
+// authorizationHeader is the metadata key the access token is sent in,
+// as "Bearer <token>".
+const authorizationHeader = "authorization"
+
+// authInterceptor validates the access token of the call once and keeps
+// the identity and the token in the context for the handlers, which get
+// them with authlib.FromContext and getAccessToken.
+// The token is taken from the metadata of the call or, for clients that
+// do not send it there, from the access_token field of the request.
+// Calls without a token go on without an identity, so methods like
+// StatByLink that are authorized otherwise can be reached, and the rest
+// reject them.
+func (s *server) authInterceptor(ctx context.Context, req interface{}, info *unaryServerInfo, handler unaryHandler) (interface{}, error) {
+	token := getMetadataToken(ctx)
+	if token == "" {
+		token = getRequestToken(req)
+	}
+	if token == "" {
+		return handler(ctx, req)
+	}
+
+	idt, err := s.parseToken(token)
+	if err != nil {
+		getLog(ctx).Error(err)
+		return nil, unauthenticatedError
+	}
+	setCaller(ctx, idt)
+
+	ctx = authlib.NewContext(ctx, idt)
+	ctx = newAccessTokenContext(ctx, token)
+	return handler(ctx, req)
+}
+
+// newAccessTokenContext returns a context with the access token the calls
+// to prop are made with. The token is added to the metadata prop gets.
+func newAccessTokenContext(ctx context.Context, token string) context.Context {
+	ctx = authlib.NewTokenContext(ctx, token)
+	md, ok := metadata.FromContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	md[authorizationHeader] = []string{"Bearer " + token}
+	return metadata.NewContext(ctx, md)
+}
+
+// getMetadataToken returns the bearer token in the metadata of the call.
+func getMetadataToken(ctx context.Context) string {
+	md, ok := getIncomingMetadata(ctx)
+	if !ok {
+		return ""
+	}
+	for _, v := range md[authorizationHeader] {
+		tokens := strings.SplitN(v, " ", 2)
+		if len(tokens) == 2 && strings.EqualFold(tokens[0], "bearer") {
+			return strings.TrimSpace(tokens[1])
+		}
+	}
+	return ""
+}
+
+// getRequestToken returns the access_token field of the request.
+// The generated messages have no getters, so it is read by name.
+func getRequestToken(req interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(req))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	f := v.FieldByName("AccessToken")
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return ""
+	}
+	return f.String()
+}
+
+// getAccessToken returns the access token the call has been authenticated with.
+func getAccessToken(ctx context.Context) string {
+	token, _ := authlib.FromTokenContext(ctx)
+	return token
+}
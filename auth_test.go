@@ -0,0 +1,83 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"testing"
+)
+
+func newBearerContext(ctx context.Context, token string) context.Context {
+	return metadata.NewContext(ctx, metadata.Pairs(authorizationHeader, "Bearer "+token))
+}
+
+func TestMetadataToken(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	ctx := newBearerContext(h.ctx, h.token)
+	p := h.home + "/photos"
+	if _, err := h.client.Mkdir(ctx, &pb.MkdirReq{Path: p}); err != nil {
+		t.Fatal(err)
+	}
+	if !h.exists(p) {
+		t.Fatalf("%s has not been created", p)
+	}
+
+	// The token is forwarded to prop in the metadata too.
+	h.prop.mu.Lock()
+	tokens := h.prop.tokens
+	h.prop.mu.Unlock()
+	if len(tokens) == 0 || tokens[len(tokens)-1] != h.token {
+		t.Fatalf("token has not been forwarded to prop: %v", tokens)
+	}
+
+	// The metadata wins over the body.
+	other := newTestToken(t, "other")
+	if _, err := h.client.Mkdir(ctx, &pb.MkdirReq{AccessToken: other, Path: h.home + "/music"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Streams are authenticated the same way.
+	stream, err := h.client.ListDir(ctx, &pb.ListDirReq{Path: h.home})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		_, err := stream.Recv()
+		if err != nil {
+			break
+		}
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("listed %d children, want 2", n)
+	}
+}
+
+func TestInvalidToken(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	_, err := h.client.Mkdir(newBearerContext(h.ctx, "invalid"), &pb.MkdirReq{AccessToken: h.token, Path: h.home + "/photos"})
+	if grpc.Code(err) != codes.Unauthenticated {
+		t.Fatalf("got %v, want Unauthenticated", err)
+	}
+
+	_, err = h.client.Mkdir(h.ctx, &pb.MkdirReq{Path: h.home + "/photos"})
+	if grpc.Code(err) != codes.Unauthenticated {
+		t.Fatalf("got %v, want Unauthenticated", err)
+	}
+}
+
+func TestGetRequestToken(t *testing.T) {
+	if token := getRequestToken(&pb.StatReq{AccessToken: "t"}); token != "t" {
+		t.Fatalf("got %q, want t", token)
+	}
+	if token := getRequestToken(&pb.StatByLinkReq{Token: "t"}); token != "" {
+		t.Fatalf("got %q, want no token", token)
+	}
+}
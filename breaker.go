@@ -0,0 +1,152 @@
+package main
+
+import (
+	rus "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"sync"
+	"time"
+)
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	// breakerClosed lets the calls through.
+	breakerClosed breakerState = iota
+	// breakerHalfOpen lets one call through to probe if the service is back.
+	breakerHalfOpen
+	// breakerOpen fails the calls without making them.
+	breakerOpen
+)
+
+func (st breakerState) String() string {
+	switch st {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+var errBreakerOpen = grpc.Errorf(codes.Unavailable, "prop is unavailable: circuit breaker is open")
+
+// circuitBreaker stops the calls to a service after a number of failures
+// in a row, so a service that is down fails the requests fast instead of
+// making every one of them wait for it. After the cooldown one call is let
+// through: if it works the calls go through again, else the breaker stays
+// open for another cooldown.
+type circuitBreaker struct {
+	name     string
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failed   int
+	openedAt time.Time
+	probing  bool
+}
+
+// newCircuitBreaker returns a breaker that opens after failures in a row.
+// A breaker with failures 0 never opens.
+func newCircuitBreaker(name string, failures int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, failures: failures, cooldown: cooldown, now: time.Now}
+}
+
+// allow checks if a call can be made. Every call allowed must be
+// followed by a call to done with its error.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return errBreakerOpen
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return errBreakerOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the result of a call allowed.
+func (b *circuitBreaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+	if !isUnavailable(err) {
+		b.failed = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.failed++
+	if b.state == breakerHalfOpen || (b.failures > 0 && b.failed >= b.failures) {
+		b.openedAt = b.now()
+		if b.state != breakerOpen {
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+// release ends a call allowed without recording its result,
+// i.e when the caller has given up on it.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// getState returns the state of the breaker.
+func (b *circuitBreaker) getState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setState changes the state and logs it. It is called with mu held.
+func (b *circuitBreaker) setState(state breakerState) {
+	log := rus.WithFields(rus.Fields{
+		"svc":      serviceID,
+		"breaker":  b.name,
+		"from":     b.state.String(),
+		"to":       state.String(),
+		"failures": b.failed,
+	})
+	b.state = state
+	if state == breakerOpen {
+		log.Errorf("circuit breaker to %s is open for %s", b.name, b.cooldown)
+		return
+	}
+	log.Infof("circuit breaker to %s is %s", b.name, state)
+}
+
+// isUnavailable checks if err means the service could not be reached or
+// did not answer in time. Other errors are answers of a working service.
+func isUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch grpc.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+		return true
+	}
+	return false
+}
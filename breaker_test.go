@@ -0,0 +1,63 @@
+package main
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker("prop", 2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	down := grpc.Errorf(codes.Unavailable, "down")
+	call := func(err error) error {
+		if err := b.allow(); err != nil {
+			return err
+		}
+		b.done(err)
+		return nil
+	}
+
+	// Answers of a working service do not open the breaker.
+	call(down)
+	call(grpc.Errorf(codes.NotFound, "not found"))
+	call(down)
+	if b.getState() != breakerClosed {
+		t.Fatalf("got %s after failures not in a row, want closed", b.getState())
+	}
+
+	call(down)
+	if b.getState() != breakerOpen {
+		t.Fatalf("got %s after 2 failures in a row, want open", b.getState())
+	}
+	if err := call(nil); err != errBreakerOpen {
+		t.Fatalf("got %v, want the call to fail fast", err)
+	}
+
+	// After the cooldown one call probes the service.
+	now = now.Add(time.Minute)
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	if b.getState() != breakerHalfOpen {
+		t.Fatalf("got %s after the cooldown, want half-open", b.getState())
+	}
+	if err := b.allow(); err != errBreakerOpen {
+		t.Fatalf("got %v, want a second probe to fail fast", err)
+	}
+	b.done(down)
+	if b.getState() != breakerOpen {
+		t.Fatalf("got %s after the probe failed, want open", b.getState())
+	}
+
+	now = now.Add(time.Minute)
+	if err := call(nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.getState() != breakerClosed {
+		t.Fatalf("got %s after the probe worked, want closed", b.getState())
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"hash"
+	"hash/adler32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// checksumAttrPrefix is the prefix of the attributes used to cache checksums.
+// The checksum computed with algorithm md5 is cached in the attribute
+// clawio.checksum.md5 with the value <mtime>:<size>:<checksum>, so it is
+// only valid while the file keeps the same modification time and size.
+const checksumAttrPrefix = "clawio.checksum."
+
+// newChecksumHash returns the hash that implements the checksum type.
+func newChecksumHash(checksumType string) (hash.Hash, error) {
+	switch checksumType {
+	case "adler32":
+		return adler32.New(), nil
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	default:
+		return nil, grpc.Errorf(codes.InvalidArgument, "checksum type %s is not supported", checksumType)
+	}
+}
+
+// getChecksumType returns the checksum type asked in the request
+// or the configured one if the request does not ask for any.
+func (s *server) getChecksumType(checksumType string) string {
+	if checksumType == "" {
+		return s.c.Checksum
+	}
+	return checksumType
+}
+
+// getCachedChecksum returns the checksum of the file p cached in its attributes.
+// It returns an empty string if there is no valid cached checksum.
+func (s *server) getCachedChecksum(p, checksumType string) (string, error) {
+	if _, err := newChecksumHash(checksumType); err != nil {
+		return "", err
+	}
+
+	finfo, err := s.storage.Stat(p)
+	if err != nil {
+		return "", err
+	}
+
+	val, err := s.storage.GetAttr(p, checksumAttrPrefix+checksumType)
+	if err != nil {
+		return "", nil
+	}
+
+	tokens := strings.SplitN(string(val), ":", 3)
+	if len(tokens) != 3 {
+		return "", nil
+	}
+
+	mtime := strconv.FormatInt(finfo.ModTime().UnixNano(), 10)
+	size := strconv.FormatInt(finfo.Size(), 10)
+	if tokens[0] != mtime || tokens[1] != size {
+		return "", nil
+	}
+
+	return fmt.Sprintf("%s:%s", checksumType, tokens[2]), nil
+}
+
+// getChecksum returns the checksum of the file p with the format <type>:<hex>.
+// The checksum is computed only if the cached one is not valid anymore.
+func (s *server) getChecksum(p, checksumType string) (string, error) {
+	checksum, err := s.getCachedChecksum(p, checksumType)
+	if err != nil {
+		return "", err
+	}
+	if checksum != "" {
+		return checksum, nil
+	}
+
+	h, err := newChecksumHash(checksumType)
+	if err != nil {
+		return "", err
+	}
+
+	finfo, err := s.storage.Stat(p)
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := s.storage.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	// A file that is not able to keep the cache is still checksummed.
+	val := fmt.Sprintf("%d:%d:%s", finfo.ModTime().UnixNano(), finfo.Size(), sum)
+	s.storage.SetAttr(p, checksumAttrPrefix+checksumType, []byte(val))
+
+	return fmt.Sprintf("%s:%s", checksumType, sum), nil
+}
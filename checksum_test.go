@@ -0,0 +1,159 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestStatChecksum(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	p := h.home + "/notes.txt"
+	h.writeFile(p, "hello")
+
+	tests := []struct {
+		checksumType string
+		code         codes.Code
+		checksum     string
+	}{
+		{"", codes.OK, "md5:5d41402abc4b2a76b9719d911017c592"},
+		{"adler32", codes.OK, "adler32:062c0215"},
+		{"md5", codes.OK, "md5:5d41402abc4b2a76b9719d911017c592"},
+		{"sha1", codes.OK, "sha1:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"},
+		{"sha256", codes.OK, "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{"crc32", codes.InvalidArgument, ""},
+	}
+
+	for _, tt := range tests {
+		req := &pb.StatReq{AccessToken: h.token, Path: p, ChecksumType: tt.checksumType}
+		m, err := h.client.Stat(h.ctx, req)
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.checksumType, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code == codes.OK && m.Checksum != tt.checksum {
+			t.Errorf("%s: got checksum %s, want %s", tt.checksumType, m.Checksum, tt.checksum)
+		}
+	}
+}
+
+func TestStatChecksumOfOtherUser(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	p := h.otherHome + "/notes.txt"
+	h.writeFile(p, "hello")
+
+	m, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Checksum != "" {
+		t.Errorf("got checksum %s without read access", m.Checksum)
+	}
+	cached, err := h.srv.getCachedChecksum(p, "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != "" {
+		t.Errorf("file has been read to compute the checksum")
+	}
+
+	other := newTestToken(t, "other")
+	m, err = h.client.Stat(h.ctx, &pb.StatReq{AccessToken: other, Path: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Checksum != "md5:5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("got checksum %s for the owner", m.Checksum)
+	}
+}
+
+func TestChecksumCache(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	p := h.home + "/notes.txt"
+	h.writeFile(p, "hello")
+
+	if _, err := h.srv.getChecksum(p, "md5"); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := h.srv.getCachedChecksum(p, "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != "md5:5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("got cached checksum %s", cached)
+	}
+
+	// children only get cached checksums
+	h.writeFile(h.home+"/other.txt", "other")
+	m, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home, Children: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range m.Children {
+		if c.Path == p && c.Checksum != cached {
+			t.Errorf("got checksum %s for %s, want %s", c.Checksum, c.Path, cached)
+		}
+		if c.Path == h.home+"/other.txt" && c.Checksum != "" {
+			t.Errorf("got checksum %s for %s, want none", c.Checksum, c.Path)
+		}
+	}
+
+	// a modified file invalidates the cache
+	h.writeFile(p, "bye")
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path.Join(h.dataDir, p), future, future); err != nil {
+		t.Fatal(err)
+	}
+	cached, err = h.srv.getCachedChecksum(p, "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != "" {
+		t.Errorf("got stale cached checksum %s", cached)
+	}
+	checksum, err := h.srv.getChecksum(p, "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum != "md5:bfa99df33b137bc8fb5f5407d7e58da8" {
+		t.Errorf("got checksum %s after modification", checksum)
+	}
+}
+
+func TestCpSendsChecksum(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/notes.txt", "hello")
+
+	req := &pb.CpReq{AccessToken: h.token, Src: h.home + "/notes.txt", Dst: h.home + "/copy.txt", ChecksumType: "sha1"}
+	if _, err := h.client.Cp(h.ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	rec, ok := h.prop.record(h.home + "/copy.txt")
+	if !ok {
+		t.Fatalf("copy has not been saved in prop")
+	}
+	if rec.Checksum != "sha1:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d" {
+		t.Errorf("got checksum %s in prop", rec.Checksum)
+	}
+
+	req = &pb.CpReq{AccessToken: h.token, Src: h.home + "/notes.txt", Dst: h.home + "/bad.txt", ChecksumType: "crc32"}
+	_, err := h.client.Cp(h.ctx, req)
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.InvalidArgument)
+	}
+	if h.exists(h.home + "/bad.txt") {
+		t.Errorf("copy with invalid checksum type has been created")
+	}
+}
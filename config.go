@@ -0,0 +1,507 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	rus "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	serviceID    = "CLAWIO_LOCALFS_META"
+	configEnvar  = serviceID + "_CONFIG"
+	redactedText = "******"
+)
+
+// config is the configuration of the service.
+// Every setting has a default and can be given in a JSON config file,
+// as a command-line flag or as an environment variable. They are applied
+// in that order, so an environment variable overrides a flag, that
+// overrides the config file.
+type config struct {
+	DataDir              string   `json:"dataDir"`
+	TmpDir               string   `json:"tmpDir"`
+	Port                 int      `json:"port"`
+	Prop                 string   `json:"prop"`
+	LogLevel             string   `json:"logLevel"`
+	PropMaxActive        int      `json:"propMaxActive"`
+	PropMaxIdle          int      `json:"propMaxIdle"`
+	PropMaxConcurrency   int      `json:"propMaxConcurrency"`
+	PropBatchSize        int      `json:"propBatchSize"`
+	PropBatchConcurrency int      `json:"propBatchConcurrency"`
+	PropTimeout          int      `json:"propTimeout"`
+	PropRetries          int      `json:"propRetries"`
+	PropRetryBackoff     int      `json:"propRetryBackoff"`
+	PropBreakerFailures  int      `json:"propBreakerFailures"`
+	PropBreakerCooldown  int      `json:"propBreakerCooldown"`
+	MaxVersions          int      `json:"maxVersions"`
+	Checksum             string   `json:"checksum"`
+	QuotaMaxBytes        uint64   `json:"quotaMaxBytes"`
+	QuotaMaxInodes       uint64   `json:"quotaMaxInodes"`
+	QuotaFile            string   `json:"quotaFile"`
+	GroupsFile           string   `json:"groupsFile"`
+	HomeLayout           string   `json:"homeLayout"`
+	HomeIdp              bool     `json:"homeIdp"`
+	IdentityMapFile      string   `json:"identityMapFile"`
+	TLSCertFile          string   `json:"tlsCertFile"`
+	TLSKeyFile           string   `json:"tlsKeyFile"`
+	TLSClientCAFile      string   `json:"tlsClientCAFile"`
+	PropTLS              bool     `json:"propTLS"`
+	PropCAFile           string   `json:"propCAFile"`
+	PropCertFile         string   `json:"propCertFile"`
+	PropKeyFile          string   `json:"propKeyFile"`
+	PropServerName       string   `json:"propServerName"`
+	JWTAlgorithms        []string `json:"jwtAlgorithms"`
+	JWTIssuer            string   `json:"jwtIssuer"`
+	JWTAudience          string   `json:"jwtAudience"`
+	JWTClockSkew         int      `json:"jwtClockSkew"`
+	JWTAllowNoExpiry     bool     `json:"jwtAllowNoExpiry"`
+	JWKSFile             string   `json:"jwksFile"`
+	JWTSigningKeyFile    string   `json:"jwtSigningKeyFile"`
+	JWTSigningKeyID      string   `json:"jwtSigningKeyID"`
+	MetricsPort          int      `json:"metricsPort"`
+	HealthInterval       int      `json:"healthInterval"`
+	HealthMinFreeBytes   uint64   `json:"healthMinFreeBytes"`
+	ShutdownTimeout      int      `json:"shutdownTimeout"`
+	SharedSecret         string   `json:"sharedSecret"`
+
+	// The fields below are not settings: they are loaded from the
+	// files the settings point to when the service starts.
+
+	// quotaOverrides are the quota limits of the users that do not
+	// have the default ones.
+	quotaOverrides map[string]quotaLimits
+
+	// groups are the members of every group shares can be granted to.
+	groups map[string][]string
+
+	// layout places the user homes in the namespace.
+	// If nil, the letter layout is used.
+	layout homeLayout
+
+	// propTLS is the TLS config of the connections to prop.
+	// If nil, the connections are not encrypted.
+	propTLS *tls.Config
+
+	// tokens validates the access tokens. If nil, HS256 tokens
+	// signed with SharedSecret are accepted.
+	tokens *tokenValidator
+
+	// identities links identities to storage accounts
+	// and lists the homes to migrate. It can be nil.
+	identities *identityMap
+
+	// storage is the storage driver used by the server.
+	// If nil, the local filesystem under DataDir is used.
+	storage storage
+}
+
+// newConfig returns the config with the defaults.
+// The data and tmp dirs, prop and the shared secret have no default.
+func newConfig() *config {
+	c := &config{}
+	c.Port = 57001
+	c.LogLevel = "error"
+	c.PropMaxActive = 1024
+	c.PropMaxIdle = 1024
+	c.PropMaxConcurrency = 1024
+	c.PropBatchSize = 100
+	c.PropBatchConcurrency = 4
+	c.PropTimeout = 5
+	c.PropRetries = 2
+	c.PropRetryBackoff = 100
+	c.PropBreakerFailures = 5
+	c.PropBreakerCooldown = 10
+	c.MaxVersions = 10
+	c.Checksum = "md5"
+	c.HomeLayout = homeLayoutLetter
+	c.JWTAlgorithms = []string{"HS256"}
+	c.JWTClockSkew = 60
+	c.MetricsPort = 57009
+	c.HealthInterval = 10
+	c.HealthMinFreeBytes = 100 * 1024 * 1024
+	c.ShutdownTimeout = 30
+	return c
+}
+
+// setting is a field of the config and the names it is given by
+// in the config file, on the command line and in the environment.
+type setting struct {
+	name  string
+	flag  string
+	envar string
+	usage string
+	value settingValue
+}
+
+// settingValue parses and prints the value of a setting.
+// The config file is decoded into it with encoding/json.
+type settingValue interface {
+	String() string
+	Set(string) error
+}
+
+// settings returns the settings of c, in the order they are documented.
+func (c *config) settings() []*setting {
+	return []*setting{
+		{"dataDir", "data-dir", serviceID + "_DATADIR", "absolute path of the dir the homes are stored in", (*stringValue)(&c.DataDir)},
+		{"tmpDir", "tmp-dir", serviceID + "_TMPDIR", "absolute path of the dir for temporary files, outside dataDir but on the same filesystem", (*stringValue)(&c.TmpDir)},
+		{"port", "port", serviceID + "_PORT", "port the gRPC server listens on", (*intValue)(&c.Port)},
+		{"prop", "prop", serviceID + "_PROP", "host:port of the prop service", (*stringValue)(&c.Prop)},
+		{"logLevel", "log-level", serviceID + "_LOGLEVEL", "log level: debug, info, warning, error, fatal or panic", (*stringValue)(&c.LogLevel)},
+		{"propMaxActive", "prop-max-active", serviceID + "_PROPMAXACTIVE", "maximum connections to prop", (*intValue)(&c.PropMaxActive)},
+		{"propMaxIdle", "prop-max-idle", serviceID + "_PROPMAXIDLE", "maximum idle connections to prop", (*intValue)(&c.PropMaxIdle)},
+		{"propMaxConcurrency", "prop-max-concurrency", serviceID + "_PROPMAXCONCURRENCY", "maximum connections to prop opened at the same time", (*intValue)(&c.PropMaxConcurrency)},
+		{"propBatchSize", "prop-batch-size", serviceID + "_PROPBATCHSIZE", "records asked to prop in one call when listing", (*intValue)(&c.PropBatchSize)},
+		{"propBatchConcurrency", "prop-batch-concurrency", serviceID + "_PROPBATCHCONCURRENCY", "calls to prop in flight when listing", (*intValue)(&c.PropBatchConcurrency)},
+		{"propTimeout", "prop-timeout", serviceID + "_PROPTIMEOUT", "seconds prop has to answer a call, 0 is no deadline", (*intValue)(&c.PropTimeout)},
+		{"propRetries", "prop-retries", serviceID + "_PROPRETRIES", "retries of the reads from prop while it is unavailable", (*intValue)(&c.PropRetries)},
+		{"propRetryBackoff", "prop-retry-backoff", serviceID + "_PROPRETRYBACKOFF", "milliseconds before the first retry, doubled every retry", (*intValue)(&c.PropRetryBackoff)},
+		{"propBreakerFailures", "prop-breaker-failures", serviceID + "_PROPBREAKERFAILURES", "failed calls in a row that stop the calls to prop, 0 never stops them", (*intValue)(&c.PropBreakerFailures)},
+		{"propBreakerCooldown", "prop-breaker-cooldown", serviceID + "_PROPBREAKERCOOLDOWN", "seconds the calls to prop are stopped before trying again", (*intValue)(&c.PropBreakerCooldown)},
+		{"maxVersions", "max-versions", serviceID + "_MAXVERSIONS", "versions kept per file, 0 disables versioning", (*intValue)(&c.MaxVersions)},
+		{"checksum", "checksum", serviceID + "_CHECKSUM", "checksum type: adler32, md5, sha1 or sha256", (*stringValue)(&c.Checksum)},
+		{"quotaMaxBytes", "quota-max-bytes", serviceID + "_QUOTAMAXBYTES", "default quota in bytes, 0 is unlimited", (*uint64Value)(&c.QuotaMaxBytes)},
+		{"quotaMaxInodes", "quota-max-inodes", serviceID + "_QUOTAMAXINODES", "default quota in files and dirs, 0 is unlimited", (*uint64Value)(&c.QuotaMaxInodes)},
+		{"quotaFile", "quota-file", serviceID + "_QUOTAFILE", "JSON file with the quotas of the users that do not have the default one", (*stringValue)(&c.QuotaFile)},
+		{"groupsFile", "groups-file", serviceID + "_GROUPSFILE", "JSON file with the members of the groups", (*stringValue)(&c.GroupsFile)},
+		{"homeLayout", "home-layout", serviceID + "_HOMELAYOUT", "layout of the homes: letter, flat, idp or hashed", (*stringValue)(&c.HomeLayout)},
+		{"homeIdp", "home-idp", serviceID + "_HOMEIDP", "place the homes under the identity provider", (*boolValue)(&c.HomeIdp)},
+		{"identityMapFile", "identity-map-file", serviceID + "_IDENTITYMAPFILE", "JSON file with the identity links and migrations", (*stringValue)(&c.IdentityMapFile)},
+		{"tlsCertFile", "tls-cert-file", serviceID + "_TLSCERTFILE", "certificate of the server, enables TLS", (*stringValue)(&c.TLSCertFile)},
+		{"tlsKeyFile", "tls-key-file", serviceID + "_TLSKEYFILE", "private key of the server certificate", (*stringValue)(&c.TLSKeyFile)},
+		{"tlsClientCAFile", "tls-client-ca-file", serviceID + "_TLSCLIENTCAFILE", "CA the client certificates must be signed by", (*stringValue)(&c.TLSClientCAFile)},
+		{"propTLS", "prop-tls", serviceID + "_PROPTLS", "connect to prop with TLS", (*boolValue)(&c.PropTLS)},
+		{"propCAFile", "prop-ca-file", serviceID + "_PROPCAFILE", "CA the prop certificate must be signed by", (*stringValue)(&c.PropCAFile)},
+		{"propCertFile", "prop-cert-file", serviceID + "_PROPCERTFILE", "client certificate presented to prop", (*stringValue)(&c.PropCertFile)},
+		{"propKeyFile", "prop-key-file", serviceID + "_PROPKEYFILE", "private key of the client certificate", (*stringValue)(&c.PropKeyFile)},
+		{"propServerName", "prop-server-name", serviceID + "_PROPSERVERNAME", "name in the prop certificate, the prop host by default", (*stringValue)(&c.PropServerName)},
+		{"jwtAlgorithms", "jwt-algorithms", serviceID + "_JWTALGORITHMS", "comma separated signing algorithms of the access tokens", (*listValue)(&c.JWTAlgorithms)},
+		{"jwtIssuer", "jwt-issuer", serviceID + "_JWTISSUER", "issuer of the access tokens, not checked if empty", (*stringValue)(&c.JWTIssuer)},
+		{"jwtAudience", "jwt-audience", serviceID + "_JWTAUDIENCE", "audience of the access tokens, not checked if empty", (*stringValue)(&c.JWTAudience)},
+		{"jwtClockSkew", "jwt-clock-skew", serviceID + "_JWTCLOCKSKEW", "seconds of clock skew allowed on the token times", (*intValue)(&c.JWTClockSkew)},
+		{"jwtAllowNoExpiry", "jwt-allow-no-expiry", serviceID + "_JWTALLOWNOEXPIRY", "accept access tokens without expiration time", (*boolValue)(&c.JWTAllowNoExpiry)},
+		{"jwksFile", "jwks-file", serviceID + "_JWKSFILE", "JWKS file with the keys of the access tokens", (*stringValue)(&c.JWKSFile)},
+		{"jwtSigningKeyFile", "jwt-signing-key-file", serviceID + "_JWTSIGNINGKEYFILE", "PEM private key the link tokens are signed with when no HMAC algorithm is allowed", (*stringValue)(&c.JWTSigningKeyFile)},
+		{"jwtSigningKeyID", "jwt-signing-key-id", serviceID + "_JWTSIGNINGKEYID", "kid of the signing key in the JWKS file", (*stringValue)(&c.JWTSigningKeyID)},
+		{"metricsPort", "metrics-port", serviceID + "_METRICSPORT", "port the metrics are served on, 0 disables them", (*intValue)(&c.MetricsPort)},
+		{"healthInterval", "health-interval", serviceID + "_HEALTHINTERVAL", "seconds between health checks", (*intValue)(&c.HealthInterval)},
+		{"healthMinFreeBytes", "health-min-free-bytes", serviceID + "_HEALTHMINFREEBYTES", "free bytes under which the service is unhealthy, 0 disables the check", (*uint64Value)(&c.HealthMinFreeBytes)},
+		{"shutdownTimeout", "shutdown-timeout", serviceID + "_SHUTDOWNTIMEOUT", "seconds the requests in flight have to end at shutdown", (*intValue)(&c.ShutdownTimeout)},
+		{"sharedSecret", "shared-secret", "CLAWIO_SHAREDSECRET", "secret shared by the services, prefer the environment variable", (*stringValue)(&c.SharedSecret)},
+	}
+}
+
+// loadConfig returns the config made of the defaults, the config file,
+// the command-line flags in args and the environment, in that order.
+// printConfig is true if the config has only to be printed.
+func loadConfig(args []string) (c *config, printConfig bool, err error) {
+	// The flags are parsed into a scratch config, so they can be
+	// applied after the config file they may point to.
+	scratch := newConfig()
+	fs := flag.NewFlagSet(filepath.Base(args[0]), flag.ContinueOnError)
+	configFile := fs.String("config", "", "JSON config file, also "+configEnvar)
+	fs.BoolVar(&printConfig, "print-config", false, "print the config, with the secret redacted, and exit")
+	for _, s := range scratch.settings() {
+		fs.Var(s.value, s.flag, s.usage+", also "+s.envar)
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if fn, ok := os.LookupEnv(configEnvar); ok {
+		*configFile = fn
+	}
+
+	c = newConfig()
+	if *configFile != "" {
+		if err := c.loadFile(*configFile); err != nil {
+			return nil, false, err
+		}
+	}
+
+	settings := c.settings()
+	flags := map[string]*setting{}
+	for _, s := range settings {
+		flags[s.flag] = s
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if s, ok := flags[f.Name]; ok && err == nil {
+			err = s.value.Set(f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.envar); ok {
+			if err := s.value.Set(v); err != nil {
+				return nil, false, fmt.Errorf("%s: %s", s.envar, err.Error())
+			}
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, false, err
+	}
+	return c, printConfig, nil
+}
+
+// loadFile sets the settings in the config file fn.
+// Unknown settings are an error, so typos do not go unnoticed.
+func (c *config) loadFile(fn string) error {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("config file %s is not valid JSON: %s", fn, err.Error())
+	}
+
+	settings := map[string]*setting{}
+	for _, s := range c.settings() {
+		settings[s.name] = s
+	}
+	for name, v := range raw {
+		s, ok := settings[name]
+		if !ok {
+			return fmt.Errorf("config file %s: unknown setting %q", fn, name)
+		}
+		if err := json.Unmarshal(v, s.value); err != nil {
+			return fmt.Errorf("config file %s: %s must be %s", fn, name, describeValue(s.value))
+		}
+	}
+	return nil
+}
+
+// validate checks every setting and returns all the problems found.
+func (c *config) validate() error {
+	names := map[string]*setting{}
+	for _, s := range c.settings() {
+		names[s.name] = s
+	}
+	problems := []string{}
+	fail := func(name, format string, args ...interface{}) {
+		s := names[name]
+		problems = append(problems, fmt.Sprintf("%s (%s): %s", s.name, s.envar, fmt.Sprintf(format, args...)))
+	}
+	checkDir := func(name, dir string) {
+		if dir == "" {
+			fail(name, "must be set")
+		} else if !filepath.IsAbs(dir) {
+			fail(name, "must be an absolute path, got %q", dir)
+		}
+	}
+	checkPort := func(name string, port int, optional bool) {
+		if optional && port == 0 {
+			return
+		}
+		if port <= 0 || port > 65535 {
+			fail(name, "must be between 1 and 65535, got %d", port)
+		}
+	}
+	checkMin := func(name string, v, min int) {
+		if v < min {
+			fail(name, "must be at least %d, got %d", min, v)
+		}
+	}
+	checkPair := func(name, v, other, otherValue string) {
+		if v != "" && otherValue == "" {
+			fail(other, "must be set with %s", name)
+		}
+	}
+
+	checkDir("dataDir", c.DataDir)
+	checkDir("tmpDir", c.TmpDir)
+	// Temporary files would be listed and counted as the ones of the homes.
+	if filepath.IsAbs(c.DataDir) && filepath.IsAbs(c.TmpDir) && isUnder(c.TmpDir, c.DataDir) {
+		fail("tmpDir", "must not be dataDir nor inside it, got %q", c.TmpDir)
+	}
+	checkPort("port", c.Port, false)
+	if c.Prop == "" {
+		fail("prop", "must be set")
+	} else if _, _, err := net.SplitHostPort(c.Prop); err != nil {
+		fail("prop", "must be host:port, got %q", c.Prop)
+	}
+	if _, err := rus.ParseLevel(c.LogLevel); err != nil {
+		fail("logLevel", "unknown level %q", c.LogLevel)
+	}
+	checkMin("propMaxActive", c.PropMaxActive, 1)
+	checkMin("propMaxIdle", c.PropMaxIdle, 0)
+	checkMin("propMaxConcurrency", c.PropMaxConcurrency, 0)
+	checkMin("propBatchSize", c.PropBatchSize, 1)
+	checkMin("propBatchConcurrency", c.PropBatchConcurrency, 1)
+	checkMin("propTimeout", c.PropTimeout, 0)
+	checkMin("propRetries", c.PropRetries, 0)
+	checkMin("propRetryBackoff", c.PropRetryBackoff, 0)
+	checkMin("propBreakerFailures", c.PropBreakerFailures, 0)
+	checkMin("propBreakerCooldown", c.PropBreakerCooldown, 0)
+	checkMin("maxVersions", c.MaxVersions, 0)
+	if _, err := newChecksumHash(c.Checksum); err != nil {
+		fail("checksum", "unknown type %q", c.Checksum)
+	}
+	if _, err := newHomeLayout(c.HomeLayout, false); err != nil {
+		fail("homeLayout", "unknown layout %q", c.HomeLayout)
+	}
+	checkPair("tlsCertFile", c.TLSCertFile, "tlsKeyFile", c.TLSKeyFile)
+	checkPair("tlsKeyFile", c.TLSKeyFile, "tlsCertFile", c.TLSCertFile)
+	checkPair("tlsClientCAFile", c.TLSClientCAFile, "tlsCertFile", c.TLSCertFile)
+	checkPair("propCertFile", c.PropCertFile, "propKeyFile", c.PropKeyFile)
+	checkPair("propKeyFile", c.PropKeyFile, "propCertFile", c.PropCertFile)
+	if !c.PropTLS && (c.PropCAFile != "" || c.PropCertFile != "" || c.PropServerName != "") {
+		fail("propTLS", "must be true to use the prop TLS settings")
+	}
+	if len(c.JWTAlgorithms) == 0 {
+		fail("jwtAlgorithms", "must be set")
+	} else if _, err := newTokenValidator(tokenOptions{algorithms: c.JWTAlgorithms}); err != nil {
+		fail("jwtAlgorithms", "%s", err.Error())
+	}
+	checkMin("jwtClockSkew", c.JWTClockSkew, 0)
+	checkPair("jwtSigningKeyID", c.JWTSigningKeyID, "jwtSigningKeyFile", c.JWTSigningKeyFile)
+	checkPort("metricsPort", c.MetricsPort, true)
+	if c.MetricsPort != 0 && c.MetricsPort == c.Port {
+		fail("metricsPort", "must not be the gRPC port %d", c.Port)
+	}
+	checkMin("healthInterval", c.HealthInterval, 1)
+	checkMin("shutdownTimeout", c.ShutdownTimeout, 0)
+	// Only HMAC tokens are verified with the shared secret,
+	// the rest need the keys of the JWKS file.
+	hmac := false
+	for _, alg := range c.JWTAlgorithms {
+		if strings.HasPrefix(alg, "HS") {
+			hmac = true
+		}
+	}
+	if hmac && c.SharedSecret == "" {
+		fail("sharedSecret", "must be set to accept HMAC tokens")
+	}
+	if !hmac && c.JWKSFile == "" {
+		fail("jwksFile", "must be set when no HMAC algorithm is allowed")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// redacted returns a copy of the settings of c without the shared secret.
+func (c *config) redacted() *config {
+	r := *c
+	if r.SharedSecret != "" {
+		r.SharedSecret = redactedText
+	}
+	return &r
+}
+
+// print writes the config as a config file, with the secret redacted.
+func (c *config) print(w io.Writer) error {
+	data, err := json.MarshalIndent(c.redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// log logs the settings, with the secret redacted.
+func (c *config) log() {
+	for _, s := range c.redacted().settings() {
+		rus.Infof("%s=%s\n", s.envar, s.value.String())
+	}
+}
+
+type stringValue string
+
+func (v *stringValue) String() string { return string(*v) }
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("%q is not an integer", s)
+	}
+	*v = intValue(i)
+	return nil
+}
+
+type uint64Value uint64
+
+func (v *uint64Value) String() string { return strconv.FormatUint(uint64(*v), 10) }
+
+func (v *uint64Value) Set(s string) error {
+	i, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a positive integer", s)
+	}
+	*v = uint64Value(i)
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("%q is not true or false", s)
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+// IsBoolFlag lets the flag be given without a value.
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+// listValue is a comma separated list.
+type listValue []string
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+
+func (v *listValue) Set(s string) error {
+	l := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	*v = l
+	return nil
+}
+
+// describeValue tells what a setting expects in the config file.
+func describeValue(v settingValue) string {
+	switch v.(type) {
+	case *intValue:
+		return "an integer"
+	case *uint64Value:
+		return "a positive integer"
+	case *boolValue:
+		return "true or false"
+	case *listValue:
+		return "a list of strings"
+	}
+	return "a string"
+}
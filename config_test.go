@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes a config file in a temporary dir.
+func writeConfigFile(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "localfs-meta-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfig(t *testing.T) {
+	fn, cleanup := writeConfigFile(t, `{
+		"dataDir": "/srv/localfs",
+		"tmpDir": "/srv/localfs-tmp",
+		"prop": "prop:57003",
+		"port": 1000,
+		"maxVersions": 5,
+		"jwtAlgorithms": ["HS256", "RS256"]
+	}`)
+	defer cleanup()
+
+	os.Setenv("CLAWIO_LOCALFS_META_MAXVERSIONS", "7")
+	os.Setenv("CLAWIO_SHAREDSECRET", "secret")
+	defer os.Unsetenv("CLAWIO_LOCALFS_META_MAXVERSIONS")
+	defer os.Unsetenv("CLAWIO_SHAREDSECRET")
+
+	c, printConfig, err := loadConfig([]string{"meta", "-config", fn, "-port", "2000", "-max-versions", "6", "-home-idp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printConfig {
+		t.Fatal("config has to be printed")
+	}
+
+	// The flags override the file and the environment the flags.
+	if c.DataDir != "/srv/localfs" || c.Prop != "prop:57003" {
+		t.Fatalf("settings of the file are not set: %+v", c)
+	}
+	if c.Port != 2000 {
+		t.Fatalf("got port %d, want the one of the flag", c.Port)
+	}
+	if c.MaxVersions != 7 {
+		t.Fatalf("got max versions %d, want the one of the environment", c.MaxVersions)
+	}
+	if !c.HomeIdp {
+		t.Fatal("bool flag without a value is not set")
+	}
+	if strings.Join(c.JWTAlgorithms, ",") != "HS256,RS256" {
+		t.Fatalf("got algorithms %v", c.JWTAlgorithms)
+	}
+	if c.PropBatchSize != 100 || c.HealthInterval != 10 {
+		t.Fatalf("defaults are not set: %+v", c)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	fn, cleanup := writeConfigFile(t, `{"dataDir": "/srv/localfs", "prot": 1000}`)
+	defer cleanup()
+	_, _, err := loadConfig([]string{"meta", "-config", fn})
+	if err == nil || !strings.Contains(err.Error(), `unknown setting "prot"`) {
+		t.Fatalf("got %v, want the unknown setting", err)
+	}
+
+	fn, cleanup = writeConfigFile(t, `{"port": "1000"}`)
+	defer cleanup()
+	_, _, err = loadConfig([]string{"meta", "-config", fn})
+	if err == nil || !strings.Contains(err.Error(), "port must be an integer") {
+		t.Fatalf("got %v, want the port not to be an integer", err)
+	}
+
+	os.Setenv("CLAWIO_LOCALFS_META_PORT", "abc")
+	_, _, err = loadConfig([]string{"meta"})
+	os.Unsetenv("CLAWIO_LOCALFS_META_PORT")
+	if err == nil || !strings.Contains(err.Error(), `CLAWIO_LOCALFS_META_PORT: "abc" is not an integer`) {
+		t.Fatalf("got %v, want the port not to be an integer", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	c := newConfig()
+	c.DataDir = "data"
+	c.PropBatchSize = 0
+	c.Checksum = "crc"
+	c.TLSClientCAFile = "ca.pem"
+
+	err := c.validate()
+	if err == nil {
+		t.Fatal("invalid config is valid")
+	}
+	for _, problem := range []string{
+		`dataDir (CLAWIO_LOCALFS_META_DATADIR): must be an absolute path, got "data"`,
+		"tmpDir (CLAWIO_LOCALFS_META_TMPDIR): must be set",
+		"prop (CLAWIO_LOCALFS_META_PROP): must be set",
+		"propBatchSize (CLAWIO_LOCALFS_META_PROPBATCHSIZE): must be at least 1, got 0",
+		`checksum (CLAWIO_LOCALFS_META_CHECKSUM): unknown type "crc"`,
+		"tlsCertFile (CLAWIO_LOCALFS_META_TLSCERTFILE): must be set with tlsClientCAFile",
+		"sharedSecret (CLAWIO_SHAREDSECRET): must be set to accept HMAC tokens",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%q is not reported in:\n%s", problem, err.Error())
+		}
+	}
+
+	c.DataDir, c.TmpDir, c.Prop, c.SharedSecret = "/srv/localfs", "/tmp", "prop:57003", "secret"
+	c.PropBatchSize, c.Checksum, c.TLSClientCAFile = 100, "md5", ""
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Temporary files must not end up in the homes.
+	for _, tmpDir := range []string{"/srv/localfs", "/srv/localfs/", "/srv/localfs/tmp"} {
+		c.TmpDir = tmpDir
+		if err := c.validate(); err == nil || !strings.Contains(err.Error(), "tmpDir") {
+			t.Errorf("%s: got %v, want tmpDir to be rejected", tmpDir, err)
+		}
+	}
+	c.TmpDir = "/srv/localfs-tmp"
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Setups with only asymmetric algorithms need no shared secret.
+	c.JWTAlgorithms, c.SharedSecret = []string{"RS256"}, ""
+	if err := c.validate(); err == nil || !strings.Contains(err.Error(), "jwksFile") {
+		t.Fatalf("got %v, want the JWKS file to be required", err)
+	}
+	c.JWKSFile = "/etc/clawio/jwks.json"
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	c := newConfig()
+	c.SharedSecret = "secret"
+	buf := &bytes.Buffer{}
+	if err := c.print(buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), `"secret"`) || !strings.Contains(buf.String(), `"sharedSecret": "******"`) {
+		t.Fatalf("secret is not redacted:\n%s", buf.String())
+	}
+	if c.SharedSecret != "secret" {
+		t.Fatal("secret of the config has been changed")
+	}
+
+	// The config printed can be used as a config file.
+	fn, cleanup := writeConfigFile(t, buf.String())
+	defer cleanup()
+	loaded := newConfig()
+	if err := loaded.loadFile(fn); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Port != c.Port || loaded.HealthMinFreeBytes != c.HealthMinFreeBytes {
+		t.Fatalf("got %+v, want %+v", loaded, c)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// ficlone is the ioctl that makes dst share the data blocks of src
+// in filesystems that support reflinks, like btrfs or xfs.
+const ficlone = 0x40049409
+
+// copyFileRangeChunk is the number of bytes copied by each copy_file_range call.
+const copyFileRangeChunk = 8 << 20
+
+// sysCopyFileRange is the copy_file_range syscall number. It is zero in
+// architectures where it is not known and then the data is read and written.
+var sysCopyFileRange = map[string]uintptr{
+	"386":     377,
+	"amd64":   326,
+	"arm":     391,
+	"arm64":   285,
+	"ppc64":   379,
+	"ppc64le": 379,
+}[runtime.GOARCH]
+
+// fileAtime returns the access time of the file.
+func fileAtime(finfo os.FileInfo) time.Time {
+	st, ok := finfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return finfo.ModTime()
+	}
+	return time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+}
+
+// fastCopy copies the data of src to dst without passing it through user
+// space, cloning it when the filesystem supports reflinks or with
+// copy_file_range otherwise. It returns false if none of them can be used,
+// in which case nothing has been copied.
+func (c *copier) fastCopy(dst, src *os.File, size int64) (bool, error) {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno == 0 {
+		c.stats.bytes += uint64(size)
+		c.report()
+		return true, nil
+	}
+
+	if sysCopyFileRange == 0 {
+		return false, nil
+	}
+
+	copied := false
+	for {
+		if err := c.ctx.Err(); err != nil {
+			return true, err
+		}
+
+		n, _, errno := unix.Syscall6(sysCopyFileRange, src.Fd(), 0, dst.Fd(), 0, copyFileRangeChunk, 0)
+		if errno != 0 {
+			if !copied {
+				switch errno {
+				case unix.ENOSYS, unix.EXDEV, unix.EINVAL, unix.EOPNOTSUPP, unix.EBADF:
+					return false, nil
+				}
+			}
+			return true, errno
+		}
+		if n == 0 {
+			return true, nil
+		}
+
+		copied = true
+		c.stats.bytes += uint64(n)
+		c.report()
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileAtime returns the access time of the file.
+// The modification time is used where it is not available.
+func fileAtime(finfo os.FileInfo) time.Time {
+	return finfo.ModTime()
+}
+
+// fastCopy is only available on Linux.
+func (c *copier) fastCopy(dst, src *os.File, size int64) (bool, error) {
+	return false, nil
+}
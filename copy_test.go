@@ -0,0 +1,250 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// cpWithProgress returns the progress messages streamed by CpWithProgress.
+func (h *testHarness) cpWithProgress(req *pb.CpReq) ([]*pb.CpProgress, error) {
+	stream, err := h.client.CpWithProgress(h.ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	msgs := []*pb.CpProgress{}
+	for {
+		m, err := stream.Recv()
+		if err == io.EOF {
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+func TestCpWithProgress(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/photos/a.jpg", "aaaa")
+	h.writeFile(h.home+"/photos/2015/b.jpg", "bb")
+
+	msgs, err := h.cpWithProgress(&pb.CpReq{AccessToken: h.token, Src: h.home + "/photos", Dst: h.home + "/backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) == 0 {
+		t.Fatal("no progress has been sent")
+	}
+
+	last := msgs[len(msgs)-1]
+	if !last.Done {
+		t.Errorf("last progress is not done")
+	}
+	// photos, photos/2015 and the two files
+	if last.TotalFiles != 4 || last.CopiedFiles != 4 {
+		t.Errorf("got %d of %d files, want 4 of 4", last.CopiedFiles, last.TotalFiles)
+	}
+	if last.TotalBytes != 6 || last.CopiedBytes != 6 {
+		t.Errorf("got %d of %d bytes, want 6 of 6", last.CopiedBytes, last.TotalBytes)
+	}
+	if !h.exists(h.home + "/backup/2015/b.jpg") {
+		t.Errorf("%s has not been copied", h.home+"/backup/2015/b.jpg")
+	}
+	if _, ok := h.prop.record(h.home + "/backup"); !ok {
+		t.Errorf("%s has not been saved in prop", h.home+"/backup")
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		src   string
+		dst   string
+		code  codes.Code
+	}{
+		{"dst exists", h.token, h.home + "/photos", h.home + "/backup", codes.AlreadyExists},
+		{"missing src", h.token, h.home + "/missing", h.home + "/other", codes.NotFound},
+		{"to other home", h.token, h.home + "/photos", h.otherHome + "/photos", codes.PermissionDenied},
+		{"bad token", "bad", h.home + "/photos", h.home + "/bad", codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		_, err := h.cpWithProgress(&pb.CpReq{AccessToken: tt.token, Src: tt.src, Dst: tt.dst})
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+		}
+	}
+}
+
+func TestCopyDirIsAtomic(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "localfs-meta-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	tmpDir := path.Join(dataDir, "tmp")
+	if err := os.Mkdir(tmpDir, dirPerm); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/src/a", "/src/b", "/src/c/d", "/src/c/e"} {
+		pp := path.Join(dataDir, p)
+		if err := os.MkdirAll(path.Dir(pp), dirPerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pp, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layout, _ := newHomeLayout(homeLayoutLetter, false)
+	l := newLocalStorage(dataDir, tmpDir, layout)
+
+	// the copy is cancelled in the middle of the tree
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := copyOptions{}
+	opts.progress = func(copied copyStats) {
+		if copied.files >= 3 {
+			cancel()
+		}
+	}
+
+	err = l.Copy(ctx, "/src", "/dst", opts)
+	if err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(path.Join(dataDir, "dst")); !os.IsNotExist(err) {
+		t.Errorf("dst has been left behind")
+	}
+	names, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("got %d entries in tmp dir, want 0", len(names))
+	}
+
+	if err := l.Copy(context.Background(), "/src", "/dst", copyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dataDir, "dst/c/e")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCpPreserve(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	src := h.home + "/notes.txt"
+	h.writeFile(src, "hello")
+	psrc := path.Join(h.dataDir, src)
+	mtime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	if err := os.Chmod(psrc, 0600); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := true
+	if err := setXattr(psrc, "test", []byte("value")); err != nil {
+		xattrs = false
+		t.Logf("extended attributes are not checked: %v", err)
+	} else if err := setXattr(psrc, aclAttr, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(psrc, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		dst      string
+		preserve bool
+	}{
+		{"preserve", h.home + "/preserved.txt", true},
+		{"no preserve", h.home + "/copied.txt", false},
+	}
+
+	for _, tt := range tests {
+		_, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: h.token, Src: src, Dst: tt.dst, Preserve: tt.preserve})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		pdst := path.Join(h.dataDir, tt.dst)
+		finfo, err := os.Stat(pdst)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := finfo.Mode().Perm() == 0600; got != tt.preserve {
+			t.Errorf("%s: got mode %v", tt.name, finfo.Mode())
+		}
+		if got := finfo.ModTime().Equal(mtime); got != tt.preserve {
+			t.Errorf("%s: got modification time %v", tt.name, finfo.ModTime())
+		}
+		if xattrs && tt.preserve {
+			val, err := getXattr(pdst, "test")
+			if err != nil || string(val) != "value" {
+				t.Errorf("%s: got attribute %q (%v), want %q", tt.name, val, err, "value")
+			}
+			if _, err := getXattr(pdst, aclAttr); err != errAttrNotFound {
+				t.Errorf("%s: internal attribute %s has been copied", tt.name, aclAttr)
+			}
+		}
+	}
+}
+
+func TestCopyDirPreserve(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "localfs-meta-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	mtime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	for _, p := range []string{"/src/a", "/src/c/d"} {
+		pp := path.Join(dataDir, p)
+		if err := os.MkdirAll(path.Dir(pp), dirPerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pp, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"/src/c", "/src"} {
+		if err := os.Chmod(path.Join(dataDir, p), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path.Join(dataDir, p), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layout, _ := newHomeLayout(homeLayoutLetter, false)
+	l := newLocalStorage(dataDir, dataDir, layout)
+	if err := l.Copy(context.Background(), "/src", "/dst", copyOptions{preserve: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/dst/c", "/dst"} {
+		finfo, err := os.Stat(path.Join(dataDir, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finfo.Mode().Perm() != 0750 {
+			t.Errorf("%s: got mode %v, want %v", p, finfo.Mode().Perm(), os.FileMode(0750))
+		}
+		if !finfo.ModTime().Equal(mtime) {
+			t.Errorf("%s: got modification time %v, want %v", p, finfo.ModTime(), mtime)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// getFreeBytes returns the bytes available to unprivileged users
+// in the filesystem of pp.
+func getFreeBytes(pp string) (uint64, bool, error) {
+	st := unix.Statfs_t{}
+	if err := unix.Statfs(pp, &st); err != nil {
+		return 0, false, err
+	}
+	return st.Bavail * uint64(st.Bsize), true, nil
+}
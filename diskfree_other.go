@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// getFreeBytes is only available on Linux.
+func getFreeBytes(pp string) (uint64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	proppb "github.com/clawio/service-localfs-meta/proto/propagator"
+	"github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeProp is an in-memory implementation of the propagator service.
+// It keeps one record per path and, like the real propagator, it
+// propagates a new etag and modification time to all the ancestors
+// of a path that changes.
+type fakeProp struct {
+	mu      sync.Mutex
+	records map[string]*proppb.Record
+
+	// calls counts the calls made to every method.
+	calls map[string]int
+
+	// tokens are the access tokens Put has been called with in the metadata.
+	tokens []string
+
+	// errs are the errors the methods fail with.
+	errs map[string]error
+}
+
+func newFakeProp() *fakeProp {
+	return &fakeProp{records: map[string]*proppb.Record{}, calls: map[string]int{}, errs: map[string]error{}}
+}
+
+func (f *fakeProp) Put(ctx context.Context, req *proppb.PutReq) (*proppb.Void, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["put"]++
+	if err := f.errs["put"]; err != nil {
+		return nil, err
+	}
+	f.tokens = append(f.tokens, getMetadataToken(ctx))
+
+	p := path.Clean(req.Path)
+	rec := f.getOrCreate(p)
+	rec.Checksum = req.Checksum
+	f.propagate(p)
+	return &proppb.Void{}, nil
+}
+
+func (f *fakeProp) Get(ctx context.Context, req *proppb.GetReq) (*proppb.Record, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["get"]++
+	if err := f.errs["get"]; err != nil {
+		return nil, err
+	}
+
+	rec, ok := f.get(path.Clean(req.Path), req.ForceCreation)
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "record %s not found", path.Clean(req.Path))
+	}
+	return rec, nil
+}
+
+func (f *fakeProp) GetBatch(ctx context.Context, req *proppb.GetBatchReq) (*proppb.RecordList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["getbatch"]++
+	if err := f.errs["getbatch"]; err != nil {
+		return nil, err
+	}
+
+	list := &proppb.RecordList{}
+	for _, p := range req.Paths {
+		if rec, ok := f.get(path.Clean(p), req.ForceCreation); ok {
+			list.Records = append(list.Records, rec)
+		}
+	}
+	return list, nil
+}
+
+func (f *fakeProp) Mv(ctx context.Context, req *proppb.MvReq) (*proppb.Void, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["mv"]++
+	if err := f.errs["mv"]; err != nil {
+		return nil, err
+	}
+
+	src := path.Clean(req.Src)
+	dst := path.Clean(req.Dst)
+	for p, rec := range f.records {
+		if p == src || strings.HasPrefix(p, src+"/") {
+			delete(f.records, p)
+			rec.Path = dst + strings.TrimPrefix(p, src)
+			f.records[rec.Path] = rec
+		}
+	}
+	f.propagate(path.Dir(src))
+	f.propagate(dst)
+	return &proppb.Void{}, nil
+}
+
+func (f *fakeProp) Rm(ctx context.Context, req *proppb.RmReq) (*proppb.Void, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["rm"]++
+	if err := f.errs["rm"]; err != nil {
+		return nil, err
+	}
+
+	p := path.Clean(req.Path)
+	for k := range f.records {
+		if k == p || strings.HasPrefix(k, p+"/") {
+			delete(f.records, k)
+		}
+	}
+	f.propagate(path.Dir(p))
+	return &proppb.Void{}, nil
+}
+
+// record returns a copy of the record saved for p.
+func (f *fakeProp) record(p string) (proppb.Record, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rec, ok := f.records[path.Clean(p)]
+	if !ok {
+		return proppb.Record{}, false
+	}
+	return *rec, true
+}
+
+// fail makes method fail with err. A nil err makes it work again.
+func (f *fakeProp) fail(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[method] = err
+}
+
+// callCount returns the number of calls made to the method and resets it.
+func (f *fakeProp) callCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := f.calls[method]
+	f.calls[method] = 0
+	return n
+}
+
+// get returns a copy of the record of p, creating it if force is set.
+func (f *fakeProp) get(p string, force bool) (*proppb.Record, bool) {
+	rec, ok := f.records[p]
+	if !ok {
+		if !force {
+			return nil, false
+		}
+		rec = f.getOrCreate(p)
+		f.propagate(p)
+	}
+	cp := *rec
+	return &cp, true
+}
+
+func (f *fakeProp) getOrCreate(p string) *proppb.Record {
+	rec, ok := f.records[p]
+	if ok {
+		return rec
+	}
+	rec = &proppb.Record{}
+	rec.Id = newFakeID()
+	rec.Path = p
+	f.records[p] = rec
+	return rec
+}
+
+// propagate sets a new etag and modification time to p and its ancestors.
+func (f *fakeProp) propagate(p string) {
+	modified := uint32(time.Now().Unix())
+	for {
+		rec := f.getOrCreate(p)
+		rec.Etag = newFakeID()
+		rec.Modified = modified
+		if p == "/" || p == "." {
+			return
+		}
+		p = path.Dir(p)
+	}
+}
+
+func newFakeID() string {
+	u, err := uuid.NewV4()
+	if err != nil {
+		panic(fmt.Sprintf("cannot create uuid: %s", err))
+	}
+	return u.String()
+}
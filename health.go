@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1alpha"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheckTimeout is how long prop has to answer a health check.
+const healthCheckTimeout = 5 * time.Second
+
+// healthServices are the services the health status is given for.
+// The empty name is the server as a whole.
+var healthServices = []string{"", "metadata.Meta"}
+
+// healthChecker implements the standard gRPC health service.
+// The status is computed in the background by checking that the data and
+// tmp dirs are writable, that there is enough free space in them, that
+// prop answers and that its circuit breaker is not open, so a replica
+// with a broken disk or prop is taken out of service by the orchestrator.
+type healthChecker struct {
+	s            *server
+	minFreeBytes uint64
+	timeout      time.Duration
+
+	mu       sync.Mutex
+	status   healthpb.HealthCheckResponse_ServingStatus
+	problems []string
+	stopped  bool
+}
+
+func newHealthChecker(s *server, minFreeBytes uint64) *healthChecker {
+	return &healthChecker{s: s, minFreeBytes: minFreeBytes, timeout: healthCheckTimeout, status: healthpb.HealthCheckResponse_UNKNOWN}
+}
+
+// Check returns the last status computed.
+func (h *healthChecker) Check(ctx context.Context, in *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	for _, service := range healthServices {
+		if in.Service == service {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			return &healthpb.HealthCheckResponse{Status: h.status}, nil
+		}
+	}
+	return nil, grpc.Errorf(codes.NotFound, "unknown service")
+}
+
+// run updates the status every interval until stop is closed.
+func (h *healthChecker) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.update()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// update runs the checks and sets the status. Changes are logged.
+func (h *healthChecker) update() {
+	problems := h.check()
+
+	status := healthpb.HealthCheckResponse_SERVING
+	if len(problems) > 0 {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	h.mu.Lock()
+	if h.stopped {
+		h.mu.Unlock()
+		return
+	}
+	changed := status != h.status || strings.Join(problems, "") != strings.Join(h.problems, "")
+	h.status = status
+	h.problems = problems
+	h.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if len(problems) > 0 {
+		rus.WithField("status", status.String()).Errorf("health check failed: %s", strings.Join(problems, "; "))
+		return
+	}
+	rus.WithField("status", status.String()).Info("health check passed")
+}
+
+// shutdown sets the status to NOT_SERVING for good,
+// so traffic is routed away while the server drains.
+func (h *healthChecker) shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status = healthpb.HealthCheckResponse_NOT_SERVING
+	h.stopped = true
+}
+
+// check runs all the checks and returns the problems found.
+func (h *healthChecker) check() []string {
+	problems := []string{}
+	for _, dir := range []string{h.s.c.DataDir, h.s.c.TmpDir} {
+		if err := checkWritable(dir); err != nil {
+			problems = append(problems, fmt.Sprintf("%s is not writable: %s", dir, err.Error()))
+			continue
+		}
+		if err := checkFreeSpace(dir, h.minFreeBytes); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if state := h.s.propBreaker.getState(); state == breakerOpen {
+		problems = append(problems, fmt.Sprintf("circuit breaker to prop is %s", state))
+	}
+	if err := h.checkProp(); err != nil {
+		problems = append(problems, fmt.Sprintf("prop at %s does not answer: %s", h.s.c.Prop, err.Error()))
+	}
+	return problems
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	fd, err := ioutil.TempFile(dir, ".health")
+	if err != nil {
+		return err
+	}
+	fd.Close()
+	return os.Remove(fd.Name())
+}
+
+// checkFreeSpace checks that the filesystem of dir has more than min bytes free.
+func checkFreeSpace(dir string, min uint64) error {
+	if min == 0 {
+		return nil
+	}
+	free, ok, err := getFreeBytes(dir)
+	if err != nil {
+		return err
+	}
+	if ok && free < min {
+		return fmt.Errorf("%s has %d bytes free, less than %d", dir, free, min)
+	}
+	return nil
+}
+
+// checkProp asks prop for its health. Any answer, even that prop has no
+// health service, means prop is up: only the errors that mean it could
+// not be reached are problems.
+func (h *healthChecker) checkProp() error {
+	resource, err := h.s.grpcPool.Get("")
+	if err != nil {
+		return err
+	}
+	defer resource.Release()
+
+	handle, err := resource.Handle()
+	if err != nil {
+		return err
+	}
+	con := handle.(*grpc.ClientConn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	res, err := healthpb.NewHealthClient(con).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		switch grpc.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled, codes.Internal:
+			return err
+		}
+		return nil
+	}
+	if res.Status == healthpb.HealthCheckResponse_NOT_SERVING {
+		return fmt.Errorf("prop is %s", res.Status.String())
+	}
+	return nil
+}
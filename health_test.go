@@ -0,0 +1,87 @@
+package main
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1alpha"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	checker := newHealthChecker(h.srv, 0)
+	checker.timeout = 500 * time.Millisecond
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, checker)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	con, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	client := healthpb.NewHealthClient(con)
+
+	status := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		res, err := client.Check(h.ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Status
+	}
+
+	if s := status(""); s != healthpb.HealthCheckResponse_UNKNOWN {
+		t.Fatalf("got %s before the first check, want UNKNOWN", s)
+	}
+
+	checker.update()
+	for _, service := range healthServices {
+		if s := status(service); s != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("got %s for %q, want SERVING: %v", s, service, checker.problems)
+		}
+	}
+
+	if _, err := client.Check(h.ctx, &healthpb.HealthCheckRequest{Service: "other"}); grpc.Code(err) != codes.NotFound {
+		t.Fatalf("got %v for unknown service, want NotFound", err)
+	}
+
+	// Not enough free space.
+	checker.minFreeBytes = 1 << 62
+	if _, ok, _ := getFreeBytes(h.dataDir); ok {
+		checker.update()
+		if s := status(""); s != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Fatalf("got %s without free space, want NOT_SERVING", s)
+		}
+	}
+	checker.minFreeBytes = 0
+
+	// The tmp dir is gone.
+	os.RemoveAll(h.srv.c.TmpDir)
+	checker.update()
+	if s := status(""); s != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("got %s without tmp dir, want NOT_SERVING", s)
+	}
+	os.MkdirAll(h.srv.c.TmpDir, dirPerm)
+	checker.update()
+	if s := status(""); s != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("got %s with tmp dir back, want SERVING: %v", s, checker.problems)
+	}
+
+	// prop is down.
+	h.propSrv.Stop()
+	checker.update()
+	if s := status(""); s != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("got %s without prop, want NOT_SERVING", s)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	proppb "github.com/clawio/service-localfs-meta/proto/propagator"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// identityMap links identities of several idps to one storage account
+// and tells which homes must be migrated when the idp of a user changes.
+// Identities and accounts are written as <idp>/<pid>.
+type identityMap struct {
+	// Links maps an identity to the account it uses.
+	Links map[string]string `json:"links"`
+
+	// Migrations maps an identity to the account whose home is moved
+	// to the home of the identity the first time the home is asked for.
+	Migrations map[string]string `json:"migrations"`
+}
+
+// loadIdentityMap reads the identity map from a JSON file with the format
+// {"links": {"<idp>/<pid>": "<idp>/<pid>"}, "migrations": {"<idp>/<pid>": "<idp>/<pid>"}}.
+// An empty file name means there are no links nor migrations.
+func loadIdentityMap(fn string) (*identityMap, error) {
+	m := &identityMap{Links: map[string]string{}, Migrations: map[string]string{}}
+	if fn == "" {
+		return m, nil
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+
+	for _, entries := range []map[string]string{m.Links, m.Migrations} {
+		for k, v := range entries {
+			if _, err := parseAccount(k); err != nil {
+				return nil, err
+			}
+			if _, err := parseAccount(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if m.Links == nil {
+		m.Links = map[string]string{}
+	}
+	if m.Migrations == nil {
+		m.Migrations = map[string]string{}
+	}
+	return m, nil
+}
+
+// parseAccount returns the identity written as <idp>/<pid>.
+func parseAccount(account string) (*authlib.Identity, error) {
+	tokens := strings.Split(account, "/")
+	if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+		return nil, fmt.Errorf("account %s is not <idp>/<pid>", account)
+	}
+	return &authlib.Identity{Idp: tokens[0], Pid: tokens[1]}, nil
+}
+
+// getAccountID returns the id the resources of the user are kept under
+// in the areas outside the homes, like the trash, the versions, the shares
+// and the quota overrides. It is the pid, or <idp>/<pid> when the homes
+// are separated by idp.
+func (s *server) getAccountID(idt *authlib.Identity) string {
+	if s.layout.hasIdp() {
+		return path.Join(path.Clean(idt.Idp), path.Clean(idt.Pid))
+	}
+	return path.Clean(idt.Pid)
+}
+
+// parseToken returns the identity of the access token mapped
+// to the storage account it is linked to.
+func (s *server) parseToken(token string) (*authlib.Identity, error) {
+	idt, err := s.tokens.parse(token)
+	if err != nil {
+		return nil, err
+	}
+	return s.mapIdentity(idt), nil
+}
+
+// mapIdentity returns the identity of the account idt is linked to,
+// or idt if it is not linked. Links are not followed transitively.
+func (s *server) mapIdentity(idt *authlib.Identity) *authlib.Identity {
+	if s.c.identities == nil {
+		return idt
+	}
+	account, ok := s.c.identities.Links[path.Join(idt.Idp, idt.Pid)]
+	if !ok {
+		return idt
+	}
+
+	linked, _ := parseAccount(account)
+	mapped := *idt
+	mapped.Idp = linked.Idp
+	mapped.Pid = linked.Pid
+	return &mapped
+}
+
+// migrateHome moves the home of the account the user is migrated from
+// to the new home. It does nothing if there is no migration for the
+// user or if the old home does not exist. The trash entries and the
+// shares follow the home. Versions are kept by path, so like with a
+// rename they are not carried over.
+// It must be called when the new home does not exist yet.
+func (s *server) migrateHome(ctx context.Context, token string, idt *authlib.Identity, client proppb.PropClient, log *rus.Entry) (bool, error) {
+	if s.c.identities == nil {
+		return false, nil
+	}
+	account, ok := s.c.identities.Migrations[path.Join(idt.Idp, idt.Pid)]
+	if !ok {
+		return false, nil
+	}
+	old, _ := parseAccount(account)
+
+	oldHome := s.getHome(old)
+	home := s.getHome(idt)
+	if oldHome == home {
+		return false, nil
+	}
+
+	_, err := s.storage.Stat(oldHome)
+	if os.IsNotExist(err) {
+		log.Infof("home %s to migrate from does not exist", oldHome)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.storage.MkdirAll(path.Dir(home)); err != nil {
+		return false, err
+	}
+	if err := s.storage.Move(oldHome, home); err != nil {
+		return false, err
+	}
+
+	log.Infof("migrated home %s to %s", oldHome, home)
+
+	s.usages.invalidate(oldHome)
+	s.usages.invalidate(home)
+
+	if err := s.migrateTrash(old, idt, oldHome, home); err != nil {
+		log.Errorf("trash of %s has not been migrated because %s", account, err.Error())
+	}
+	s.migrateShares(old, idt, oldHome, home, log)
+	s.moveVersionsUnder(oldHome, old, home, idt, log)
+
+	in := &proppb.MvReq{}
+	in.Src = oldHome
+	in.Dst = home
+	in.AccessToken = token
+
+	if _, err := client.Mv(ctx, in); err != nil {
+		return true, err
+	}
+
+	log.Infof("migrated home %s to %s in prop", oldHome, home)
+
+	return true, nil
+}
+
+// migrateTrash moves the trash of the old account to the new one and
+// points the entries deleted from the old home to the new home.
+func (s *server) migrateTrash(old, idt *authlib.Identity, oldHome, home string) error {
+	oldTrash := s.getTrash(old)
+	trash := s.getTrash(idt)
+	if oldTrash == trash {
+		return nil
+	}
+
+	if _, err := s.storage.Stat(oldTrash); os.IsNotExist(err) {
+		return nil
+	}
+	if err := s.storage.MkdirAll(path.Dir(trash)); err != nil {
+		return err
+	}
+	if err := s.storage.Move(oldTrash, trash); err != nil {
+		return err
+	}
+
+	keys, err := s.storage.List(trash)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		entry := path.Join(trash, key)
+		p, err := s.storage.GetAttr(entry, trashPathAttr)
+		if err != nil || !isUnder(string(p), oldHome) {
+			continue
+		}
+		moved := path.Join(home, strings.TrimPrefix(string(p), oldHome))
+		if err := s.storage.SetAttr(entry, trashPathAttr, []byte(moved)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateShares hands the shares of the old account to the new one:
+// the grants on the old home are moved to the new home and the grants
+// given to the old account are given to the new one.
+func (s *server) migrateShares(old, idt *authlib.Identity, oldHome, home string, log *rus.Entry) {
+	oldAccount := s.getAccountID(old)
+	account := s.getAccountID(idt)
+
+	owned := s.shares.list(func(sh *pb.Share) bool {
+		return sh.Owner == oldAccount && isUnder(sh.Path, oldHome)
+	})
+	for _, sh := range owned {
+		moved := *sh
+		moved.Owner = account
+		moved.Path = path.Join(home, strings.TrimPrefix(sh.Path, oldHome))
+
+		attrs := map[string]string{shareOwnerAttr: moved.Owner, sharePathAttr: moved.Path}
+		if sh.GranteeType == granteeTypeLink {
+			li, err := json.Marshal(&linkIdentity{Pid: idt.Pid, Idp: idt.Idp, Email: idt.Email, DisplayName: idt.DisplayName})
+			if err != nil {
+				log.Errorf("share %s has not been migrated because %s", sh.Id, err.Error())
+				continue
+			}
+			attrs[shareIdentityAttr] = string(li)
+		}
+		if err := s.setShareAttrs(sh.Id, attrs); err != nil {
+			log.Errorf("share %s has not been migrated because %s", sh.Id, err.Error())
+			continue
+		}
+		s.shares.add(&moved)
+	}
+
+	granted := s.shares.list(func(sh *pb.Share) bool {
+		return sh.GranteeType == granteeTypeUser && sh.Grantee == oldAccount
+	})
+	for _, sh := range granted {
+		moved := *sh
+		moved.Grantee = account
+		if err := s.setShareAttrs(sh.Id, map[string]string{shareGranteeAttr: account}); err != nil {
+			log.Errorf("share %s has not been migrated because %s", sh.Id, err.Error())
+			continue
+		}
+		s.shares.add(&moved)
+	}
+}
+
+// setShareAttrs changes the attributes of the share grant id.
+func (s *server) setShareAttrs(id string, attrs map[string]string) error {
+	for k, v := range attrs {
+		if err := s.storage.SetAttr(path.Join(sharesDir, id), k, []byte(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
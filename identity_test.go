@@ -0,0 +1,175 @@
+package main
+
+import (
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHomeLayoutWithIdp(t *testing.T) {
+	tests := []struct {
+		layout string
+		home   string
+	}{
+		{homeLayoutLetter, "/local/users/ldap/d/demo"},
+		{homeLayoutFlat, "/home/ldap/demo"},
+		{homeLayoutHashed, "/home/ldap/89/e4/demo"},
+		{homeLayoutIdp, "/ldap/demo"},
+	}
+
+	idt := &authlib.Identity{Idp: "ldap", Pid: "demo"}
+	for _, tt := range tests {
+		layout, err := newHomeLayout(tt.layout, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &server{layout: layout}
+
+		if !layout.hasIdp() {
+			t.Errorf("%s: homes are not separated by idp", tt.layout)
+		}
+		if home := s.getHome(idt); home != tt.home {
+			t.Errorf("%s: got home %s, want %s", tt.layout, home, tt.home)
+		}
+		owner := s.getOwner(tt.home + "/photos")
+		if owner == nil || owner.Idp != "ldap" || owner.Pid != "demo" {
+			t.Errorf("%s: got owner %+v", tt.layout, owner)
+		}
+		if other := s.getHome(&authlib.Identity{Idp: "local", Pid: "demo"}); other == tt.home {
+			t.Errorf("%s: users of different idps share the home %s", tt.layout, other)
+		}
+		if id := s.getAccountID(idt); id != "ldap/demo" {
+			t.Errorf("%s: got account %s, want %s", tt.layout, id, "ldap/demo")
+		}
+	}
+}
+
+func TestLoadIdentityMap(t *testing.T) {
+	m, err := loadIdentityMap("")
+	if err != nil || len(m.Links) != 0 || len(m.Migrations) != 0 {
+		t.Fatalf("got %+v (%v), want an empty map", m, err)
+	}
+
+	tests := []struct {
+		data string
+		ok   bool
+	}{
+		{`{"links": {"ldap/jdoe": "local/demo"}}`, true},
+		{`{"migrations": {"ldap/demo": "local/demo"}}`, true},
+		{`{"links": {"jdoe": "local/demo"}}`, false},
+		{`{"migrations": {"ldap/demo": "local/"}}`, false},
+		{`{"links": []}`, false},
+	}
+
+	for _, tt := range tests {
+		f, err := ioutil.TempFile("", "identities")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(tt.data)
+		f.Close()
+
+		m, err := loadIdentityMap(f.Name())
+		os.Remove(f.Name())
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.data, err)
+			continue
+		}
+		if tt.ok && (m.Links == nil || m.Migrations == nil) {
+			t.Errorf("%s: got nil maps", tt.data)
+		}
+	}
+}
+
+func TestIdentityLinks(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/a.txt", "a")
+	h.srv.c.identities = &identityMap{Links: map[string]string{"ldap/jdoe": "local/demo"}}
+
+	linked := newTestIdpToken(t, "ldap", "jdoe")
+	if _, err := h.client.Home(h.ctx, &pb.HomeReq{AccessToken: linked}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: linked, Path: h.home, Children: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Children) != 1 || m.Permissions != permAll&^permDelete {
+		t.Errorf("got %d children and permissions %05b", len(m.Children), m.Permissions)
+	}
+	if _, err := h.client.Mkdir(h.ctx, &pb.MkdirReq{AccessToken: linked, Path: h.home + "/ldap"}); err != nil {
+		t.Fatal(err)
+	}
+	if h.exists("/local/users/j/jdoe") {
+		t.Errorf("a home has been created for the linked identity")
+	}
+}
+
+func TestMigrateHome(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	layout, err := newHomeLayout(homeLayoutIdp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.srv.layout = layout
+	h.srv.storage = newLocalStorage(h.dataDir, h.dataDir, layout)
+
+	oldHome := "/local/demo"
+	newHome := "/ldap/demo"
+	if _, err := h.client.Home(h.ctx, &pb.HomeReq{AccessToken: h.token}); err != nil {
+		t.Fatal(err)
+	}
+	h.writeFile(oldHome+"/photos/a.jpg", "a")
+	h.writeFile(oldHome+"/old.txt", "old")
+	h.home = oldHome
+	h.rmToTrash(oldHome + "/old.txt")
+	sh := h.share(oldHome+"/photos", "local/other", "user", "read")
+
+	h.srv.c.identities = &identityMap{Migrations: map[string]string{"ldap/demo": "local/demo"}}
+	token := newTestIdpToken(t, "ldap", "demo")
+	if _, err := h.client.Home(h.ctx, &pb.HomeReq{AccessToken: token}); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.exists(oldHome) {
+		t.Errorf("old home %s is still there", oldHome)
+	}
+	if !h.exists(newHome + "/photos/a.jpg") {
+		t.Errorf("files have not been migrated to %s", newHome)
+	}
+	if _, ok := h.prop.record(newHome); !ok {
+		t.Errorf("%s has not been moved in prop", newHome)
+	}
+
+	list, err := h.client.ListTrash(h.ctx, &pb.ListTrashReq{AccessToken: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 1 || list.Entries[0].Path != newHome+"/old.txt" {
+		t.Errorf("got trash entries %+v", list.Entries)
+	}
+
+	shares, err := h.client.ListShares(h.ctx, &pb.ListSharesReq{AccessToken: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares.Shares) != 1 || shares.Shares[0].Id != sh.Id || shares.Shares[0].Path != path.Join(newHome, "photos") || shares.Shares[0].Owner != "ldap/demo" {
+		t.Errorf("got shares %+v", shares.Shares)
+	}
+
+	// The migration is only done once, the home exists now.
+	h.writeFile(oldHome+"/new.txt", "new")
+	if _, err := h.client.Home(h.ctx, &pb.HomeReq{AccessToken: token}); err != nil {
+		t.Fatal(err)
+	}
+	if !h.exists(oldHome + "/new.txt") {
+		t.Errorf("home has been migrated twice")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"reflect"
+)
+
+// The vendored grpc has no interceptors, so the Meta service is registered
+// with a service description built here that runs every call through one.
+// The types follow the ones of newer grpc versions.
+
+// unaryServerInfo describes the call an interceptor is run for.
+type unaryServerInfo struct {
+	// server is the implementation of the service.
+	server interface{}
+
+	// fullMethod is the name of the method, i.e /metadata.Meta/Stat.
+	fullMethod string
+
+	// isServerStream tells if the method streams its responses.
+	isServerStream bool
+}
+
+// unaryHandler calls the method with the request.
+type unaryHandler func(ctx context.Context, req interface{}) (interface{}, error)
+
+// unaryServerInterceptor runs around a call. It must call handler to
+// continue with the call, with the context the method must see.
+// Methods that stream their responses receive a single request too, so
+// they go through the same interceptor and their response is always nil.
+type unaryServerInterceptor func(ctx context.Context, req interface{}, info *unaryServerInfo, handler unaryHandler) (interface{}, error)
+
+// metaStreams returns the typed streams the streaming methods of Meta are called with.
+var metaStreams = map[string]func(stream grpc.ServerStream) interface{}{
+	"ListDir": func(stream grpc.ServerStream) interface{} {
+		return &metaListDirServer{stream}
+	},
+	"CpWithProgress": func(stream grpc.ServerStream) interface{} {
+		return &metaCpWithProgressServer{stream}
+	},
+}
+
+// registerMetaServer registers srv in the grpc server like
+// pb.RegisterMetaServer does, with all the calls intercepted.
+func registerMetaServer(g *grpc.Server, srv pb.MetaServer, interceptor unaryServerInterceptor) {
+	g.RegisterService(newServiceDesc("metadata.Meta", (*pb.MetaServer)(nil), metaStreams, interceptor), srv)
+}
+
+// newServiceDesc builds the description of the service implementing
+// the interface handlerType points to, with a method for every
+// method of the interface. Methods in streams stream their responses
+// over the stream the constructor builds.
+func newServiceDesc(name string, handlerType interface{}, streams map[string]func(stream grpc.ServerStream) interface{}, interceptor unaryServerInterceptor) *grpc.ServiceDesc {
+	sd := &grpc.ServiceDesc{}
+	sd.ServiceName = name
+	sd.HandlerType = handlerType
+
+	t := reflect.TypeOf(handlerType).Elem()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		info := &unaryServerInfo{fullMethod: fmt.Sprintf("/%s/%s", name, m.Name)}
+
+		if newStream, ok := streams[m.Name]; ok {
+			info.isServerStream = true
+			sd.Streams = append(sd.Streams, grpc.StreamDesc{
+				StreamName:    m.Name,
+				Handler:       newStreamHandler(m, info, newStream, interceptor),
+				ServerStreams: true,
+			})
+			continue
+		}
+
+		sd.Methods = append(sd.Methods, grpc.MethodDesc{
+			MethodName: m.Name,
+			Handler:    newMethodHandler(m, info, interceptor),
+		})
+	}
+	return sd
+}
+
+// newMethodHandler returns the handler of the method
+// Name(context.Context, *Req) (*Res, error).
+func newMethodHandler(m reflect.Method, info *unaryServerInfo, interceptor unaryServerInterceptor) func(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	reqType := m.Type.In(1).Elem()
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+		req := reflect.New(reqType).Interface()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			out := reflect.ValueOf(srv).MethodByName(m.Name).Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(req)})
+			return out[0].Interface(), toError(out[1])
+		}
+
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		i := *info
+		i.server = srv
+		return interceptor(ctx, req, &i, handler)
+	}
+}
+
+// newStreamHandler returns the handler of the method
+// Name(*Req, Meta_NameServer) error.
+func newStreamHandler(m reflect.Method, info *unaryServerInfo, newStream func(stream grpc.ServerStream) interface{}, interceptor unaryServerInterceptor) func(srv interface{}, stream grpc.ServerStream) error {
+	reqType := m.Type.In(0).Elem()
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		req := reflect.New(reqType).Interface()
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			ss := newStream(&contextStream{stream, ctx})
+			out := reflect.ValueOf(srv).MethodByName(m.Name).Call([]reflect.Value{reflect.ValueOf(req), reflect.ValueOf(ss)})
+			return nil, toError(out[0])
+		}
+
+		if interceptor == nil {
+			_, err := handler(stream.Context(), req)
+			return err
+		}
+		i := *info
+		i.server = srv
+		_, err := interceptor(stream.Context(), req, &i, handler)
+		return err
+	}
+}
+
+func toError(v reflect.Value) error {
+	if v.IsNil() {
+		return nil
+	}
+	return v.Interface().(error)
+}
+
+// contextStream is a stream whose context is the one
+// the interceptors have built.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+type metaListDirServer struct {
+	grpc.ServerStream
+}
+
+func (s *metaListDirServer) Send(m *pb.Metadata) error {
+	return s.ServerStream.SendMsg(m)
+}
+
+type metaCpWithProgressServer struct {
+	grpc.ServerStream
+}
+
+func (s *metaCpWithProgressServer) Send(m *pb.CpProgress) error {
+	return s.ServerStream.SendMsg(m)
+}
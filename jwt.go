@@ -0,0 +1,508 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	"github.com/dgrijalva/jwt-go"
+	rus "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksReloadInterval is how often the JWKS file is checked for changes.
+const jwksReloadInterval = 30 * time.Second
+
+// tokenOptions are the rules access tokens are validated with.
+type tokenOptions struct {
+	// algorithms are the signing algorithms accepted, i.e HS256 or RS256.
+	algorithms []string
+
+	// issuer and audience are the iss and aud claims tokens must have.
+	// Empty means the claim is not checked.
+	issuer   string
+	audience string
+
+	// skew is the clock difference tolerated when checking exp, nbf and iat.
+	skew time.Duration
+
+	// allowNoExpiry accepts tokens without exp, which never expire.
+	allowNoExpiry bool
+
+	// secret is the shared secret HMAC tokens are signed with.
+	secret string
+
+	// jwksFile is a local JWKS file with more keys, i.e the public keys of
+	// RS256 and ES256 tokens or new shared secrets while they are rotated.
+	jwksFile string
+
+	// signingKey is the RSA or EC private key the service signs its own
+	// tokens with when only asymmetric algorithms are allowed, and
+	// signingKeyID its kid. Its public key must be in the JWKS file.
+	signingKey   interface{}
+	signingKeyID string
+}
+
+// tokenValidator validates access tokens against several active keys.
+// The keys of the JWKS file are reloaded when it changes, so keys
+// can be added and removed without restarting the service.
+type tokenValidator struct {
+	opts tokenOptions
+
+	mu      sync.RWMutex
+	keys    []*jwk
+	modTime time.Time
+}
+
+// jwk is a verification key. A key with a kid is only used for
+// tokens with that kid in their header.
+type jwk struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+// newTokenValidator returns a validator with the keys already loaded.
+func newTokenValidator(opts tokenOptions) (*tokenValidator, error) {
+	if len(opts.algorithms) == 0 {
+		return nil, errors.New("no signing algorithm is allowed")
+	}
+	for _, alg := range opts.algorithms {
+		if alg == "none" || jwt.GetSigningMethod(alg) == nil {
+			return nil, fmt.Errorf("signing algorithm %s is not supported", alg)
+		}
+	}
+	if opts.skew < 0 {
+		return nil, errors.New("clock skew must not be negative")
+	}
+
+	v := &tokenValidator{opts: opts}
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// load reads the keys from the shared secret and the JWKS file.
+func (v *tokenValidator) load() error {
+	keys := []*jwk{}
+	if v.opts.secret != "" {
+		keys = append(keys, &jwk{key: []byte(v.opts.secret)})
+	}
+
+	var modTime time.Time
+	if v.opts.jwksFile != "" {
+		finfo, err := os.Stat(v.opts.jwksFile)
+		if err != nil {
+			return err
+		}
+		modTime = finfo.ModTime()
+
+		fileKeys, err := loadJWKS(v.opts.jwksFile)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	v.modTime = modTime
+	return nil
+}
+
+// reload loads the keys again if the JWKS file has changed. If it cannot
+// be loaded the keys loaded before are kept.
+func (v *tokenValidator) reload() error {
+	if v.opts.jwksFile == "" {
+		return nil
+	}
+	finfo, err := os.Stat(v.opts.jwksFile)
+	if err != nil {
+		return err
+	}
+	v.mu.RLock()
+	changed := !finfo.ModTime().Equal(v.modTime)
+	v.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+
+	if err := v.load(); err != nil {
+		return err
+	}
+	rus.Infof("token keys reloaded from %s", v.opts.jwksFile)
+	return nil
+}
+
+// watch reloads the JWKS file every interval until stop is closed.
+func (v *tokenValidator) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := v.reload(); err != nil {
+				rus.Errorf("token keys have not been reloaded because %s", err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// getKeys returns the keys a token signed with alg and kid can be verified with.
+func (v *tokenValidator) getKeys(alg, kid string) []interface{} {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	keys := []interface{}{}
+	for _, k := range v.keys {
+		if kid != "" && k.kid != "" && k.kid != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != alg {
+			continue
+		}
+		if !isKeyFor(k.key, alg) {
+			continue
+		}
+		keys = append(keys, k.key)
+	}
+	return keys
+}
+
+// isKeyFor checks if key is of the type the algorithm alg verifies with.
+func isKeyFor(key interface{}, alg string) bool {
+	switch key.(type) {
+	case []byte:
+		return strings.HasPrefix(alg, "HS")
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		return strings.HasPrefix(alg, "ES")
+	}
+	return false
+}
+
+// sign returns a token with the claims signed so the validator accepts it.
+// The first allowed algorithm there is a key to sign with is used: the
+// shared secret or an oct key of the JWKS file for HMAC algorithms and the
+// signing key for the rest. The issuer and audience are set when configured.
+func (v *tokenValidator) sign(claims map[string]interface{}) (string, error) {
+	for _, alg := range v.opts.algorithms {
+		kid, key := v.getSigningKey(alg)
+		if key == nil {
+			continue
+		}
+
+		token := jwt.New(jwt.GetSigningMethod(alg))
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		for k, val := range claims {
+			token.Claims[k] = val
+		}
+		if v.opts.issuer != "" {
+			token.Claims["iss"] = v.opts.issuer
+		}
+		if v.opts.audience != "" {
+			token.Claims["aud"] = v.opts.audience
+		}
+		return token.SignedString(key)
+	}
+	return "", fmt.Errorf("no key to sign tokens with %s", strings.Join(v.opts.algorithms, ", "))
+}
+
+// getSigningKey returns the kid and the key to sign tokens with alg.
+// The key is nil if there is none.
+func (v *tokenValidator) getSigningKey(alg string) (string, interface{}) {
+	if strings.HasPrefix(alg, "HS") {
+		if v.opts.secret != "" {
+			return "", []byte(v.opts.secret)
+		}
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+		for _, k := range v.keys {
+			if (k.alg == "" || k.alg == alg) && isKeyFor(k.key, alg) {
+				return k.kid, k.key
+			}
+		}
+		return "", nil
+	}
+
+	switch key := v.opts.signingKey.(type) {
+	case *rsa.PrivateKey:
+		if isKeyFor(&key.PublicKey, alg) {
+			return v.opts.signingKeyID, key
+		}
+	case *ecdsa.PrivateKey:
+		if isKeyFor(&key.PublicKey, alg) {
+			return v.opts.signingKeyID, key
+		}
+	}
+	return "", nil
+}
+
+// loadSigningKey reads an RSA or EC private key from a PEM file.
+func loadSigningKey(fn string) (interface{}, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPrivateKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s has no RSA or EC private key", fn)
+}
+
+// parse validates the token and returns the identity in it.
+func (v *tokenValidator) parse(token string) (*authlib.Identity, error) {
+	alg, kid, err := getTokenHeader(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isAllowedAlgorithm(alg, v.opts.algorithms) {
+		return nil, fmt.Errorf("signing algorithm %q is not allowed", alg)
+	}
+
+	keys := v.getKeys(alg, kid)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no key for token signed with %s and kid %q", alg, kid)
+	}
+
+	parser := &jwt.Parser{ValidMethods: v.opts.algorithms}
+	for _, key := range keys {
+		key := key
+		t, err := parser.Parse(token, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+		if err != nil && !isTimeError(err) {
+			continue
+		}
+		if err := v.validateClaims(t.Claims); err != nil {
+			return nil, err
+		}
+		return getClaimsIdentity(t.Claims)
+	}
+	return nil, errors.New("token signature is invalid")
+}
+
+func isAllowedAlgorithm(alg string, algorithms []string) bool {
+	for _, a := range algorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// isTimeError checks if the only errors found parsing a token are the
+// ones about exp and nbf, which are checked again with the clock skew.
+func isTimeError(err error) bool {
+	verr, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return false
+	}
+	return verr.Errors&^(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) == 0
+}
+
+// validateClaims checks the time, issuer and audience claims.
+// Tokens without exp are rejected unless allowNoExpiry is set.
+func (v *tokenValidator) validateClaims(claims map[string]interface{}) error {
+	now := jwt.TimeFunc()
+	skew := v.opts.skew
+
+	exp, ok := claims["exp"].(float64)
+	if !ok && !v.opts.allowNoExpiry {
+		return errors.New("token has no expiration time")
+	}
+	if ok && now.Add(-skew).After(time.Unix(int64(exp), 0)) {
+		return errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(skew).Before(time.Unix(int64(nbf), 0)) {
+			return errors.New("token is not valid yet")
+		}
+	}
+	if iat, ok := claims["iat"].(float64); ok {
+		if now.Add(skew).Before(time.Unix(int64(iat), 0)) {
+			return errors.New("token is issued in the future")
+		}
+	}
+
+	if v.opts.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.opts.issuer {
+			return fmt.Errorf("token issuer %q is not %q", iss, v.opts.issuer)
+		}
+	}
+	if v.opts.audience != "" && !hasAudience(claims["aud"], v.opts.audience) {
+		return fmt.Errorf("token is not for audience %q", v.opts.audience)
+	}
+	return nil
+}
+
+// hasAudience checks if the aud claim, a string or a list of
+// strings, contains audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, e := range a {
+			if s, ok := e.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getTokenHeader returns the alg and kid in the header of the token.
+func getTokenHeader(token string) (string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", errors.New("token is malformed")
+	}
+	data, err := jwt.DecodeSegment(parts[0])
+	if err != nil {
+		return "", "", err
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return "", "", err
+	}
+	return header.Alg, header.Kid, nil
+}
+
+// getClaimsIdentity returns the identity in the claims, like authlib.ParseToken does.
+func getClaimsIdentity(claims map[string]interface{}) (*authlib.Identity, error) {
+	idt := &authlib.Identity{}
+	for name, dst := range map[string]*string{
+		"pid":          &idt.Pid,
+		"idp":          &idt.Idp,
+		"display_name": &idt.DisplayName,
+		"email":        &idt.Email,
+	} {
+		val, ok := claims[name].(string)
+		if !ok {
+			return nil, fmt.Errorf("claim %s is not a string", name)
+		}
+		*dst = val
+	}
+	return idt, nil
+}
+
+// loadJWKS reads the keys of a JWKS file with the format
+// {"keys": [{"kty": "RSA", "kid": "...", "n": "...", "e": "..."}]}.
+// RSA, EC (P-256, P-384 and P-521) and oct keys are supported.
+func loadJWKS(fn string) ([]*jwk, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	set := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := []*jwk{}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key interface{}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = newRSAKey(k.N, k.E)
+		case "EC":
+			key, err = newECKey(k.Crv, k.X, k.Y)
+		case "oct":
+			key, err = base64.RawURLEncoding.DecodeString(k.K)
+		default:
+			err = fmt.Errorf("key type %s is not supported", k.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %d of %s: %s", i, fn, err.Error())
+		}
+		keys = append(keys, &jwk{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return keys, nil
+}
+
+func newRSAKey(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("rsa exponent is too large")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}, nil
+}
+
+func newECKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("curve %s is not supported", crv)
+	}
+
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("ec point is not on the curve")
+	}
+	return key, nil
+}
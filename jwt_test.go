@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// signTestToken returns a token of demo signed with the method and key,
+// with the claims and the kid given.
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims map[string]interface{}) string {
+	token := jwt.New(method)
+	token.Claims["pid"] = "demo"
+	token.Claims["idp"] = "local"
+	token.Claims["display_name"] = "demo"
+	token.Claims["email"] = "demo@example.org"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	for k, v := range claims {
+		token.Claims[k] = v
+	}
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestValidator(t *testing.T, opts tokenOptions) *tokenValidator {
+	v, err := newTokenValidator(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func writeJWKS(t *testing.T, fn string, keys ...map[string]string) {
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestTokenAlgorithms(t *testing.T) {
+	v := newTestValidator(t, tokenOptions{algorithms: []string{"HS256"}, secret: testSecret})
+
+	idt, err := v.parse(signTestToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idt.Pid != "demo" || idt.Idp != "local" {
+		t.Fatalf("got %s, want demo of local", idt)
+	}
+
+	if _, err := v.parse(signTestToken(t, jwt.SigningMethodHS512, []byte(testSecret), "", nil)); err == nil {
+		t.Fatal("token signed with an algorithm not allowed has been accepted")
+	}
+	if _, err := v.parse(signTestToken(t, jwt.SigningMethodHS256, []byte("other"), "", nil)); err == nil {
+		t.Fatal("token signed with another secret has been accepted")
+	}
+
+	// alg none is never accepted.
+	none := b64([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + b64([]byte(`{"pid":"demo","idp":"local","display_name":"demo","email":"demo"}`)) + "."
+	if _, err := v.parse(none); err == nil {
+		t.Fatal("unsigned token has been accepted")
+	}
+
+	if _, err := newTokenValidator(tokenOptions{algorithms: []string{"none"}}); err == nil {
+		t.Fatal("alg none has been allowed")
+	}
+	if _, err := newTokenValidator(tokenOptions{}); err == nil {
+		t.Fatal("validator without algorithms has been created")
+	}
+}
+
+func TestTokenClaims(t *testing.T) {
+	opts := tokenOptions{}
+	opts.algorithms = []string{"HS256"}
+	opts.secret = testSecret
+	opts.issuer = "https://auth.example.org"
+	opts.audience = "localfs"
+	opts.skew = time.Minute
+	v := newTestValidator(t, opts)
+
+	now := time.Now()
+	valid := map[string]interface{}{"iss": opts.issuer, "aud": []string{"other", "localfs"}}
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		ok     bool
+	}{
+		{"valid", map[string]interface{}{}, true},
+		{"expired within skew", map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}, true},
+		{"expired", map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}, false},
+		{"no expiry", map[string]interface{}{"exp": nil}, false},
+		{"not valid yet within skew", map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}, true},
+		{"not valid yet", map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()}, false},
+		{"issued in the future", map[string]interface{}{"iat": now.Add(2 * time.Minute).Unix()}, false},
+		{"other issuer", map[string]interface{}{"iss": "https://evil.example.org"}, false},
+		{"no issuer", map[string]interface{}{"iss": nil}, false},
+		{"other audience", map[string]interface{}{"aud": "other"}, false},
+		{"audience string", map[string]interface{}{"aud": "localfs"}, true},
+	}
+	for _, tt := range tests {
+		claims := map[string]interface{}{}
+		for k, val := range valid {
+			claims[k] = val
+		}
+		for k, val := range tt.claims {
+			claims[k] = val
+		}
+		_, err := v.parse(signTestToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+
+	// tokens without expiry are only accepted when allowed
+	opts.allowNoExpiry = true
+	v = newTestValidator(t, opts)
+	claims := map[string]interface{}{"iss": opts.issuer, "aud": "localfs", "exp": nil}
+	if _, err := v.parse(signTestToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims)); err != nil {
+		t.Errorf("got %v for a token without expiry", err)
+	}
+}
+
+func TestTokenJWKS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfs-meta-jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn := path.Join(dir, "jwks.json")
+	writeJWKS(t, fn,
+		map[string]string{"kty": "RSA", "kid": "rsa1", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		map[string]string{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		map[string]string{"kty": "oct", "kid": "new", "k": b64([]byte("new secret"))},
+	)
+
+	opts := tokenOptions{}
+	opts.algorithms = []string{"HS256", "RS256", "ES256"}
+	opts.secret = testSecret
+	opts.jwksFile = fn
+	v := newTestValidator(t, opts)
+
+	tokens := map[string]string{
+		"rsa":        signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa1", nil),
+		"ec":         signTestToken(t, jwt.SigningMethodES256, ecKey, "ec1", nil),
+		"old secret": signTestToken(t, jwt.SigningMethodHS256, []byte(testSecret), "", nil),
+		"new secret": signTestToken(t, jwt.SigningMethodHS256, []byte("new secret"), "new", nil),
+		"no kid":     signTestToken(t, jwt.SigningMethodHS256, []byte("new secret"), "", nil),
+	}
+	for name, token := range tokens {
+		if _, err := v.parse(token); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	if _, err := v.parse(signTestToken(t, jwt.SigningMethodRS256, rsaKey, "unknown", nil)); err == nil {
+		t.Fatal("token with unknown kid has been accepted")
+	}
+
+	// The new secret replaces the old one in the file.
+	writeJWKS(t, fn, map[string]string{"kty": "oct", "kid": "newer", "k": b64([]byte("newer secret"))})
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(fn, future, future)
+	if err := v.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.parse(tokens["new secret"]); err == nil {
+		t.Fatal("token of removed key has been accepted")
+	}
+	if _, err := v.parse(signTestToken(t, jwt.SigningMethodHS256, []byte("newer secret"), "newer", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.parse(tokens["old secret"]); err != nil {
+		t.Fatal(err)
+	}
+
+	// A broken file keeps the keys loaded before.
+	ioutil.WriteFile(fn, []byte("{"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(fn, future, future)
+	if err := v.reload(); err == nil {
+		t.Fatal("broken jwks has been loaded")
+	}
+	if _, err := v.parse(signTestToken(t, jwt.SigningMethodHS256, []byte("newer secret"), "newer", nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfs-meta-jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := path.Join(dir, "jwks.json")
+	writeJWKS(t, fn,
+		map[string]string{"kty": "RSA", "kid": "rsa1", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+	)
+
+	claims := map[string]interface{}{}
+	claims["pid"] = "demo"
+	claims["idp"] = "local"
+	claims["email"] = "demo@example.org"
+	claims["display_name"] = "demo"
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+
+	tests := []struct {
+		name string
+		opts tokenOptions
+		ok   bool
+	}{
+		{"secret", tokenOptions{algorithms: []string{"HS256"}, secret: testSecret}, true},
+		{"rsa", tokenOptions{algorithms: []string{"RS256"}, jwksFile: fn, signingKey: rsaKey, signingKeyID: "rsa1"}, true},
+		{"rsa without signing key", tokenOptions{algorithms: []string{"RS256"}, jwksFile: fn}, false},
+		{"ec key for rsa", tokenOptions{algorithms: []string{"RS256"}, jwksFile: fn, signingKey: &ecdsa.PrivateKey{}}, false},
+	}
+
+	for _, tt := range tests {
+		tt.opts.issuer = "https://idp.example.org"
+		tt.opts.audience = "clawio"
+		v := newTestValidator(t, tt.opts)
+
+		token, err := v.sign(claims)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		idt, err := v.parse(token)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if idt.Pid != "demo" {
+			t.Errorf("%s: got %s, want demo", tt.name, idt)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	"path"
+	"strings"
+)
+
+// homeLayout decides where the home of every user is in the namespace.
+// All the checks about homes are derived from it.
+type homeLayout interface {
+	// home returns the home directory of the user.
+	home(idt *authlib.Identity) string
+
+	// owner returns the owner of the home p is under.
+	// It returns nil if p is not under a home.
+	owner(p string) *authlib.Identity
+
+	// isCommon checks if p is above the homes, in the part of
+	// the namespace all logged in users can browse.
+	isCommon(p string) bool
+
+	// hasIdp checks if the homes are separated by idp, so users
+	// with the same pid in different idps have different homes.
+	hasIdp() bool
+}
+
+// Supported home layouts.
+const (
+	homeLayoutLetter = "letter"
+	homeLayoutFlat   = "flat"
+	homeLayoutIdp    = "idp"
+	homeLayoutHashed = "hashed"
+)
+
+// newHomeLayout returns the home layout with the given name.
+// An empty name means the letter layout. If withIdp is true the idp
+// of the owner is placed right under the root of the layout,
+// i.e /local/users/ldap/d/demo. The idp layout always has it.
+func newHomeLayout(name string, withIdp bool) (homeLayout, error) {
+	switch name {
+	case "", homeLayoutLetter:
+		// /local/users/d/demo
+		return &prefixLayout{root: "/local/users", idp: withIdp, depth: 1, shards: func(pid string) []string {
+			return []string{string(pid[0])}
+		}}, nil
+	case homeLayoutFlat:
+		// /home/demo
+		return &prefixLayout{root: "/home", idp: withIdp}, nil
+	case homeLayoutIdp:
+		// /local/demo
+		return &prefixLayout{root: "/", idp: true}, nil
+	case homeLayoutHashed:
+		// /home/89/e4/demo
+		return &prefixLayout{root: "/home", idp: withIdp, depth: 2, shards: func(pid string) []string {
+			sum := sha1.Sum([]byte(pid))
+			h := hex.EncodeToString(sum[:2])
+			return []string{h[:2], h[2:]}
+		}}, nil
+	default:
+		return nil, fmt.Errorf("home layout %s is not supported", name)
+	}
+}
+
+// prefixLayout places the homes at root/[<idp>]/<shards>/<pid>,
+// where the depth shards are derived from the pid of the owner.
+type prefixLayout struct {
+	root   string
+	idp    bool
+	depth  int
+	shards func(pid string) []string
+}
+
+// levels returns the number of elements between the root and the pid.
+func (l *prefixLayout) levels() int {
+	if l.idp {
+		return l.depth + 1
+	}
+	return l.depth
+}
+
+func (l *prefixLayout) home(idt *authlib.Identity) string {
+	pid := path.Clean(idt.Pid)
+	if idt.Pid == "" {
+		panic("idt.Pid must not be empty")
+	}
+
+	elems := []string{l.root}
+	if l.idp {
+		if idt.Idp == "" {
+			panic("idt.Idp must not be empty")
+		}
+		elems = append(elems, path.Clean(idt.Idp))
+	}
+	if l.shards != nil {
+		elems = append(elems, l.shards(pid)...)
+	}
+	return path.Join(append(elems, pid)...)
+}
+
+func (l *prefixLayout) owner(p string) *authlib.Identity {
+	n := l.levels()
+	tokens := l.split(p)
+	if len(tokens) < n+1 {
+		return nil
+	}
+
+	idt := &authlib.Identity{Pid: tokens[n]}
+	if l.idp {
+		idt.Idp = tokens[0]
+	}
+
+	// Shards that do not match the owner are not a home,
+	// i.e /local/users/x/demo
+	home := path.Join(append([]string{l.root}, tokens[:n+1]...)...)
+	if l.home(idt) != home {
+		return nil
+	}
+	return idt
+}
+
+func (l *prefixLayout) isCommon(p string) bool {
+	p = path.Clean(p)
+	if isUnder(l.root, p) {
+		return true
+	}
+	tokens := l.split(p)
+	return tokens != nil && len(tokens) <= l.levels()
+}
+
+func (l *prefixLayout) hasIdp() bool {
+	return l.idp
+}
+
+// split returns the elements of p under the root of the layout.
+// It returns nil if p is not under the root.
+func (l *prefixLayout) split(p string) []string {
+	p = path.Clean(p)
+	if !isUnder(p, l.root) {
+		return nil
+	}
+	rel := strings.Trim(strings.TrimPrefix(p, l.root), "/")
+	if rel == "" {
+		return []string{}
+	}
+	return strings.Split(rel, "/")
+}
+
+// getHome returns the home directory of the user.
+func (s *server) getHome(idt *authlib.Identity) string {
+	return s.layout.home(idt)
+}
+
+// getOwner returns the owner of the home p is under.
+// It returns nil if p is not under a home.
+func (s *server) getOwner(p string) *authlib.Identity {
+	return getOwner(s.layout, p)
+}
+
+// isUnderHome checks if p is the home of the user or is inside it.
+func (s *server) isUnderHome(p string, idt *authlib.Identity) bool {
+	return isUnder(p, s.getHome(idt))
+}
+
+// isUnderOtherHome checks if p is under the home of another user.
+func (s *server) isUnderOtherHome(p string, idt *authlib.Identity) bool {
+	owner := s.getOwner(p)
+	return owner != nil && s.getHome(owner) != s.getHome(idt)
+}
+
+// isCommonDomain checks if p is above the homes.
+func (s *server) isCommonDomain(p string) bool {
+	return s.layout.isCommon(p)
+}
+
+// getOwner returns the owner of the home p is under in the layout.
+// The areas the service keeps for itself are never under a home.
+func getOwner(layout homeLayout, p string) *authlib.Identity {
+	if isHiddenPath(p) {
+		return nil
+	}
+	return layout.owner(p)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"testing"
+)
+
+func TestHomeLayouts(t *testing.T) {
+	idt := &authlib.Identity{Pid: "demo", Idp: "local"}
+
+	tests := []struct {
+		layout  string
+		home    string
+		notHome []string
+		common  []string
+		other   []string
+	}{
+		{homeLayoutLetter, "/local/users/d/demo",
+			[]string{"/local/users/x/demo", "/local/users/d"},
+			[]string{"/", "/local", "/local/users", "/local/users/d"},
+			[]string{"/local/users/d/demo2", "/local/users/o/other/photos"}},
+		{homeLayoutFlat, "/home/demo",
+			[]string{"/home", "/local/users/d/demo"},
+			[]string{"/", "/home"},
+			[]string{"/home/demo2", "/home/demo2/photos"}},
+		{homeLayoutIdp, "/local/demo",
+			[]string{"/local", "/.trash/demo"},
+			[]string{"/", "/local", "/ldap"},
+			[]string{"/ldap/demo", "/local/demo2/photos"}},
+		{homeLayoutHashed, "/home/89/e4/demo",
+			[]string{"/home/00/00/demo", "/home/89/e4"},
+			[]string{"/", "/home", "/home/89", "/home/89/e4"},
+			[]string{"/home/db/61/demo2"}},
+	}
+
+	for _, tt := range tests {
+		layout, err := newHomeLayout(tt.layout, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &server{layout: layout}
+
+		if home := s.getHome(idt); home != tt.home {
+			t.Errorf("%s: got home %s, want %s", tt.layout, home, tt.home)
+		}
+		for _, p := range []string{tt.home, tt.home + "/photos/2015"} {
+			owner := s.getOwner(p)
+			if owner == nil || owner.Pid != idt.Pid {
+				t.Errorf("%s: got owner %+v of %s, want %s", tt.layout, owner, p, idt.Pid)
+			}
+			if !s.isUnderHome(p, idt) || s.isUnderOtherHome(p, idt) {
+				t.Errorf("%s: %s is not under the home", tt.layout, p)
+			}
+		}
+		for _, p := range tt.notHome {
+			if owner := s.getOwner(p); owner != nil && s.getHome(owner) == tt.home {
+				t.Errorf("%s: %s is under the home", tt.layout, p)
+			}
+		}
+		for _, p := range tt.common {
+			if !s.isCommonDomain(p) {
+				t.Errorf("%s: %s is not common", tt.layout, p)
+			}
+		}
+		for _, p := range tt.other {
+			if s.isUnderHome(p, idt) || !s.isUnderOtherHome(p, idt) || s.isCommonDomain(p) {
+				t.Errorf("%s: %s is not under another home", tt.layout, p)
+			}
+		}
+		if s.isCommonDomain(tt.home) {
+			t.Errorf("%s: home is common", tt.layout)
+		}
+	}
+
+	if _, err := newHomeLayout("tree", false); err == nil {
+		t.Errorf("unknown layout has been accepted")
+	}
+}
+
+func TestLetterHomeLayoutNonASCII(t *testing.T) {
+	layout, err := newHomeLayout(homeLayoutLetter, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{layout: layout}
+
+	// The letter is derived from the first byte of the pid,
+	// as the homes created before the layouts were configurable.
+	idt := &authlib.Identity{Pid: "élise", Idp: "local"}
+	want := "/local/users/\u00c3/élise"
+	if home := s.getHome(idt); home != want {
+		t.Errorf("got home %q, want %q", home, want)
+	}
+	if owner := s.getOwner(want + "/photos"); owner == nil || owner.Pid != idt.Pid {
+		t.Errorf("got owner %+v, want %s", owner, idt.Pid)
+	}
+}
+
+func TestFlatHomeLayout(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	layout, err := newHomeLayout(homeLayoutFlat, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.srv.layout = layout
+	h.srv.storage = newLocalStorage(h.dataDir, h.dataDir, layout)
+
+	if _, err := h.client.Home(h.ctx, &pb.HomeReq{AccessToken: h.token}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.client.Mkdir(h.ctx, &pb.MkdirReq{AccessToken: h.token, Path: "/home/demo/photos"}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: "/home/demo", Children: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Children) != 1 || m.Children[0].Path != "/home/demo/photos" {
+		t.Errorf("got children %+v", m.Children)
+	}
+	if !h.exists("/home/demo/photos") {
+		t.Errorf("dir has not been created in the flat home")
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	proppb "github.com/clawio/service-localfs-meta/proto/propagator"
+	"github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	linkModeRead   = "read"
+	linkModeUpload = "upload"
+)
+
+// passwordIterations is the number of PBKDF2 iterations used to hash link passwords.
+const passwordIterations = 10000
+
+// linkTokenTTL is the validity of the tokens minted to talk to prop
+// on behalf of the owner of a link.
+const linkTokenTTL = time.Minute
+
+var (
+	linkNotFound        = grpc.Errorf(codes.NotFound, "link not found")
+	linkPasswordInvalid = grpc.Errorf(codes.Unauthenticated, "link password is not valid")
+)
+
+// linkIdentity is the identity of the owner saved with a link.
+type linkIdentity struct {
+	Pid         string `json:"pid"`
+	Idp         string `json:"idp"`
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name"`
+}
+
+// newLinkToken returns a random token that identifies a link.
+func newLinkToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// pbkdf2 derives a key from the password and the salt as defined in RFC 2898
+// using HMAC-SHA256. Only the first block is computed as it is all we need.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// hashPassword returns the hash of the password saved with a link
+// with the format pbkdf2-sha256:<iterations>:<salt>:<key>.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("pbkdf2-sha256:%d:%s:%s", passwordIterations, hex.EncodeToString(salt), hex.EncodeToString(key)), nil
+}
+
+// checkPassword checks if the password matches the hash.
+func checkPassword(password, hash string) bool {
+	tokens := strings.Split(hash, ":")
+	if len(tokens) != 4 || tokens[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(tokens[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := hex.DecodeString(tokens[2])
+	if err != nil {
+		return false
+	}
+	key, err := hex.DecodeString(tokens[3])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2([]byte(password), salt, iterations), key) == 1
+}
+
+// getLink returns the link with the token if it has not expired.
+func (s *server) getLink(token string) (*pb.Share, error) {
+	links := s.shares.list(func(sh *pb.Share) bool {
+		return sh.GranteeType == granteeTypeLink && sh.Grantee == token
+	})
+	if token == "" || len(links) == 0 {
+		return nil, linkNotFound
+	}
+
+	l := links[0]
+	if l.Expires != 0 && uint32(time.Now().Unix()) > l.Expires {
+		return nil, linkNotFound
+	}
+	if l.Permission != linkModeRead && l.Permission != linkModeUpload {
+		return nil, linkNotFound
+	}
+	return l, nil
+}
+
+// checkLinkPassword checks the password of the link if it has one.
+func (s *server) checkLinkPassword(l *pb.Share, password string) error {
+	if !l.PasswordProtected {
+		return nil
+	}
+	hash, err := s.storage.GetAttr(path.Join(sharesDir, l.Id), sharePasswordAttr)
+	if err != nil {
+		return err
+	}
+	if !checkPassword(password, string(hash)) {
+		return linkPasswordInvalid
+	}
+	return nil
+}
+
+// getLinkAccessToken returns a short lived access token of the owner of
+// the link so the requests to prop are made on behalf of the owner.
+// It is signed like the tokens the service accepts.
+func (s *server) getLinkAccessToken(l *pb.Share) (string, error) {
+	val, err := s.storage.GetAttr(path.Join(sharesDir, l.Id), shareIdentityAttr)
+	if err != nil {
+		return "", err
+	}
+	li := &linkIdentity{}
+	if err := json.Unmarshal(val, li); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{}
+	claims["pid"] = li.Pid
+	claims["idp"] = li.Idp
+	claims["email"] = li.Email
+	claims["display_name"] = li.DisplayName
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(linkTokenTTL).Unix()
+	return s.tokens.sign(claims)
+}
+
+// getLinkPermissions returns the permissions of anyone with the link on the
+// shared resource. Upload links only allow to create children.
+func getLinkPermissions(l *pb.Share) uint32 {
+	if l.Permission == linkModeUpload {
+		return permCreate
+	}
+	return permRead
+}
+
+// toLinkPath returns p relative to the shared resource of the link,
+// so the paths of the owner home are not disclosed.
+func toLinkPath(p string, l *pb.Share) string {
+	return path.Join("/", strings.TrimPrefix(p, l.Path))
+}
+
+func (s *server) CreateLink(ctx context.Context, req *pb.CreateLinkReq) (*pb.Share, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.Share{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	p := path.Clean(req.Path)
+
+	log.Infof("path is %s", p)
+
+	if !s.isUnderHome(p, idt) {
+		log.Error(permissionDenied)
+		return &pb.Share{}, permissionDenied
+	}
+
+	mode := req.Mode
+	if mode == "" {
+		mode = linkModeRead
+	}
+	if mode != linkModeRead && mode != linkModeUpload {
+		return &pb.Share{}, grpc.Errorf(codes.InvalidArgument, "link mode %s is not supported", mode)
+	}
+
+	if req.Expires != 0 && req.Expires <= uint32(time.Now().Unix()) {
+		return &pb.Share{}, grpc.Errorf(codes.InvalidArgument, "expiration time is in the past")
+	}
+
+	finfo, err := s.storage.Stat(p)
+	if err != nil {
+		log.Error(err)
+		return &pb.Share{}, err
+	}
+
+	if mode == linkModeUpload && !finfo.IsDir() {
+		return &pb.Share{}, grpc.Errorf(codes.InvalidArgument, "upload links must point to a container")
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		log.Error(err)
+		return &pb.Share{}, err
+	}
+
+	token, err := newLinkToken()
+	if err != nil {
+		log.Error(err)
+		return &pb.Share{}, err
+	}
+
+	li, err := json.Marshal(&linkIdentity{Pid: idt.Pid, Idp: idt.Idp, Email: idt.Email, DisplayName: idt.DisplayName})
+	if err != nil {
+		log.Error(err)
+		return &pb.Share{}, err
+	}
+
+	extra := map[string]string{}
+	extra[shareExpiresAttr] = strconv.FormatUint(uint64(req.Expires), 10)
+	extra[shareIdentityAttr] = string(li)
+	if req.Password != "" {
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			log.Error(err)
+			return &pb.Share{}, err
+		}
+		extra[sharePasswordAttr] = hash
+	}
+
+	l := &pb.Share{}
+	l.Id = u.String()
+	l.Owner = s.getAccountID(idt)
+	l.Path = p
+	l.Grantee = token
+	l.GranteeType = granteeTypeLink
+	l.Permission = mode
+	l.Created = uint32(time.Now().Unix())
+	l.Expires = req.Expires
+	l.PasswordProtected = req.Password != ""
+
+	err = s.saveShare(l, extra)
+	if err != nil {
+		log.Error(err)
+		return &pb.Share{}, err
+	}
+
+	log.Infof("created %s link %s for %s", mode, l.Id, p)
+
+	return l, nil
+}
+
+func (s *server) StatByLink(ctx context.Context, req *pb.StatByLinkReq) (*pb.Metadata, error) {
+
+	log := getLog(ctx)
+
+	l, err := s.getLink(req.Token)
+	if err != nil {
+		log.Error(err)
+		return &pb.Metadata{}, err
+	}
+
+	log.Infof("link %s of %s", l.Id, l.Path)
+
+	err = s.checkLinkPassword(l, req.Password)
+	if err != nil {
+		log.Error(err)
+		return &pb.Metadata{}, err
+	}
+
+	rel := path.Clean("/" + req.Path)
+	p := path.Join(l.Path, rel)
+
+	log.Infof("path is %s", p)
+
+	// Upload links only disclose the shared container itself.
+	if l.Permission == linkModeUpload && (rel != "/" || req.Children) {
+		log.Error(permissionDenied)
+		return &pb.Metadata{}, permissionDenied
+	}
+
+	accessToken, err := s.getLinkAccessToken(l)
+	if err != nil {
+		log.Error(err)
+		return &pb.Metadata{}, err
+	}
+
+	// prop is called on behalf of the owner of the link.
+	ctx = newAccessTokenContext(ctx, accessToken)
+
+	parentMeta, err := s.getMeta(p)
+	if err != nil {
+		log.Error(err)
+		return &pb.Metadata{}, err
+	}
+
+	resource, err := s.grpcPool.Get("")
+	if err != nil {
+		log.Error(err)
+		return &pb.Metadata{}, err
+	}
+
+	defer resource.Release()
+
+	handle, err := resource.Handle()
+	if err != nil {
+		log.Error(err)
+		return &pb.Metadata{}, err
+	}
+	con := handle.(*grpc.ClientConn)
+	log.Infof("created connection to %s", s.c.Prop)
+
+	client := s.newPropClient(con)
+
+	in := &proppb.GetReq{}
+	in.Path = p
+	in.AccessToken = accessToken
+	in.ForceCreation = true
+
+	rec, err := client.Get(ctx, in)
+	if err != nil {
+		log.Error(err)
+		return &pb.Metadata{}, err
+	}
+
+	parentMeta.Id = rec.Id
+	parentMeta.Etag = rec.Etag
+	parentMeta.Modified = rec.Modified
+	parentMeta.Checksum = rec.Checksum
+	parentMeta.Path = toLinkPath(p, l)
+	parentMeta.Permissions = getLinkPermissions(l)
+
+	if !parentMeta.IsContainer || req.Children == false {
+		return parentMeta, nil
+	}
+
+	opts := listOptions{}
+	opts.prefix = req.Prefix
+	opts.sort = req.Sort
+	opts.cursor = req.Cursor
+	opts.limit = int(req.Limit)
+	opts.permissions = func(string) uint32 { return permRead }
+
+	next, err := s.listChildren(ctx, client, p, opts, s.c.Checksum, accessToken, log, func(m *pb.Metadata) error {
+		m.Path = toLinkPath(m.Path, l)
+		parentMeta.Children = append(parentMeta.Children, m)
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return &pb.Metadata{}, err
+	}
+	parentMeta.NextCursor = next
+
+	log.Infof("added %d entries to parent", len(parentMeta.Children))
+
+	return parentMeta, nil
+}
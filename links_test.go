@@ -0,0 +1,165 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCreateLink(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/photos/a.jpg", "a")
+	h.writeFile(h.otherHome+"/secret.txt", "secret")
+
+	future := uint32(time.Now().Add(time.Hour).Unix())
+	past := uint32(time.Now().Add(-time.Hour).Unix())
+
+	tests := []struct {
+		name  string
+		token string
+		path  string
+		mode  string
+		exp   uint32
+		code  codes.Code
+	}{
+		{"read", h.token, h.home + "/photos", "", 0, codes.OK},
+		{"upload", h.token, h.home + "/photos", "upload", future, codes.OK},
+		{"upload to file", h.token, h.home + "/photos/a.jpg", "upload", 0, codes.InvalidArgument},
+		{"bad mode", h.token, h.home + "/photos", "write", 0, codes.InvalidArgument},
+		{"expired", h.token, h.home + "/photos", "", past, codes.InvalidArgument},
+		{"missing path", h.token, h.home + "/missing", "", 0, codes.NotFound},
+		{"other home", h.token, h.otherHome + "/secret.txt", "", 0, codes.PermissionDenied},
+		{"bad token", "bad", h.home + "/photos", "", 0, codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		req := &pb.CreateLinkReq{AccessToken: tt.token, Path: tt.path, Mode: tt.mode, Expires: tt.exp}
+		l, err := h.client.CreateLink(h.ctx, req)
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code != codes.OK {
+			continue
+		}
+		if l.Grantee == "" || l.GranteeType != granteeTypeLink || l.Expires != tt.exp {
+			t.Errorf("%s: got link %+v", tt.name, l)
+		}
+	}
+
+	// links are listed with the shares of the owner only
+	list, err := h.client.ListShares(h.ctx, &pb.ListSharesReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Shares) != 2 {
+		t.Errorf("got %d shares, want 2", len(list.Shares))
+	}
+}
+
+func TestStatByLink(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/photos/a.jpg", "a")
+	h.writeFile(h.home+"/photos/2015/b.jpg", "b")
+	h.writeFile(h.home+"/private.txt", "private")
+
+	create := func(req *pb.CreateLinkReq) *pb.Share {
+		req.AccessToken = h.token
+		l, err := h.client.CreateLink(h.ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	open := create(&pb.CreateLinkReq{Path: h.home + "/photos"})
+	locked := create(&pb.CreateLinkReq{Path: h.home + "/photos", Password: "s3cret"})
+	upload := create(&pb.CreateLinkReq{Path: h.home + "/photos", Mode: "upload"})
+	expired := create(&pb.CreateLinkReq{Path: h.home + "/photos", Expires: uint32(time.Now().Add(time.Hour).Unix())})
+	// links cannot be created already expired so the index is changed
+	if l, ok := h.srv.shares.get(expired.Id); ok {
+		l.Expires = uint32(time.Now().Add(-time.Hour).Unix())
+	}
+
+	tests := []struct {
+		name     string
+		req      *pb.StatByLinkReq
+		code     codes.Code
+		path     string
+		children []string
+	}{
+		{"root", &pb.StatByLinkReq{Token: open.Grantee, Children: true, Sort: "name"}, codes.OK, "/", []string{"/2015", "/a.jpg"}},
+		{"child", &pb.StatByLinkReq{Token: open.Grantee, Path: "2015", Children: true}, codes.OK, "/2015", []string{"/2015/b.jpg"}},
+		{"escape", &pb.StatByLinkReq{Token: open.Grantee, Path: "../private.txt"}, codes.NotFound, "", nil},
+		{"password", &pb.StatByLinkReq{Token: locked.Grantee, Password: "s3cret"}, codes.OK, "/", nil},
+		{"bad password", &pb.StatByLinkReq{Token: locked.Grantee, Password: "guess"}, codes.Unauthenticated, "", nil},
+		{"no password", &pb.StatByLinkReq{Token: locked.Grantee}, codes.Unauthenticated, "", nil},
+		{"upload root", &pb.StatByLinkReq{Token: upload.Grantee}, codes.OK, "/", nil},
+		{"upload children", &pb.StatByLinkReq{Token: upload.Grantee, Children: true}, codes.PermissionDenied, "", nil},
+		{"upload child", &pb.StatByLinkReq{Token: upload.Grantee, Path: "a.jpg"}, codes.PermissionDenied, "", nil},
+		{"expired", &pb.StatByLinkReq{Token: expired.Grantee}, codes.NotFound, "", nil},
+		{"bad token", &pb.StatByLinkReq{Token: "bad"}, codes.NotFound, "", nil},
+		{"no token", &pb.StatByLinkReq{}, codes.NotFound, "", nil},
+	}
+
+	for _, tt := range tests {
+		m, err := h.client.StatByLink(h.ctx, tt.req)
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code != codes.OK {
+			continue
+		}
+		if m.Path != tt.path {
+			t.Errorf("%s: got path %s, want %s", tt.name, m.Path, tt.path)
+		}
+		paths := []string{}
+		for _, c := range m.Children {
+			paths = append(paths, c.Path)
+		}
+		if tt.children != nil && !reflect.DeepEqual(paths, tt.children) {
+			t.Errorf("%s: got children %v, want %v", tt.name, paths, tt.children)
+		}
+	}
+
+	// upload links only allow to create in the shared container
+	m, err := h.client.StatByLink(h.ctx, &pb.StatByLinkReq{Token: upload.Grantee})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Permissions != permCreate || len(m.Children) != 0 {
+		t.Errorf("got permissions %d and %d children, want %d and none", m.Permissions, len(m.Children), permCreate)
+	}
+
+	// removed links cannot be used anymore
+	if _, err := h.client.RemoveShare(h.ctx, &pb.RemoveShareReq{AccessToken: h.token, Id: open.Id}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.client.StatByLink(h.ctx, &pb.StatByLinkReq{Token: open.Grantee})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.NotFound)
+	}
+}
+
+func TestLinkPassword(t *testing.T) {
+	hash, err := hashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword("s3cret", hash) {
+		t.Errorf("password does not match its hash")
+	}
+	if checkPassword("s3cret!", hash) {
+		t.Errorf("wrong password matches the hash")
+	}
+	if checkPassword("s3cret", "plain:s3cret") {
+		t.Errorf("malformed hash matches")
+	}
+}
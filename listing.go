@@ -0,0 +1,462 @@
+package main
+
+import (
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	proppb "github.com/clawio/service-localfs-meta/proto/propagator"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listChunkSize is the number of entries read from a container at once.
+const listChunkSize = 256
+
+// listOptions are the options to list the children of a container.
+type listOptions struct {
+	prefix string
+	sort   string
+	cursor string
+	limit  int
+
+	// permissions returns the permissions of the caller on a child.
+	permissions func(p string) uint32
+}
+
+// dirEntry is a child of a container with the values it can be sorted by.
+type dirEntry struct {
+	name     string
+	size     int64
+	modified int64
+}
+
+// checkSort returns a codes.InvalidArgument error if the sort order is not supported.
+func checkSort(sortBy string) error {
+	switch sortBy {
+	case "", "name", "size", "modified":
+		return nil
+	default:
+		return grpc.Errorf(codes.InvalidArgument, "sort order %s is not supported", sortBy)
+	}
+}
+
+// less reports if the entry a goes before the entry b in the sort order.
+// Entries with the same size or modification time are sorted by name.
+func (a dirEntry) less(b dirEntry, sortBy string) bool {
+	switch sortBy {
+	case "size":
+		if a.size != b.size {
+			return a.size < b.size
+		}
+	case "modified":
+		if a.modified != b.modified {
+			return a.modified < b.modified
+		}
+	}
+	return a.name < b.name
+}
+
+// cursor returns the cursor that points to the entry e.
+// Names cannot contain a slash so it is used to separate the sort value.
+func (e dirEntry) cursor(sortBy string) string {
+	switch sortBy {
+	case "size":
+		return fmt.Sprintf("%d/%s", e.size, e.name)
+	case "modified":
+		return fmt.Sprintf("%d/%s", e.modified, e.name)
+	default:
+		return e.name
+	}
+}
+
+// parseCursor returns the entry the cursor points to.
+func parseCursor(cursor, sortBy string) (dirEntry, error) {
+	if sortBy == "name" {
+		return dirEntry{name: cursor}, nil
+	}
+
+	tokens := strings.SplitN(cursor, "/", 2)
+	if len(tokens) != 2 {
+		return dirEntry{}, grpc.Errorf(codes.InvalidArgument, "cursor %s is not valid", cursor)
+	}
+	v, err := strconv.ParseInt(tokens[0], 10, 64)
+	if err != nil {
+		return dirEntry{}, grpc.Errorf(codes.InvalidArgument, "cursor %s is not valid", cursor)
+	}
+
+	e := dirEntry{name: tokens[1]}
+	if sortBy == "size" {
+		e.size = v
+	} else {
+		e.modified = v
+	}
+	return e, nil
+}
+
+// getRecords returns the prop records of the paths of the batch by path.
+// Prop versions without GetBatch are asked for each path, paths whose
+// record cannot be got that way are logged and left out as before.
+func (s *server) getRecords(ctx context.Context, client proppb.PropClient, in *proppb.GetBatchReq, log *rus.Entry) (map[string]*proppb.Record, error) {
+	recs := map[string]*proppb.Record{}
+
+	list, err := client.GetBatch(ctx, in)
+	if grpc.Code(err) == codes.Unimplemented {
+		log.Warnf("prop does not support batches, getting %d records one by one", len(in.Paths))
+		for _, p := range in.Paths {
+			getReq := &proppb.GetReq{}
+			getReq.Path = p
+			getReq.AccessToken = in.AccessToken
+			getReq.ForceCreation = in.ForceCreation
+
+			rec, err := client.Get(ctx, getReq)
+			if err != nil {
+				log.Errorf("path %s has not been added because %s", p, err.Error())
+				continue
+			}
+			recs[p] = rec
+		}
+		return recs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rec := range list.Records {
+		recs[path.Clean(rec.Path)] = rec
+	}
+	return recs, nil
+}
+
+// resolveBatch returns the metadata of the children names of p with their
+// prop records, asking prop for all of them in a single call.
+// Children that cannot be resolved are logged and skipped.
+func (s *server) resolveBatch(ctx context.Context, client proppb.PropClient, p string, names []string, checksumType, accessToken string, perms func(p string) uint32, log *rus.Entry) ([]*pb.Metadata, error) {
+	metas := []*pb.Metadata{}
+	in := &proppb.GetBatchReq{}
+	in.AccessToken = accessToken
+	in.ForceCreation = true
+	for _, n := range names {
+		cp := path.Join(p, n)
+		m, err := s.getMeta(cp)
+		if err != nil {
+			log.Errorf("path %s has not been added because %s", cp, err.Error())
+			continue
+		}
+		if perms != nil {
+			m.Permissions = perms(cp)
+		}
+		metas = append(metas, m)
+		in.Paths = append(in.Paths, cp)
+	}
+
+	if len(metas) == 0 {
+		return metas, nil
+	}
+
+	recs, err := s.getRecords(ctx, client, in, log)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := []*pb.Metadata{}
+	for _, m := range metas {
+		rec, ok := recs[m.Path]
+		if !ok {
+			log.Errorf("path %s has not been added because it has no prop record", m.Path)
+			continue
+		}
+
+		m.Id = rec.Id
+		m.Etag = rec.Etag
+		m.Modified = rec.Modified
+		m.Checksum = rec.Checksum
+
+		// Checksums of children are only taken from the cache,
+		// reading every file of a big directory is too slow.
+		if !m.IsContainer {
+			checksum, err := s.getCachedChecksum(m.Path, checksumType)
+			if err != nil {
+				log.Errorf("path %s has not been added because %s", m.Path, err.Error())
+				continue
+			}
+			if checksum != "" {
+				m.Checksum = checksum
+			}
+		}
+		resolved = append(resolved, m)
+	}
+	return resolved, nil
+}
+
+// resolveChildren returns the metadata of the children names of p in the same
+// order. The names are split in batches of propBatchSize and at most
+// propBatchConc batches are asked to prop at the same time.
+// If a batch fails the first error is returned.
+func (s *server) resolveChildren(ctx context.Context, client proppb.PropClient, p string, names []string, checksumType, accessToken string, perms func(p string) uint32, log *rus.Entry) ([]*pb.Metadata, error) {
+	batches := [][]string{}
+	for len(names) > 0 {
+		n := s.c.PropBatchSize
+		if n <= 0 || n > len(names) {
+			n = len(names)
+		}
+		batches = append(batches, names[:n])
+		names = names[n:]
+	}
+
+	conc := s.c.PropBatchConcurrency
+	if conc <= 0 {
+		conc = 1
+	}
+
+	results := make([][]*pb.Metadata, len(batches))
+	errs := make([]error, len(batches))
+	sem := make(chan struct{}, conc)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, batch []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			metas, err := s.resolveBatch(ctx, client, p, batch, checksumType, accessToken, perms, log)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i] = metas
+		}(i, batch)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resolved := []*pb.Metadata{}
+	for _, metas := range results {
+		resolved = append(resolved, metas...)
+	}
+	return resolved, nil
+}
+
+// readDir reads the names of the container p in chunks and calls fn with
+// the ones that match the prefix. Hidden areas are never returned.
+func (s *server) readDir(p, prefix string, fn func(names []string) error) error {
+	dir, err := s.storage.OpenDir(p)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	for {
+		names, err := dir.Read(listChunkSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		matched := []string{}
+		for _, n := range names {
+			if !strings.HasPrefix(n, prefix) || isHiddenPath(path.Join(p, n)) {
+				continue
+			}
+			matched = append(matched, n)
+		}
+		if len(matched) > 0 {
+			if err := fn(matched); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF || len(names) == 0 {
+			return nil
+		}
+	}
+}
+
+// listChildren resolves the children of the container p and calls send
+// with each one. Children that cannot be resolved are logged and skipped.
+// When the children are not sorted nor paginated they are sent as the
+// container is read, otherwise all the names are read first to sort them.
+// It returns the cursor of the next page or an empty string on the last one.
+func (s *server) listChildren(ctx context.Context, client proppb.PropClient, p string, opts listOptions, checksumType, accessToken string, log *rus.Entry, send func(m *pb.Metadata) error) (string, error) {
+	if err := checkSort(opts.sort); err != nil {
+		return "", err
+	}
+
+	// Pages need a stable order.
+	if opts.sort == "" && (opts.limit > 0 || opts.cursor != "") {
+		opts.sort = "name"
+	}
+
+	resolve := func(names []string) error {
+		metas, err := s.resolveChildren(ctx, client, p, names, checksumType, accessToken, opts.permissions, log)
+		if err != nil {
+			return err
+		}
+		for _, m := range metas {
+			if err := send(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if opts.sort == "" {
+		return "", s.readDir(p, opts.prefix, resolve)
+	}
+
+	var after *dirEntry
+	if opts.cursor != "" {
+		e, err := parseCursor(opts.cursor, opts.sort)
+		if err != nil {
+			return "", err
+		}
+		after = &e
+	}
+
+	entries := []dirEntry{}
+	err := s.readDir(p, opts.prefix, func(names []string) error {
+		for _, n := range names {
+			e := dirEntry{name: n}
+			if opts.sort != "name" {
+				finfo, err := s.storage.Stat(path.Join(p, n))
+				if err != nil {
+					log.Errorf("path %s has not been added because %s", path.Join(p, n), err.Error())
+					continue
+				}
+				e.size = finfo.Size()
+				e.modified = finfo.ModTime().UnixNano()
+			}
+			if after != nil && !after.less(e, opts.sort) {
+				continue
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Sort(byOrder{entries, opts.sort})
+
+	next := ""
+	if opts.limit > 0 && len(entries) > opts.limit {
+		entries = entries[:opts.limit]
+		next = entries[len(entries)-1].cursor(opts.sort)
+	}
+
+	// The sorted children are still resolved and sent in chunks.
+	for len(entries) > 0 {
+		n := listChunkSize
+		if n > len(entries) {
+			n = len(entries)
+		}
+		names := []string{}
+		for _, e := range entries[:n] {
+			names = append(names, e.name)
+		}
+		if err := resolve(names); err != nil {
+			return "", err
+		}
+		entries = entries[n:]
+	}
+	return next, nil
+}
+
+// byOrder sorts entries in the given sort order.
+type byOrder struct {
+	entries []dirEntry
+	sortBy  string
+}
+
+func (o byOrder) Len() int           { return len(o.entries) }
+func (o byOrder) Swap(i, j int)      { o.entries[i], o.entries[j] = o.entries[j], o.entries[i] }
+func (o byOrder) Less(i, j int) bool { return o.entries[i].less(o.entries[j], o.sortBy) }
+
+func (s *server) ListDir(req *pb.ListDirReq, stream pb.Meta_ListDirServer) error {
+
+	ctx := stream.Context()
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	p := path.Clean(req.Path)
+
+	log.Infof("path is %s", p)
+
+	err := s.checkStatAccess(p, idt, true, log)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	m, err := s.getMeta(p)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if !m.IsContainer {
+		err = grpc.Errorf(codes.InvalidArgument, "%s is not a container", p)
+		log.Error(err)
+		return err
+	}
+
+	resource, err := s.grpcPool.Get("")
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	defer resource.Release()
+
+	handle, err := resource.Handle()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	con := handle.(*grpc.ClientConn)
+	log.Infof("created connection to %s", s.c.Prop)
+
+	client := s.newPropClient(con)
+
+	checksumType := s.getChecksumType(req.ChecksumType)
+
+	opts := listOptions{}
+	opts.prefix = req.Prefix
+	opts.sort = req.Sort
+	opts.permissions = s.getChildrenPermissions(p, idt)
+
+	sent := 0
+	_, err = s.listChildren(ctx, client, p, opts, checksumType, getAccessToken(ctx), log, func(m *pb.Metadata) error {
+		sent++
+		return stream.Send(m)
+	})
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	log.Infof("sent %d entries of %s", sent, p)
+
+	return nil
+}
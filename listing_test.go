@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// childNames returns the base names of the children.
+func childNames(children []*pb.Metadata) []string {
+	names := []string{}
+	for _, c := range children {
+		names = append(names, path.Base(c.Path))
+	}
+	return names
+}
+
+// listDir returns the base names of the entries streamed by ListDir.
+func (h *testHarness) listDir(req *pb.ListDirReq) ([]string, error) {
+	stream, err := h.client.ListDir(h.ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*pb.Metadata{}
+	for {
+		m, err := stream.Recv()
+		if err == io.EOF {
+			return childNames(entries), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, m)
+	}
+}
+
+// writeListingFiles creates files with different sizes and modification
+// times so the sort orders give different results.
+func (h *testHarness) writeListingFiles() {
+	files := []struct {
+		name    string
+		content string
+		age     time.Duration
+	}{
+		{"b.txt", "bbbbbb", 1 * time.Hour},
+		{"a.txt", "aaaa", 2 * time.Hour},
+		{"c.jpg", "cc", 3 * time.Hour},
+		{"d.jpg", "dddd", 4 * time.Hour},
+	}
+	for _, f := range files {
+		p := h.home + "/" + f.name
+		h.writeFile(p, f.content)
+		mtime := time.Now().Add(-f.age)
+		if err := os.Chtimes(path.Join(h.dataDir, p), mtime, mtime); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+}
+
+func TestStatPagination(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeListingFiles()
+
+	tests := []struct {
+		name  string
+		sort  string
+		limit uint32
+		pages [][]string
+	}{
+		{"name", "name", 3, [][]string{{"a.txt", "b.txt", "c.jpg"}, {"d.jpg"}}},
+		{"default order", "", 2, [][]string{{"a.txt", "b.txt"}, {"c.jpg", "d.jpg"}}},
+		{"size", "size", 2, [][]string{{"c.jpg", "a.txt"}, {"d.jpg", "b.txt"}}},
+		{"modified", "modified", 1, [][]string{{"d.jpg"}, {"c.jpg"}, {"a.txt"}, {"b.txt"}}},
+	}
+
+	for _, tt := range tests {
+		cursor := ""
+		for i, want := range tt.pages {
+			req := &pb.StatReq{AccessToken: h.token, Path: h.home, Children: true, Sort: tt.sort, Cursor: cursor, Limit: tt.limit}
+			m, err := h.client.Stat(h.ctx, req)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if got := childNames(m.Children); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: page %d: got %v, want %v", tt.name, i, got, want)
+			}
+			last := i == len(tt.pages)-1
+			if last != (m.NextCursor == "") {
+				t.Errorf("%s: page %d: got next cursor %q", tt.name, i, m.NextCursor)
+			}
+			cursor = m.NextCursor
+		}
+	}
+}
+
+func TestStatChildrenFilter(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeListingFiles()
+
+	m, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home, Children: true, Prefix: "c", Sort: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := childNames(m.Children), []string{"c.jpg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	_, err = h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home, Children: true, Sort: "color"})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.InvalidArgument)
+	}
+
+	_, err = h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home, Children: true, Sort: "size", Cursor: "a.txt"})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.InvalidArgument)
+	}
+}
+
+func TestListDir(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeListingFiles()
+
+	tests := []struct {
+		name  string
+		token string
+		path  string
+		sort  string
+		pref  string
+		code  codes.Code
+		names []string
+	}{
+		{"name", h.token, h.home, "name", "", codes.OK, []string{"a.txt", "b.txt", "c.jpg", "d.jpg"}},
+		{"size with prefix", h.token, h.home, "size", "a", codes.OK, []string{"a.txt"}},
+		{"modified", h.token, h.home, "modified", "", codes.OK, []string{"d.jpg", "c.jpg", "a.txt", "b.txt"}},
+		{"file", h.token, h.home + "/a.txt", "", "", codes.InvalidArgument, nil},
+		{"missing", h.token, h.home + "/missing", "", "", codes.NotFound, nil},
+		{"other home", h.token, h.otherHome, "", "", codes.PermissionDenied, nil},
+		{"trash", h.token, trashDir, "", "", codes.PermissionDenied, nil},
+		{"bad token", "bad", h.home, "", "", codes.Unauthenticated, nil},
+	}
+
+	for _, tt := range tests {
+		req := &pb.ListDirReq{AccessToken: tt.token, Path: tt.path, Sort: tt.sort, Prefix: tt.pref}
+		names, err := h.listDir(req)
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code == codes.OK && !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("%s: got %v, want %v", tt.name, names, tt.names)
+		}
+	}
+}
+
+func TestListDirManyEntries(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	n := listChunkSize*2 + 10
+	for i := 0; i < n; i++ {
+		h.writeFile(fmt.Sprintf("%s/big/%04d", h.home, i), "")
+	}
+
+	// each chunk read from the container is resolved in batches
+	batches := 0
+	for left := n; left > 0; left -= listChunkSize {
+		chunk := left
+		if chunk > listChunkSize {
+			chunk = listChunkSize
+		}
+		batches += (chunk + h.srv.c.PropBatchSize - 1) / h.srv.c.PropBatchSize
+	}
+	h.prop.callCount("get")
+	h.prop.callCount("getbatch")
+
+	names, err := h.listDir(&pb.ListDirReq{AccessToken: h.token, Path: h.home + "/big"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != n {
+		t.Errorf("got %d entries, want %d", len(names), n)
+	}
+	if got := h.prop.callCount("get"); got != 0 {
+		t.Errorf("got %d prop get calls, want 0", got)
+	}
+	if got := h.prop.callCount("getbatch"); got != batches {
+		t.Errorf("got %d prop batch calls, want %d", got, batches)
+	}
+
+	m, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home + "/big", Children: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Children) != n {
+		t.Errorf("got %d children, want %d", len(m.Children), n)
+	}
+	if got := h.prop.callCount("get"); got != 1 {
+		t.Errorf("got %d prop get calls, want 1", got)
+	}
+	if got := h.prop.callCount("getbatch"); got != batches {
+		t.Errorf("got %d prop batch calls, want %d", got, batches)
+	}
+
+	// every child has been saved in prop
+	for _, name := range names {
+		if _, ok := h.prop.record(h.home + "/big/" + name); !ok {
+			t.Errorf("%s has not been saved in prop", name)
+		}
+	}
+}
+
+func TestListDirBatchErrors(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/a.txt", "a")
+	h.writeFile(h.home+"/b.txt", "b")
+
+	// prop versions without batches are asked for each child
+	h.prop.fail("getbatch", grpc.Errorf(codes.Unimplemented, "unknown method GetBatch"))
+	h.prop.callCount("get")
+	names, err := h.listDir(&pb.ListDirReq{AccessToken: h.token, Path: h.home, Sort: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.txt", "b.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+	if got := h.prop.callCount("get"); got != 2 {
+		t.Errorf("got %d prop get calls, want 2", got)
+	}
+
+	// other errors are returned instead of dropping the children
+	h.prop.fail("getbatch", grpc.Errorf(codes.Unavailable, "prop is down"))
+	_, err = h.listDir(&pb.ListDirReq{AccessToken: h.token, Path: h.home})
+	if grpc.Code(err) != codes.Unavailable {
+		t.Errorf("list: got %v, want %v", grpc.Code(err), codes.Unavailable)
+	}
+	_, err = h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home, Children: true})
+	if grpc.Code(err) != codes.Unavailable {
+		t.Errorf("stat: got %v, want %v", grpc.Code(err), codes.Unavailable)
+	}
+}
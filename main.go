@@ -1,131 +1,191 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	pb "github.com/clawio/service-localfs-meta/proto/metadata"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1alpha"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
-	"strconv"
+	"syscall"
+	"time"
 )
 
-const (
-	serviceID               = "CLAWIO_LOCALFS_META"
-	dataDirEnvar            = serviceID + "_DATADIR"
-	tmpDirEnvar             = serviceID + "_TMPDIR"
-	portEnvar               = serviceID + "_PORT"
-	propEnvar               = serviceID + "_PROP"
-	logLevelEnvar           = serviceID + "_LOGLEVEL"
-	propMaxActiveEnvar      = serviceID + "_PROPMAXACTIVE"
-	propMaxIdleEnvar        = serviceID + "_PROPMAXIDLE"
-	propMaxConcurrencyEnvar = serviceID + "_PROPMAXCONCURRENCY"
-	sharedSecretEnvar       = "CLAWIO_SHAREDSECRET"
-)
-
-type environ struct {
-	dataDir            string
-	tmpDir             string
-	port               int
-	prop               string
-	logLevel           string
-	propMaxActive      int
-	propMaxIdle        int
-	propMaxConcurrency int
-	sharedSecret       string
-}
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
 
-func getEnviron() (*environ, error) {
-	e := &environ{}
-	e.dataDir = os.Getenv(dataDirEnvar)
-	e.tmpDir = os.Getenv(tmpDirEnvar)
-	port, err := strconv.Atoi(os.Getenv(portEnvar))
+	c, printConfig, err := loadConfig(os.Args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
 	if err != nil {
-		return nil, err
+		log.Error(err)
+		os.Exit(1)
+	}
+	if printConfig {
+		if err := c.print(os.Stdout); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return
 	}
-	e.port = port
 
-	e.prop = os.Getenv(propEnvar)
-	e.logLevel = os.Getenv(logLevelEnvar)
+	l, _ := log.ParseLevel(c.LogLevel)
+	log.SetLevel(l)
 
-	propMaxActive, err := strconv.Atoi(os.Getenv(propMaxActiveEnvar))
+	quotaOverrides, err := loadQuotaOverrides(c.QuotaFile)
 	if err != nil {
-		return nil, err
+		log.Error(err)
+		os.Exit(1)
 	}
-	e.propMaxActive = propMaxActive
+	c.quotaOverrides = quotaOverrides
 
-	propMaxIdle, err := strconv.Atoi(os.Getenv(propMaxIdleEnvar))
+	groups, err := loadGroups(c.GroupsFile)
 	if err != nil {
-		return nil, err
+		log.Error(err)
+		os.Exit(1)
 	}
-	e.propMaxIdle = propMaxIdle
+	c.groups = groups
 
-	propMaxConcurrency, err := strconv.Atoi(os.Getenv(propMaxConcurrencyEnvar))
+	layout, err := newHomeLayout(c.HomeLayout, c.HomeIdp)
 	if err != nil {
-		return nil, err
+		log.Error(err)
+		os.Exit(1)
 	}
-	e.propMaxConcurrency = propMaxConcurrency
-
-	e.sharedSecret = os.Getenv(sharedSecretEnvar)
-	return e, nil
-}
-func printEnviron(e *environ) {
-	log.Infof("%s=%s\n", dataDirEnvar, e.dataDir)
-	log.Infof("%s=%s\n", tmpDirEnvar, e.tmpDir)
-	log.Infof("%s=%d\n", portEnvar, e.port)
-	log.Infof("%s=%s\n", propEnvar, e.prop)
-	log.Infof("%s=%d\n", propMaxActiveEnvar, e.propMaxActive)
-	log.Infof("%s=%d\n", propMaxIdleEnvar, e.propMaxIdle)
-	log.Infof("%s=%d\n", propMaxConcurrencyEnvar, e.propMaxConcurrency)
-	log.Infof("%s=%s\n", sharedSecretEnvar, "******")
-}
-
-func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
+	c.layout = layout
 
-	env, err := getEnviron()
+	identities, err := loadIdentityMap(c.IdentityMapFile)
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
-
-	l, err := log.ParseLevel(env.logLevel)
+	c.identities = identities
+
+	tokenOpts := tokenOptions{}
+	tokenOpts.algorithms = c.JWTAlgorithms
+	tokenOpts.issuer = c.JWTIssuer
+	tokenOpts.audience = c.JWTAudience
+	tokenOpts.skew = time.Duration(c.JWTClockSkew) * time.Second
+	tokenOpts.allowNoExpiry = c.JWTAllowNoExpiry
+	tokenOpts.secret = c.SharedSecret
+	tokenOpts.jwksFile = c.JWKSFile
+	if c.JWTSigningKeyFile != "" {
+		key, err := loadSigningKey(c.JWTSigningKeyFile)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		tokenOpts.signingKey = key
+		tokenOpts.signingKeyID = c.JWTSigningKeyID
+	}
+	tokens, err := newTokenValidator(tokenOpts)
 	if err != nil {
-		l = log.ErrorLevel
+		log.Error(err)
+		os.Exit(1)
+	}
+	if c.JWKSFile != "" {
+		go tokens.watch(jwksReloadInterval, nil)
+	}
+	c.tokens = tokens
+
+	if c.PropTLS {
+		reloader, err := newCertReloader(c.PropCertFile, c.PropKeyFile, c.PropCAFile)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		go reloader.watch(certReloadInterval, nil)
+
+		serverName := c.PropServerName
+		if serverName == "" {
+			serverName, _, err = net.SplitHostPort(c.Prop)
+			if err != nil {
+				log.Error(err)
+				os.Exit(1)
+			}
+		}
+		c.propTLS = newClientTLSConfig(reloader, serverName)
 	}
-	log.SetLevel(l)
-
-	p := &newServerParams{}
-	p.dataDir = env.dataDir
-	p.tmpDir = env.tmpDir
-	p.prop = env.prop
-	p.sharedSecret = env.sharedSecret
-	p.propMaxActive = env.propMaxActive
-	p.propMaxIdle = env.propMaxIdle
-	p.propMaxConcurrency = env.propMaxConcurrency
 
 	log.Infof("Service %s started", serviceID)
-	printEnviron(env)
+	c.log()
 
 	// Create data and tmp dirs
-	if err := os.MkdirAll(p.dataDir, 0644); err != nil {
+	if err := os.MkdirAll(c.DataDir, 0644); err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
-	if err := os.MkdirAll(p.tmpDir, 0644); err != nil {
+	if err := os.MkdirAll(c.TmpDir, 0644); err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
 
-	srv := newServer(p)
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", env.port))
+	srv, err := newServer(c)
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Port))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	opts := []grpc.ServerOption{}
+	if c.TLSCertFile != "" {
+		reloader, err := newCertReloader(c.TLSCertFile, c.TLSKeyFile, c.TLSClientCAFile)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		go reloader.watch(certReloadInterval, nil)
+
+		opts = append(opts, grpc.Creds(credentials.NewTLS(newServerTLSConfig(reloader))))
+	}
+
+	// The metrics are served apart from the gRPC port.
+	// A port of 0 disables them.
+	if c.MetricsPort != 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf(":%d", c.MetricsPort), mux)
+			log.Errorf("metrics listener has stopped because %s", err.Error())
+		}()
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+	registerMetaServer(grpcServer, srv, srv.interceptor())
+
+	checker := newHealthChecker(srv, c.HealthMinFreeBytes)
+	checker.update()
+	stopChecker := make(chan struct{})
+	go checker.run(time.Duration(c.HealthInterval)*time.Second, stopChecker)
+	healthpb.RegisterHealthServer(grpcServer, checker)
+
+	// Serve returns as soon as the listener is closed, so it is only
+	// fatal if it stops before a shutdown has been requested.
+	served := make(chan error, 1)
+	go func() {
+		served <- grpcServer.Serve(lis)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-served:
+		log.Error(err)
+		os.Exit(1)
+	case sig := <-signals:
+		log.Infof("received %s, shutting down", sig)
+	}
 
-	grpcServer := grpc.NewServer()
-	pb.RegisterMetaServer(grpcServer, srv)
-	grpcServer.Serve(lis)
+	close(stopChecker)
+	checker.shutdown()
+	srv.shutdown(grpcServer, lis, time.Duration(c.ShutdownTimeout)*time.Second)
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics are exposed in the Prometheus text format.
+// There is no Prometheus client vendored, so the few metric types
+// the service needs are implemented here.
+
+// defBuckets are the upper bounds of the latency histograms in seconds.
+var defBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	metrics = newMetricsRegistry()
+
+	requestsTotal = metrics.newCounter("localfs_meta_requests_total",
+		"Requests handled by method and gRPC code.", "method", "code")
+	requestDuration = metrics.newHistogram("localfs_meta_request_duration_seconds",
+		"Latency of the requests by method and gRPC code.", "method", "code")
+	fsDuration = metrics.newHistogram("localfs_meta_fs_duration_seconds",
+		"Latency of the filesystem operations by operation.", "op")
+	propDuration = metrics.newHistogram("localfs_meta_prop_duration_seconds",
+		"Latency of the calls to prop by method.", "method")
+	propErrorsTotal = metrics.newCounter("localfs_meta_prop_errors_total",
+		"Failed calls to prop by method and gRPC code.", "method", "code")
+)
+
+// metricsRegistry keeps the metrics to expose, in the order they are created.
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+	gauges  map[string]*gaugeFunc
+}
+
+// metric is written in the text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{gauges: map[string]*gaugeFunc{}}
+}
+
+func (r *metricsRegistry) add(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *metricsRegistry) newCounter(name, help string, labels ...string) *counter {
+	c := &counter{name: name, help: help, labels: labels, values: map[string]float64{}}
+	r.add(c)
+	return c
+}
+
+func (r *metricsRegistry) newHistogram(name, help string, labels ...string) *histogram {
+	h := &histogram{name: name, help: help, labels: labels, buckets: defBuckets, series: map[string]*histogramSeries{}}
+	r.add(h)
+	return h
+}
+
+// setGauge exposes the value f returns when the metrics are read.
+// Setting a gauge again replaces the function.
+func (r *metricsRegistry) setGauge(name, help string, f func() float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if g, ok := r.gauges[name]; ok {
+		g.setFunc(f)
+		return
+	}
+	g := &gaugeFunc{name: name, help: help, f: f}
+	r.gauges[name] = g
+	r.metrics = append(r.metrics, g)
+}
+
+// write writes all the metrics in the text format.
+func (r *metricsRegistry) write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// ServeHTTP serves the metrics to Prometheus.
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	buf := &bytes.Buffer{}
+	r.write(buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// counter is a counter with labels.
+type counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// inc adds one to the counter with the label values.
+func (c *counter) inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[joinLabelValues(values)]++
+}
+
+func (c *counter) get(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[joinLabelValues(values)]
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitLabelValues(key)), formatValue(c.values[key]))
+	}
+}
+
+// histogram is a histogram with labels.
+type histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// observe adds the value v to the histogram with the label values.
+func (h *histogram) observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := joinLabelValues(values)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// since observes the seconds passed since start.
+func (h *histogram) since(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogram) getCount(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[joinLabelValues(values)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := []string{}
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		values := splitLabelValues(key)
+		le := func(bound string) []string {
+			return append(append([]string{}, values...), bound)
+		}
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, le(formatValue(b))), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, le("+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+// gaugeFunc is a gauge whose value is read when the metrics are written.
+type gaugeFunc struct {
+	name string
+	help string
+
+	mu sync.Mutex
+	f  func() float64
+}
+
+func (g *gaugeFunc) setFunc(f func() float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.f = f
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.f()))
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// labelSep separates the label values of a series in the keys of the maps.
+const labelSep = "\xff"
+
+func joinLabelValues(values []string) string {
+	return strings.Join(values, labelSep)
+}
+
+func splitLabelValues(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, labelSep)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns the labels of a series, i.e {method="stat",code="OK"}.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueReplacer.Replace(v)))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	r := newMetricsRegistry()
+	c := r.newCounter("test_total", "Test counter.", "method", "code")
+	c.inc("stat", "OK")
+	c.inc("stat", "OK")
+	c.inc("mv", `a"b`)
+	h := r.newHistogram("test_seconds", "Test histogram.", "op")
+	h.observe(0.003, "stat")
+	h.observe(20, "stat")
+	r.setGauge("test_gauge", "Test gauge.", func() float64 { return 1 })
+	r.setGauge("test_gauge", "Test gauge.", func() float64 { return 7 })
+
+	buf := &bytes.Buffer{}
+	r.write(buf)
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE test_total counter",
+		`test_total{method="stat",code="OK"} 2`,
+		`test_total{method="mv",code="a\"b"} 1`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{op="stat",le="0.001"} 0`,
+		`test_seconds_bucket{op="stat",le="0.005"} 1`,
+		`test_seconds_bucket{op="stat",le="10"} 1`,
+		`test_seconds_bucket{op="stat",le="+Inf"} 2`,
+		`test_seconds_sum{op="stat"} 20.003`,
+		`test_seconds_count{op="stat"} 2`,
+		"# TYPE test_gauge gauge",
+		"test_gauge 7",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics do not have %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	requests := requestsTotal.get("stat", codes.OK.String())
+	stats := fsDuration.getCount("stat")
+	gets := propDuration.getCount("get")
+
+	if _, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home}); err != nil {
+		t.Fatal(err)
+	}
+	if requestsTotal.get("stat", codes.OK.String()) != requests+1 {
+		t.Fatal("request has not been counted")
+	}
+	if fsDuration.getCount("stat") <= stats {
+		t.Fatal("filesystem stat has not been measured")
+	}
+	if propDuration.getCount("get") <= gets {
+		t.Fatal("prop call has not been measured")
+	}
+
+	errors := propErrorsTotal.get("mv", codes.Unknown.String())
+	h.prop.fail("mv", grpc.Errorf(codes.Unknown, "broken"))
+	h.mkdir(h.home + "/photos")
+	h.client.Rm(h.ctx, &pb.RmReq{AccessToken: h.token, Path: h.home + "/photos"})
+	if propErrorsTotal.get("mv", codes.Unknown.String()) != errors+1 {
+		t.Fatal("prop error has not been counted")
+	}
+
+	srv := httptest.NewServer(metrics)
+	defer srv.Close()
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"localfs_meta_requests_total",
+		"localfs_meta_request_duration_seconds_bucket",
+		"localfs_meta_fs_duration_seconds_bucket",
+		"localfs_meta_prop_duration_seconds_bucket",
+		"localfs_meta_prop_errors_total",
+		"localfs_meta_prop_pool_active_handles",
+		"localfs_meta_prop_pool_idle_handles",
+	} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("metrics do not have %s", name)
+		}
+	}
+}
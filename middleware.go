@@ -0,0 +1,154 @@
+package main
+
+import (
+	authlib "github.com/clawio/service-auth/lib"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"path"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// The key type is unexported to prevent collisions with context keys
+// defined in other packages.
+type middlewareKey int
+
+const (
+	logKey middlewareKey = iota
+	callKey
+	incomingKey
+)
+
+// callInfo is filled in while a call goes through the interceptors
+// so the access log can tell who made it.
+type callInfo struct {
+	idt *authlib.Identity
+}
+
+// interceptor returns the chain every call to the server goes through:
+// the trace and the access log, the metrics, the recovery of panics,
+// the tracking of the calls in flight and the authentication, in that order.
+func (s *server) interceptor() unaryServerInterceptor {
+	return chainInterceptors(traceInterceptor, metricsInterceptor, recoveryInterceptor, s.drainer.interceptor, s.authInterceptor)
+}
+
+// chainInterceptors returns an interceptor that runs the interceptors
+// one inside the other, the first one being the outermost.
+func chainInterceptors(interceptors ...unaryServerInterceptor) unaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *unaryServerInfo, handler unaryHandler) (interface{}, error) {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, inner)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
+// traceInterceptor takes the trace of the call, or creates a new one,
+// and passes it to prop. It keeps in the context a logger with the trace
+// the handlers get with getLog, and logs the access when the call ends.
+func traceInterceptor(ctx context.Context, req interface{}, info *unaryServerInfo, handler unaryHandler) (interface{}, error) {
+	traceID, err := getTraceID(ctx)
+	if err != nil {
+		rus.Error(err)
+		return nil, err
+	}
+	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
+
+	// The metadata of the call is replaced by the one prop gets,
+	// so it is kept aside for the interceptors that read it.
+	if md, ok := metadata.FromContext(ctx); ok {
+		ctx = context.WithValue(ctx, incomingKey, md)
+	}
+	ctx = newTraceContext(ctx, traceID)
+
+	call := &callInfo{}
+	ctx = context.WithValue(ctx, logKey, log)
+	ctx = context.WithValue(ctx, callKey, call)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	res, err := handler(ctx, req)
+
+	// Compute request duration
+	reqDur := time.Since(reqStart)
+
+	fields := rus.Fields{
+		"method":   getMethodName(info.fullMethod),
+		"type":     "grpcaccess",
+		"code":     grpc.Code(err).String(),
+		"duration": reqDur.Seconds(),
+	}
+	if call.idt != nil {
+		fields["pid"] = call.idt.Pid
+		fields["idp"] = call.idt.Idp
+	}
+
+	// Log access info
+	log.WithFields(fields).Info("request finished")
+
+	return res, err
+}
+
+// metricsInterceptor counts the calls and their latency by method and code.
+func metricsInterceptor(ctx context.Context, req interface{}, info *unaryServerInfo, handler unaryHandler) (interface{}, error) {
+	start := time.Now()
+	res, err := handler(ctx, req)
+
+	method := getMethodName(info.fullMethod)
+	code := grpc.Code(err).String()
+	requestsTotal.inc(method, code)
+	requestDuration.since(start, method, code)
+	return res, err
+}
+
+// recoveryInterceptor turns a panic in the call into an internal error,
+// so one broken request does not bring the service down.
+func recoveryInterceptor(ctx context.Context, req interface{}, info *unaryServerInfo, handler unaryHandler) (res interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			getLog(ctx).Errorf("panic in %s: %v\n%s", info.fullMethod, r, debug.Stack())
+			res, err = nil, grpc.Errorf(codes.Internal, "internal error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// getMethodName returns the name the access log uses for the method,
+// i.e stat for /metadata.Meta/Stat.
+func getMethodName(fullMethod string) string {
+	return strings.ToLower(path.Base(fullMethod))
+}
+
+// getLog returns the logger of the call.
+func getLog(ctx context.Context) *rus.Entry {
+	if log, ok := ctx.Value(logKey).(*rus.Entry); ok {
+		return log
+	}
+	return rus.WithField("svc", serviceID)
+}
+
+// getIncomingMetadata returns the metadata the call has been made with.
+func getIncomingMetadata(ctx context.Context) (metadata.MD, bool) {
+	if md, ok := ctx.Value(incomingKey).(metadata.MD); ok {
+		return md, true
+	}
+	return metadata.FromContext(ctx)
+}
+
+// setCaller records who makes the call for the access log.
+func setCaller(ctx context.Context, idt *authlib.Identity) {
+	if call, ok := ctx.Value(callKey).(*callInfo); ok {
+		call.idt = idt
+	}
+}
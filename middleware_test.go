@@ -0,0 +1,121 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// accessHook keeps the access log entries.
+type accessHook struct {
+	mu      sync.Mutex
+	entries []rus.Fields
+}
+
+func (h *accessHook) Levels() []rus.Level {
+	return []rus.Level{rus.InfoLevel}
+}
+
+func (h *accessHook) Fire(e *rus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e.Data["type"] == "grpcaccess" {
+		h.entries = append(h.entries, e.Data)
+	}
+	return nil
+}
+
+func (h *accessHook) last() rus.Fields {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) == 0 {
+		return nil
+	}
+	return h.entries[len(h.entries)-1]
+}
+
+func TestChainInterceptors(t *testing.T) {
+	calls := []string{}
+	newInterceptor := func(name string) unaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *unaryServerInfo, handler unaryHandler) (interface{}, error) {
+			calls = append(calls, name)
+			return handler(ctx, req)
+		}
+	}
+	chain := chainInterceptors(newInterceptor("a"), newInterceptor("b"))
+
+	res, err := chain(context.Background(), "req", &unaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return req, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "req" {
+		t.Fatalf("got response %v, want req", res)
+	}
+	if !reflect.DeepEqual(calls, []string{"a", "b", "handler"}) {
+		t.Fatalf("got calls %v", calls)
+	}
+}
+
+func TestRecoveryInterceptor(t *testing.T) {
+	chain := chainInterceptors(traceInterceptor, recoveryInterceptor)
+	info := &unaryServerInfo{fullMethod: "/metadata.Meta/Stat"}
+	_, err := chain(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("broken handler")
+	})
+	if grpc.Code(err) != codes.Internal {
+		t.Fatalf("got %v, want Internal", err)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	hook := &accessHook{}
+	rus.AddHook(hook)
+	defer func() {
+		rus.StandardLogger().Hooks = make(rus.LevelHooks)
+	}()
+
+	h := newTestHarness(t)
+	defer h.close()
+
+	if _, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home}); err != nil {
+		t.Fatal(err)
+	}
+	e := hook.last()
+	if e["method"] != "stat" || e["code"] != codes.OK.String() || e["pid"] != "demo" {
+		t.Fatalf("got access log %v", e)
+	}
+	if _, ok := e["duration"].(float64); !ok {
+		t.Fatalf("access log has no duration: %v", e)
+	}
+
+	_, err := h.client.Stat(h.ctx, &pb.StatReq{Path: h.home})
+	if grpc.Code(err) != codes.Unauthenticated {
+		t.Fatalf("got %v, want Unauthenticated", err)
+	}
+	e = hook.last()
+	if e["code"] != codes.Unauthenticated.String() || e["pid"] != nil {
+		t.Fatalf("got access log %v", e)
+	}
+
+	// Streams are logged the same way.
+	stream, err := h.client.ListDir(h.ctx, &pb.ListDirReq{AccessToken: h.token, Path: h.home})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+	}
+	if e := hook.last(); e["method"] != "listdir" || e["code"] != codes.OK.String() {
+		t.Fatalf("got access log %v", e)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	proppb "github.com/clawio/service-localfs-meta/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"math/rand"
+	"time"
+)
+
+// newPropClient returns the client of prop used by the handlers.
+func (s *server) newPropClient(con *grpc.ClientConn) proppb.PropClient {
+	c := &resilientPropClient{}
+	c.client = &timedPropClient{proppb.NewPropClient(con)}
+	c.breaker = s.propBreaker
+	c.timeout = time.Duration(s.c.PropTimeout) * time.Second
+	c.retries = s.c.PropRetries
+	c.backoff = time.Duration(s.c.PropRetryBackoff) * time.Millisecond
+	return c
+}
+
+// resilientPropClient gives every call to prop a deadline, retries the
+// reads that fail because prop is unavailable and goes through the
+// circuit breaker of prop, so a slow or down prop fails the requests
+// fast instead of blocking them.
+// The writes are not retried, as they may have been applied.
+type resilientPropClient struct {
+	client  proppb.PropClient
+	breaker *circuitBreaker
+
+	// timeout is the deadline of every attempt. 0 is no deadline.
+	timeout time.Duration
+
+	// retries is how many times a read is retried.
+	retries int
+
+	// backoff is the wait before the first retry, doubled every retry.
+	backoff time.Duration
+}
+
+// call makes the call fn once through the breaker with the deadline.
+func (c *resilientPropClient) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	callCtx := ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	err := fn(callCtx)
+	if ctx.Err() != nil {
+		// The request has been canceled or has run out of time
+		// on its own, prop is not to blame.
+		c.breaker.release()
+		return err
+	}
+	c.breaker.done(err)
+	return err
+}
+
+// retry makes the call fn and retries it while prop is unavailable,
+// waiting a jittered and growing backoff between attempts.
+func (c *resilientPropClient) retry(ctx context.Context, method string, fn func(ctx context.Context) error) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := c.call(ctx, fn)
+		if err == nil || err == errBreakerOpen || !isUnavailable(err) || attempt >= c.retries {
+			return err
+		}
+
+		// The wait is between half and the whole backoff,
+		// so the retries of concurrent requests spread out.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		getLog(ctx).WithField("attempt", attempt+1).Warnf("retrying %s to prop in %s: %s", method, wait, err.Error())
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+func (c *resilientPropClient) Put(ctx context.Context, in *proppb.PutReq, opts ...grpc.CallOption) (out *proppb.Void, err error) {
+	err = c.call(ctx, func(ctx context.Context) error {
+		out, err = c.client.Put(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *resilientPropClient) Get(ctx context.Context, in *proppb.GetReq, opts ...grpc.CallOption) (out *proppb.Record, err error) {
+	err = c.retry(ctx, "get", func(ctx context.Context) error {
+		out, err = c.client.Get(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *resilientPropClient) GetBatch(ctx context.Context, in *proppb.GetBatchReq, opts ...grpc.CallOption) (out *proppb.RecordList, err error) {
+	err = c.retry(ctx, "getbatch", func(ctx context.Context) error {
+		out, err = c.client.GetBatch(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *resilientPropClient) Mv(ctx context.Context, in *proppb.MvReq, opts ...grpc.CallOption) (out *proppb.Void, err error) {
+	err = c.call(ctx, func(ctx context.Context) error {
+		out, err = c.client.Mv(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *resilientPropClient) Rm(ctx context.Context, in *proppb.RmReq, opts ...grpc.CallOption) (out *proppb.Void, err error) {
+	err = c.call(ctx, func(ctx context.Context) error {
+		out, err = c.client.Rm(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+// timedPropClient measures the latency and the errors of the calls to prop.
+type timedPropClient struct {
+	client proppb.PropClient
+}
+
+// observe records a call to method started at start that ended with err.
+func (c *timedPropClient) observe(method string, start time.Time, err error) {
+	propDuration.since(start, method)
+	if err != nil {
+		propErrorsTotal.inc(method, grpc.Code(err).String())
+	}
+}
+
+func (c *timedPropClient) Put(ctx context.Context, in *proppb.PutReq, opts ...grpc.CallOption) (*proppb.Void, error) {
+	start := time.Now()
+	out, err := c.client.Put(ctx, in, opts...)
+	c.observe("put", start, err)
+	return out, err
+}
+
+func (c *timedPropClient) Get(ctx context.Context, in *proppb.GetReq, opts ...grpc.CallOption) (*proppb.Record, error) {
+	start := time.Now()
+	out, err := c.client.Get(ctx, in, opts...)
+	c.observe("get", start, err)
+	return out, err
+}
+
+func (c *timedPropClient) GetBatch(ctx context.Context, in *proppb.GetBatchReq, opts ...grpc.CallOption) (*proppb.RecordList, error) {
+	start := time.Now()
+	out, err := c.client.GetBatch(ctx, in, opts...)
+	c.observe("getbatch", start, err)
+	return out, err
+}
+
+func (c *timedPropClient) Mv(ctx context.Context, in *proppb.MvReq, opts ...grpc.CallOption) (*proppb.Void, error) {
+	start := time.Now()
+	out, err := c.client.Mv(ctx, in, opts...)
+	c.observe("mv", start, err)
+	return out, err
+}
+
+func (c *timedPropClient) Rm(ctx context.Context, in *proppb.RmReq, opts ...grpc.CallOption) (*proppb.Void, error) {
+	start := time.Now()
+	out, err := c.client.Rm(ctx, in, opts...)
+	c.observe("rm", start, err)
+	return out, err
+}
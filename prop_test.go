@@ -0,0 +1,157 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	proppb "github.com/clawio/service-localfs-meta/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"testing"
+	"time"
+)
+
+// scriptedPropClient fails the calls with the errors in errs, in order,
+// and then works.
+type scriptedPropClient struct {
+	proppb.PropClient
+	errs  []error
+	calls int
+	block bool
+}
+
+func (c *scriptedPropClient) next(ctx context.Context) error {
+	c.calls++
+	if c.block {
+		<-ctx.Done()
+		return grpc.Errorf(codes.DeadlineExceeded, "%s", ctx.Err().Error())
+	}
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func (c *scriptedPropClient) Get(ctx context.Context, in *proppb.GetReq, opts ...grpc.CallOption) (*proppb.Record, error) {
+	if err := c.next(ctx); err != nil {
+		return nil, err
+	}
+	return &proppb.Record{Id: in.Path}, nil
+}
+
+func (c *scriptedPropClient) Put(ctx context.Context, in *proppb.PutReq, opts ...grpc.CallOption) (*proppb.Void, error) {
+	if err := c.next(ctx); err != nil {
+		return nil, err
+	}
+	return &proppb.Void{}, nil
+}
+
+func newTestPropClient(script *scriptedPropClient, retries int) *resilientPropClient {
+	c := &resilientPropClient{}
+	c.client = script
+	c.breaker = newCircuitBreaker("prop", 0, time.Minute)
+	c.timeout = 50 * time.Millisecond
+	c.retries = retries
+	c.backoff = time.Millisecond
+	return c
+}
+
+func TestPropClientRetries(t *testing.T) {
+	down := grpc.Errorf(codes.Unavailable, "down")
+
+	script := &scriptedPropClient{errs: []error{down, down}}
+	rec, err := newTestPropClient(script, 2).Get(context.Background(), &proppb.GetReq{Path: "/local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Id != "/local" || script.calls != 3 {
+		t.Fatalf("got record %+v after %d calls, want it after 3", rec, script.calls)
+	}
+
+	// Answers of prop are not retried.
+	script = &scriptedPropClient{errs: []error{grpc.Errorf(codes.NotFound, "not found")}}
+	if _, err := newTestPropClient(script, 2).Get(context.Background(), &proppb.GetReq{}); grpc.Code(err) != codes.NotFound || script.calls != 1 {
+		t.Fatalf("got %v after %d calls, want NotFound after 1", err, script.calls)
+	}
+
+	// Writes are not retried.
+	script = &scriptedPropClient{errs: []error{down}}
+	if _, err := newTestPropClient(script, 2).Put(context.Background(), &proppb.PutReq{}); grpc.Code(err) != codes.Unavailable || script.calls != 1 {
+		t.Fatalf("got %v after %d calls, want Unavailable after 1", err, script.calls)
+	}
+}
+
+func TestPropClientTimeout(t *testing.T) {
+	script := &scriptedPropClient{block: true}
+	start := time.Now()
+	_, err := newTestPropClient(script, 1).Get(context.Background(), &proppb.GetReq{})
+	if grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+	if script.calls != 2 {
+		t.Fatalf("got %d calls, want the timed out call retried once", script.calls)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("calls to prop have no deadline")
+	}
+}
+
+func TestPropClientCallerDeadline(t *testing.T) {
+	script := &scriptedPropClient{block: true}
+	c := newTestPropClient(script, 0)
+	c.breaker = newCircuitBreaker("prop", 1, time.Minute)
+	c.timeout = time.Minute
+
+	// The caller runs out of time before the deadline of the call.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, &proppb.GetReq{}); grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+	if c.breaker.getState() != breakerClosed {
+		t.Fatalf("got breaker %s, want closed", c.breaker.getState())
+	}
+
+	// The deadline of the call does count as a failure.
+	c.timeout = 10 * time.Millisecond
+	if _, err := c.Get(context.Background(), &proppb.GetReq{}); grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+	if c.breaker.getState() != breakerOpen {
+		t.Fatalf("got breaker %s, want open", c.breaker.getState())
+	}
+}
+
+func TestPropBreaker(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.srv.propBreaker = newCircuitBreaker("prop", 2, time.Minute)
+	h.prop.fail("get", grpc.Errorf(codes.Unavailable, "down"))
+	h.prop.callCount("get")
+
+	for i := 0; i < 2; i++ {
+		if _, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home}); grpc.Code(err) != codes.Unavailable {
+			t.Fatalf("got %v, want Unavailable", err)
+		}
+	}
+	if h.srv.propBreaker.getState() != breakerOpen {
+		t.Fatalf("got breaker %s, want open", h.srv.propBreaker.getState())
+	}
+
+	// Prop is not called while the breaker is open.
+	calls := h.prop.callCount("get")
+	if _, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home}); grpc.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want Unavailable", err)
+	}
+	if n := h.prop.callCount("get"); n != 0 {
+		t.Fatalf("prop has been called %d times with the breaker open (%d before)", n, calls)
+	}
+
+	checker := newHealthChecker(h.srv, 0)
+	checker.timeout = 500 * time.Millisecond
+	if problems := checker.check(); len(problems) != 1 || problems[0] != "circuit breaker to prop is open" {
+		t.Fatalf("got problems %v, want the breaker open", problems)
+	}
+}
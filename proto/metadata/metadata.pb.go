@@ -16,7 +16,28 @@ It has these top-level messages:
 	CpReq
 	MkdirReq
 	StatReq
+	ListDirReq
 	Metadata
+	ListTrashReq
+	RestoreTrashReq
+	PurgeTrashReq
+	TrashEntry
+	TrashList
+	ListVersionsReq
+	StatVersionReq
+	RestoreVersionReq
+	Version
+	VersionList
+	GetQuotaReq
+	Quota
+	CpProgress
+	CreateShareReq
+	ListSharesReq
+	RemoveShareReq
+	Share
+	ShareList
+	CreateLinkReq
+	StatByLinkReq
 */
 package metadata
 
@@ -69,9 +90,11 @@ func (m *HomeReq) String() string { return proto.CompactTextString(m) }
 func (*HomeReq) ProtoMessage()    {}
 
 type CpReq struct {
-	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
-	Src         string `protobuf:"bytes,2,opt,name=src" json:"src,omitempty"`
-	Dst         string `protobuf:"bytes,3,opt,name=dst" json:"dst,omitempty"`
+	AccessToken  string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Src          string `protobuf:"bytes,2,opt,name=src" json:"src,omitempty"`
+	Dst          string `protobuf:"bytes,3,opt,name=dst" json:"dst,omitempty"`
+	ChecksumType string `protobuf:"bytes,4,opt,name=checksum_type" json:"checksum_type,omitempty"`
+	Preserve     bool   `protobuf:"varint,5,opt,name=preserve" json:"preserve,omitempty"`
 }
 
 func (m *CpReq) Reset()         { *m = CpReq{} }
@@ -88,15 +111,32 @@ func (m *MkdirReq) String() string { return proto.CompactTextString(m) }
 func (*MkdirReq) ProtoMessage()    {}
 
 type StatReq struct {
-	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
-	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
-	Children    bool   `protobuf:"varint,3,opt,name=children" json:"children,omitempty"`
+	AccessToken  string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path         string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Children     bool   `protobuf:"varint,3,opt,name=children" json:"children,omitempty"`
+	ChecksumType string `protobuf:"bytes,4,opt,name=checksum_type" json:"checksum_type,omitempty"`
+	Prefix       string `protobuf:"bytes,5,opt,name=prefix" json:"prefix,omitempty"`
+	Sort         string `protobuf:"bytes,6,opt,name=sort" json:"sort,omitempty"`
+	Cursor       string `protobuf:"bytes,7,opt,name=cursor" json:"cursor,omitempty"`
+	Limit        uint32 `protobuf:"varint,8,opt,name=limit" json:"limit,omitempty"`
 }
 
 func (m *StatReq) Reset()         { *m = StatReq{} }
 func (m *StatReq) String() string { return proto.CompactTextString(m) }
 func (*StatReq) ProtoMessage()    {}
 
+type ListDirReq struct {
+	AccessToken  string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path         string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Prefix       string `protobuf:"bytes,3,opt,name=prefix" json:"prefix,omitempty"`
+	Sort         string `protobuf:"bytes,4,opt,name=sort" json:"sort,omitempty"`
+	ChecksumType string `protobuf:"bytes,5,opt,name=checksum_type" json:"checksum_type,omitempty"`
+}
+
+func (m *ListDirReq) Reset()         { *m = ListDirReq{} }
+func (m *ListDirReq) String() string { return proto.CompactTextString(m) }
+func (*ListDirReq) ProtoMessage()    {}
+
 type Metadata struct {
 	Id          string      `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
 	Path        string      `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
@@ -108,6 +148,7 @@ type Metadata struct {
 	Etag        string      `protobuf:"bytes,8,opt,name=etag" json:"etag,omitempty"`
 	Permissions uint32      `protobuf:"varint,9,opt,name=permissions" json:"permissions,omitempty"`
 	Children    []*Metadata `protobuf:"bytes,10,rep,name=children" json:"children,omitempty"`
+	NextCursor  string      `protobuf:"bytes,11,opt,name=next_cursor" json:"next_cursor,omitempty"`
 }
 
 func (m *Metadata) Reset()         { *m = Metadata{} }
@@ -121,6 +162,236 @@ func (m *Metadata) GetChildren() []*Metadata {
 	return nil
 }
 
+type ListTrashReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+}
+
+func (m *ListTrashReq) Reset()         { *m = ListTrashReq{} }
+func (m *ListTrashReq) String() string { return proto.CompactTextString(m) }
+func (*ListTrashReq) ProtoMessage()    {}
+
+type RestoreTrashReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Key         string `protobuf:"bytes,2,opt,name=key" json:"key,omitempty"`
+	Dst         string `protobuf:"bytes,3,opt,name=dst" json:"dst,omitempty"`
+}
+
+func (m *RestoreTrashReq) Reset()         { *m = RestoreTrashReq{} }
+func (m *RestoreTrashReq) String() string { return proto.CompactTextString(m) }
+func (*RestoreTrashReq) ProtoMessage()    {}
+
+type PurgeTrashReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Key         string `protobuf:"bytes,2,opt,name=key" json:"key,omitempty"`
+}
+
+func (m *PurgeTrashReq) Reset()         { *m = PurgeTrashReq{} }
+func (m *PurgeTrashReq) String() string { return proto.CompactTextString(m) }
+func (*PurgeTrashReq) ProtoMessage()    {}
+
+type TrashEntry struct {
+	Key         string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Deleted     uint32 `protobuf:"varint,3,opt,name=deleted" json:"deleted,omitempty"`
+	Id          string `protobuf:"bytes,4,opt,name=id" json:"id,omitempty"`
+	Size        uint32 `protobuf:"varint,5,opt,name=size" json:"size,omitempty"`
+	IsContainer bool   `protobuf:"varint,6,opt,name=is_container" json:"is_container,omitempty"`
+}
+
+func (m *TrashEntry) Reset()         { *m = TrashEntry{} }
+func (m *TrashEntry) String() string { return proto.CompactTextString(m) }
+func (*TrashEntry) ProtoMessage()    {}
+
+type TrashList struct {
+	Entries []*TrashEntry `protobuf:"bytes,1,rep,name=entries" json:"entries,omitempty"`
+}
+
+func (m *TrashList) Reset()         { *m = TrashList{} }
+func (m *TrashList) String() string { return proto.CompactTextString(m) }
+func (*TrashList) ProtoMessage()    {}
+
+func (m *TrashList) GetEntries() []*TrashEntry {
+	if m != nil {
+		return m.Entries
+	}
+	return nil
+}
+
+type ListVersionsReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+}
+
+func (m *ListVersionsReq) Reset()         { *m = ListVersionsReq{} }
+func (m *ListVersionsReq) String() string { return proto.CompactTextString(m) }
+func (*ListVersionsReq) ProtoMessage()    {}
+
+type StatVersionReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Key         string `protobuf:"bytes,3,opt,name=key" json:"key,omitempty"`
+}
+
+func (m *StatVersionReq) Reset()         { *m = StatVersionReq{} }
+func (m *StatVersionReq) String() string { return proto.CompactTextString(m) }
+func (*StatVersionReq) ProtoMessage()    {}
+
+type RestoreVersionReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Key         string `protobuf:"bytes,3,opt,name=key" json:"key,omitempty"`
+}
+
+func (m *RestoreVersionReq) Reset()         { *m = RestoreVersionReq{} }
+func (m *RestoreVersionReq) String() string { return proto.CompactTextString(m) }
+func (*RestoreVersionReq) ProtoMessage()    {}
+
+type Version struct {
+	Key      string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Path     string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Size     uint32 `protobuf:"varint,3,opt,name=size" json:"size,omitempty"`
+	Modified uint32 `protobuf:"varint,4,opt,name=modified" json:"modified,omitempty"`
+}
+
+func (m *Version) Reset()         { *m = Version{} }
+func (m *Version) String() string { return proto.CompactTextString(m) }
+func (*Version) ProtoMessage()    {}
+
+type VersionList struct {
+	Versions []*Version `protobuf:"bytes,1,rep,name=versions" json:"versions,omitempty"`
+}
+
+func (m *VersionList) Reset()         { *m = VersionList{} }
+func (m *VersionList) String() string { return proto.CompactTextString(m) }
+func (*VersionList) ProtoMessage()    {}
+
+func (m *VersionList) GetVersions() []*Version {
+	if m != nil {
+		return m.Versions
+	}
+	return nil
+}
+
+type GetQuotaReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+}
+
+func (m *GetQuotaReq) Reset()         { *m = GetQuotaReq{} }
+func (m *GetQuotaReq) String() string { return proto.CompactTextString(m) }
+func (*GetQuotaReq) ProtoMessage()    {}
+
+type Quota struct {
+	UsedBytes       uint64 `protobuf:"varint,1,opt,name=used_bytes" json:"used_bytes,omitempty"`
+	MaxBytes        uint64 `protobuf:"varint,2,opt,name=max_bytes" json:"max_bytes,omitempty"`
+	AvailableBytes  uint64 `protobuf:"varint,3,opt,name=available_bytes" json:"available_bytes,omitempty"`
+	UsedInodes      uint64 `protobuf:"varint,4,opt,name=used_inodes" json:"used_inodes,omitempty"`
+	MaxInodes       uint64 `protobuf:"varint,5,opt,name=max_inodes" json:"max_inodes,omitempty"`
+	AvailableInodes uint64 `protobuf:"varint,6,opt,name=available_inodes" json:"available_inodes,omitempty"`
+}
+
+func (m *Quota) Reset()         { *m = Quota{} }
+func (m *Quota) String() string { return proto.CompactTextString(m) }
+func (*Quota) ProtoMessage()    {}
+
+type CpProgress struct {
+	CopiedBytes uint64 `protobuf:"varint,1,opt,name=copied_bytes" json:"copied_bytes,omitempty"`
+	CopiedFiles uint64 `protobuf:"varint,2,opt,name=copied_files" json:"copied_files,omitempty"`
+	TotalBytes  uint64 `protobuf:"varint,3,opt,name=total_bytes" json:"total_bytes,omitempty"`
+	TotalFiles  uint64 `protobuf:"varint,4,opt,name=total_files" json:"total_files,omitempty"`
+	Done        bool   `protobuf:"varint,5,opt,name=done" json:"done,omitempty"`
+}
+
+func (m *CpProgress) Reset()         { *m = CpProgress{} }
+func (m *CpProgress) String() string { return proto.CompactTextString(m) }
+func (*CpProgress) ProtoMessage()    {}
+
+type CreateShareReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Grantee     string `protobuf:"bytes,3,opt,name=grantee" json:"grantee,omitempty"`
+	GranteeType string `protobuf:"bytes,4,opt,name=grantee_type" json:"grantee_type,omitempty"`
+	Permission  string `protobuf:"bytes,5,opt,name=permission" json:"permission,omitempty"`
+}
+
+func (m *CreateShareReq) Reset()         { *m = CreateShareReq{} }
+func (m *CreateShareReq) String() string { return proto.CompactTextString(m) }
+func (*CreateShareReq) ProtoMessage()    {}
+
+type ListSharesReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+}
+
+func (m *ListSharesReq) Reset()         { *m = ListSharesReq{} }
+func (m *ListSharesReq) String() string { return proto.CompactTextString(m) }
+func (*ListSharesReq) ProtoMessage()    {}
+
+type RemoveShareReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Id          string `protobuf:"bytes,2,opt,name=id" json:"id,omitempty"`
+}
+
+func (m *RemoveShareReq) Reset()         { *m = RemoveShareReq{} }
+func (m *RemoveShareReq) String() string { return proto.CompactTextString(m) }
+func (*RemoveShareReq) ProtoMessage()    {}
+
+type Share struct {
+	Id                string `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Owner             string `protobuf:"bytes,2,opt,name=owner" json:"owner,omitempty"`
+	Path              string `protobuf:"bytes,3,opt,name=path" json:"path,omitempty"`
+	Grantee           string `protobuf:"bytes,4,opt,name=grantee" json:"grantee,omitempty"`
+	GranteeType       string `protobuf:"bytes,5,opt,name=grantee_type" json:"grantee_type,omitempty"`
+	Permission        string `protobuf:"bytes,6,opt,name=permission" json:"permission,omitempty"`
+	Created           uint32 `protobuf:"varint,7,opt,name=created" json:"created,omitempty"`
+	Expires           uint32 `protobuf:"varint,8,opt,name=expires" json:"expires,omitempty"`
+	PasswordProtected bool   `protobuf:"varint,9,opt,name=password_protected" json:"password_protected,omitempty"`
+}
+
+func (m *Share) Reset()         { *m = Share{} }
+func (m *Share) String() string { return proto.CompactTextString(m) }
+func (*Share) ProtoMessage()    {}
+
+type ShareList struct {
+	Shares []*Share `protobuf:"bytes,1,rep,name=shares" json:"shares,omitempty"`
+}
+
+func (m *ShareList) Reset()         { *m = ShareList{} }
+func (m *ShareList) String() string { return proto.CompactTextString(m) }
+func (*ShareList) ProtoMessage()    {}
+
+func (m *ShareList) GetShares() []*Share {
+	if m != nil {
+		return m.Shares
+	}
+	return nil
+}
+
+type CreateLinkReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Password    string `protobuf:"bytes,3,opt,name=password" json:"password,omitempty"`
+	Expires     uint32 `protobuf:"varint,4,opt,name=expires" json:"expires,omitempty"`
+	Mode        string `protobuf:"bytes,5,opt,name=mode" json:"mode,omitempty"`
+}
+
+func (m *CreateLinkReq) Reset()         { *m = CreateLinkReq{} }
+func (m *CreateLinkReq) String() string { return proto.CompactTextString(m) }
+func (*CreateLinkReq) ProtoMessage()    {}
+
+type StatByLinkReq struct {
+	Token    string `protobuf:"bytes,1,opt,name=token" json:"token,omitempty"`
+	Password string `protobuf:"bytes,2,opt,name=password" json:"password,omitempty"`
+	Path     string `protobuf:"bytes,3,opt,name=path" json:"path,omitempty"`
+	Children bool   `protobuf:"varint,4,opt,name=children" json:"children,omitempty"`
+	Prefix   string `protobuf:"bytes,5,opt,name=prefix" json:"prefix,omitempty"`
+	Sort     string `protobuf:"bytes,6,opt,name=sort" json:"sort,omitempty"`
+	Cursor   string `protobuf:"bytes,7,opt,name=cursor" json:"cursor,omitempty"`
+	Limit    uint32 `protobuf:"varint,8,opt,name=limit" json:"limit,omitempty"`
+}
+
+func (m *StatByLinkReq) Reset()         { *m = StatByLinkReq{} }
+func (m *StatByLinkReq) String() string { return proto.CompactTextString(m) }
+func (*StatByLinkReq) ProtoMessage()    {}
+
 // Reference imports to suppress errors if they are not otherwise used.
 var _ context.Context
 var _ grpc.ClientConn
@@ -134,6 +405,20 @@ type MetaClient interface {
 	Cp(ctx context.Context, in *CpReq, opts ...grpc.CallOption) (*Void, error)
 	Mv(ctx context.Context, in *MvReq, opts ...grpc.CallOption) (*Void, error)
 	Rm(ctx context.Context, in *RmReq, opts ...grpc.CallOption) (*Void, error)
+	ListTrash(ctx context.Context, in *ListTrashReq, opts ...grpc.CallOption) (*TrashList, error)
+	RestoreTrash(ctx context.Context, in *RestoreTrashReq, opts ...grpc.CallOption) (*Void, error)
+	PurgeTrash(ctx context.Context, in *PurgeTrashReq, opts ...grpc.CallOption) (*Void, error)
+	ListVersions(ctx context.Context, in *ListVersionsReq, opts ...grpc.CallOption) (*VersionList, error)
+	StatVersion(ctx context.Context, in *StatVersionReq, opts ...grpc.CallOption) (*Metadata, error)
+	RestoreVersion(ctx context.Context, in *RestoreVersionReq, opts ...grpc.CallOption) (*Void, error)
+	GetQuota(ctx context.Context, in *GetQuotaReq, opts ...grpc.CallOption) (*Quota, error)
+	ListDir(ctx context.Context, in *ListDirReq, opts ...grpc.CallOption) (Meta_ListDirClient, error)
+	CpWithProgress(ctx context.Context, in *CpReq, opts ...grpc.CallOption) (Meta_CpWithProgressClient, error)
+	CreateShare(ctx context.Context, in *CreateShareReq, opts ...grpc.CallOption) (*Share, error)
+	ListShares(ctx context.Context, in *ListSharesReq, opts ...grpc.CallOption) (*ShareList, error)
+	RemoveShare(ctx context.Context, in *RemoveShareReq, opts ...grpc.CallOption) (*Void, error)
+	CreateLink(ctx context.Context, in *CreateLinkReq, opts ...grpc.CallOption) (*Share, error)
+	StatByLink(ctx context.Context, in *StatByLinkReq, opts ...grpc.CallOption) (*Metadata, error)
 }
 
 type metaClient struct {
@@ -198,6 +483,178 @@ func (c *metaClient) Rm(ctx context.Context, in *RmReq, opts ...grpc.CallOption)
 	return out, nil
 }
 
+func (c *metaClient) ListTrash(ctx context.Context, in *ListTrashReq, opts ...grpc.CallOption) (*TrashList, error) {
+	out := new(TrashList)
+	err := grpc.Invoke(ctx, "/metadata.Meta/ListTrash", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaClient) RestoreTrash(ctx context.Context, in *RestoreTrashReq, opts ...grpc.CallOption) (*Void, error) {
+	out := new(Void)
+	err := grpc.Invoke(ctx, "/metadata.Meta/RestoreTrash", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaClient) PurgeTrash(ctx context.Context, in *PurgeTrashReq, opts ...grpc.CallOption) (*Void, error) {
+	out := new(Void)
+	err := grpc.Invoke(ctx, "/metadata.Meta/PurgeTrash", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaClient) ListVersions(ctx context.Context, in *ListVersionsReq, opts ...grpc.CallOption) (*VersionList, error) {
+	out := new(VersionList)
+	err := grpc.Invoke(ctx, "/metadata.Meta/ListVersions", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaClient) StatVersion(ctx context.Context, in *StatVersionReq, opts ...grpc.CallOption) (*Metadata, error) {
+	out := new(Metadata)
+	err := grpc.Invoke(ctx, "/metadata.Meta/StatVersion", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaClient) RestoreVersion(ctx context.Context, in *RestoreVersionReq, opts ...grpc.CallOption) (*Void, error) {
+	out := new(Void)
+	err := grpc.Invoke(ctx, "/metadata.Meta/RestoreVersion", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaClient) GetQuota(ctx context.Context, in *GetQuotaReq, opts ...grpc.CallOption) (*Quota, error) {
+	out := new(Quota)
+	err := grpc.Invoke(ctx, "/metadata.Meta/GetQuota", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaClient) ListDir(ctx context.Context, in *ListDirReq, opts ...grpc.CallOption) (Meta_ListDirClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Meta_serviceDesc.Streams[0], c.cc, "/metadata.Meta/ListDir", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metaListDirClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Meta_ListDirClient interface {
+	Recv() (*Metadata, error)
+	grpc.ClientStream
+}
+
+type metaListDirClient struct {
+	grpc.ClientStream
+}
+
+func (x *metaListDirClient) Recv() (*Metadata, error) {
+	m := new(Metadata)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *metaClient) CpWithProgress(ctx context.Context, in *CpReq, opts ...grpc.CallOption) (Meta_CpWithProgressClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Meta_serviceDesc.Streams[1], c.cc, "/metadata.Meta/CpWithProgress", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metaCpWithProgressClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Meta_CpWithProgressClient interface {
+	Recv() (*CpProgress, error)
+	grpc.ClientStream
+}
+
+type metaCpWithProgressClient struct {
+	grpc.ClientStream
+}
+
+func (x *metaCpWithProgressClient) Recv() (*CpProgress, error) {
+	m := new(CpProgress)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *metaClient) CreateShare(ctx context.Context, in *CreateShareReq, opts ...grpc.CallOption) (*Share, error) {
+	out := new(Share)
+	err := grpc.Invoke(ctx, "/metadata.Meta/CreateShare", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaClient) ListShares(ctx context.Context, in *ListSharesReq, opts ...grpc.CallOption) (*ShareList, error) {
+	out := new(ShareList)
+	err := grpc.Invoke(ctx, "/metadata.Meta/ListShares", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaClient) RemoveShare(ctx context.Context, in *RemoveShareReq, opts ...grpc.CallOption) (*Void, error) {
+	out := new(Void)
+	err := grpc.Invoke(ctx, "/metadata.Meta/RemoveShare", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaClient) CreateLink(ctx context.Context, in *CreateLinkReq, opts ...grpc.CallOption) (*Share, error) {
+	out := new(Share)
+	err := grpc.Invoke(ctx, "/metadata.Meta/CreateLink", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaClient) StatByLink(ctx context.Context, in *StatByLinkReq, opts ...grpc.CallOption) (*Metadata, error) {
+	out := new(Metadata)
+	err := grpc.Invoke(ctx, "/metadata.Meta/StatByLink", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for Meta service
 
 type MetaServer interface {
@@ -207,6 +664,20 @@ type MetaServer interface {
 	Cp(context.Context, *CpReq) (*Void, error)
 	Mv(context.Context, *MvReq) (*Void, error)
 	Rm(context.Context, *RmReq) (*Void, error)
+	ListTrash(context.Context, *ListTrashReq) (*TrashList, error)
+	RestoreTrash(context.Context, *RestoreTrashReq) (*Void, error)
+	PurgeTrash(context.Context, *PurgeTrashReq) (*Void, error)
+	ListVersions(context.Context, *ListVersionsReq) (*VersionList, error)
+	StatVersion(context.Context, *StatVersionReq) (*Metadata, error)
+	RestoreVersion(context.Context, *RestoreVersionReq) (*Void, error)
+	GetQuota(context.Context, *GetQuotaReq) (*Quota, error)
+	ListDir(*ListDirReq, Meta_ListDirServer) error
+	CpWithProgress(*CpReq, Meta_CpWithProgressServer) error
+	CreateShare(context.Context, *CreateShareReq) (*Share, error)
+	ListShares(context.Context, *ListSharesReq) (*ShareList, error)
+	RemoveShare(context.Context, *RemoveShareReq) (*Void, error)
+	CreateLink(context.Context, *CreateLinkReq) (*Share, error)
+	StatByLink(context.Context, *StatByLinkReq) (*Metadata, error)
 }
 
 func RegisterMetaServer(s *grpc.Server, srv MetaServer) {
@@ -285,6 +756,192 @@ func _Meta_Rm_Handler(srv interface{}, ctx context.Context, dec func(interface{}
 	return out, nil
 }
 
+func _Meta_ListTrash_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(ListTrashReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).ListTrash(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Meta_RestoreTrash_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(RestoreTrashReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).RestoreTrash(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Meta_PurgeTrash_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(PurgeTrashReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).PurgeTrash(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Meta_ListVersions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(ListVersionsReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).ListVersions(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Meta_StatVersion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(StatVersionReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).StatVersion(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Meta_RestoreVersion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(RestoreVersionReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).RestoreVersion(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Meta_GetQuota_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(GetQuotaReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).GetQuota(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Meta_ListDir_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListDirReq)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetaServer).ListDir(m, &metaListDirServer{stream})
+}
+
+type Meta_ListDirServer interface {
+	Send(*Metadata) error
+	grpc.ServerStream
+}
+
+type metaListDirServer struct {
+	grpc.ServerStream
+}
+
+func (x *metaListDirServer) Send(m *Metadata) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Meta_CpWithProgress_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(CpReq)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetaServer).CpWithProgress(m, &metaCpWithProgressServer{stream})
+}
+
+type Meta_CpWithProgressServer interface {
+	Send(*CpProgress) error
+	grpc.ServerStream
+}
+
+type metaCpWithProgressServer struct {
+	grpc.ServerStream
+}
+
+func (x *metaCpWithProgressServer) Send(m *CpProgress) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Meta_CreateShare_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(CreateShareReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).CreateShare(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Meta_ListShares_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(ListSharesReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).ListShares(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Meta_RemoveShare_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(RemoveShareReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).RemoveShare(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Meta_CreateLink_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(CreateLinkReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).CreateLink(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Meta_StatByLink_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(StatByLinkReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(MetaServer).StatByLink(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 var _Meta_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "metadata.Meta",
 	HandlerType: (*MetaServer)(nil),
@@ -313,6 +970,65 @@ var _Meta_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Rm",
 			Handler:    _Meta_Rm_Handler,
 		},
+		{
+			MethodName: "ListTrash",
+			Handler:    _Meta_ListTrash_Handler,
+		},
+		{
+			MethodName: "RestoreTrash",
+			Handler:    _Meta_RestoreTrash_Handler,
+		},
+		{
+			MethodName: "PurgeTrash",
+			Handler:    _Meta_PurgeTrash_Handler,
+		},
+		{
+			MethodName: "ListVersions",
+			Handler:    _Meta_ListVersions_Handler,
+		},
+		{
+			MethodName: "StatVersion",
+			Handler:    _Meta_StatVersion_Handler,
+		},
+		{
+			MethodName: "RestoreVersion",
+			Handler:    _Meta_RestoreVersion_Handler,
+		},
+		{
+			MethodName: "GetQuota",
+			Handler:    _Meta_GetQuota_Handler,
+		},
+		{
+			MethodName: "CreateShare",
+			Handler:    _Meta_CreateShare_Handler,
+		},
+		{
+			MethodName: "ListShares",
+			Handler:    _Meta_ListShares_Handler,
+		},
+		{
+			MethodName: "RemoveShare",
+			Handler:    _Meta_RemoveShare_Handler,
+		},
+		{
+			MethodName: "CreateLink",
+			Handler:    _Meta_CreateLink_Handler,
+		},
+		{
+			MethodName: "StatByLink",
+			Handler:    _Meta_StatByLink_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListDir",
+			Handler:       _Meta_ListDir_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "CpWithProgress",
+			Handler:       _Meta_CpWithProgress_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams: []grpc.StreamDesc{},
 }
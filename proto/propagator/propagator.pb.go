@@ -12,9 +12,11 @@ It has these top-level messages:
 	Void
 	PutReq
 	GetReq
+	GetBatchReq
 	RmReq
 	MvReq
 	Record
+	RecordList
 */
 package propagator
 
@@ -59,6 +61,16 @@ func (m *GetReq) Reset()         { *m = GetReq{} }
 func (m *GetReq) String() string { return proto.CompactTextString(m) }
 func (*GetReq) ProtoMessage()    {}
 
+type GetBatchReq struct {
+	AccessToken   string   `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Paths         []string `protobuf:"bytes,2,rep,name=paths" json:"paths,omitempty"`
+	ForceCreation bool     `protobuf:"varint,3,opt,name=force_creation" json:"force_creation,omitempty"`
+}
+
+func (m *GetBatchReq) Reset()         { *m = GetBatchReq{} }
+func (m *GetBatchReq) String() string { return proto.CompactTextString(m) }
+func (*GetBatchReq) ProtoMessage()    {}
+
 type RmReq struct {
 	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
 	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
@@ -90,6 +102,21 @@ func (m *Record) Reset()         { *m = Record{} }
 func (m *Record) String() string { return proto.CompactTextString(m) }
 func (*Record) ProtoMessage()    {}
 
+type RecordList struct {
+	Records []*Record `protobuf:"bytes,1,rep,name=records" json:"records,omitempty"`
+}
+
+func (m *RecordList) Reset()         { *m = RecordList{} }
+func (m *RecordList) String() string { return proto.CompactTextString(m) }
+func (*RecordList) ProtoMessage()    {}
+
+func (m *RecordList) GetRecords() []*Record {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
 // Reference imports to suppress errors if they are not otherwise used.
 var _ context.Context
 var _ grpc.ClientConn
@@ -99,6 +126,7 @@ var _ grpc.ClientConn
 type PropClient interface {
 	Put(ctx context.Context, in *PutReq, opts ...grpc.CallOption) (*Void, error)
 	Get(ctx context.Context, in *GetReq, opts ...grpc.CallOption) (*Record, error)
+	GetBatch(ctx context.Context, in *GetBatchReq, opts ...grpc.CallOption) (*RecordList, error)
 	// rpc Cp(CpReq) returns (Void) {}
 	Mv(ctx context.Context, in *MvReq, opts ...grpc.CallOption) (*Void, error)
 	Rm(ctx context.Context, in *RmReq, opts ...grpc.CallOption) (*Void, error)
@@ -130,6 +158,15 @@ func (c *propClient) Get(ctx context.Context, in *GetReq, opts ...grpc.CallOptio
 	return out, nil
 }
 
+func (c *propClient) GetBatch(ctx context.Context, in *GetBatchReq, opts ...grpc.CallOption) (*RecordList, error) {
+	out := new(RecordList)
+	err := grpc.Invoke(ctx, "/propagator.Prop/GetBatch", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *propClient) Mv(ctx context.Context, in *MvReq, opts ...grpc.CallOption) (*Void, error) {
 	out := new(Void)
 	err := grpc.Invoke(ctx, "/propagator.Prop/Mv", in, out, c.cc, opts...)
@@ -153,6 +190,7 @@ func (c *propClient) Rm(ctx context.Context, in *RmReq, opts ...grpc.CallOption)
 type PropServer interface {
 	Put(context.Context, *PutReq) (*Void, error)
 	Get(context.Context, *GetReq) (*Record, error)
+	GetBatch(context.Context, *GetBatchReq) (*RecordList, error)
 	// rpc Cp(CpReq) returns (Void) {}
 	Mv(context.Context, *MvReq) (*Void, error)
 	Rm(context.Context, *RmReq) (*Void, error)
@@ -186,6 +224,18 @@ func _Prop_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{
 	return out, nil
 }
 
+func _Prop_GetBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(GetBatchReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).GetBatch(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func _Prop_Mv_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
 	in := new(MvReq)
 	if err := dec(in); err != nil {
@@ -222,6 +272,10 @@ var _Prop_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Get",
 			Handler:    _Prop_Get_Handler,
 		},
+		{
+			MethodName: "GetBatch",
+			Handler:    _Prop_GetBatch_Handler,
+		},
 		{
 			MethodName: "Mv",
 			Handler:    _Prop_Mv_Handler,
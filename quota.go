@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// quotaLimits are the limits applied to a user home.
+// A zero value means no limit.
+type quotaLimits struct {
+	MaxBytes  uint64 `json:"max_bytes"`
+	MaxInodes uint64 `json:"max_inodes"`
+}
+
+// usage is the space used by a tree.
+// Every file and container, including the root of the tree, is one inode.
+type usage struct {
+	bytes  uint64
+	inodes uint64
+}
+
+// usageCache keeps the usage of user homes so it is only computed
+// walking the tree the first time or after it has been invalidated.
+type usageCache struct {
+	mu     sync.Mutex
+	usages map[string]usage
+}
+
+func newUsageCache() *usageCache {
+	return &usageCache{usages: map[string]usage{}}
+}
+
+func (c *usageCache) get(home string) (usage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u, ok := c.usages[home]
+	return u, ok
+}
+
+func (c *usageCache) set(home string, u usage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usages[home] = u
+}
+
+// add adds u to the usage of home if it is cached.
+func (c *usageCache) add(home string, u usage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.usages[home]
+	if !ok {
+		return
+	}
+	cached.bytes += u.bytes
+	cached.inodes += u.inodes
+	c.usages[home] = cached
+}
+
+func (c *usageCache) invalidate(home string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.usages, home)
+}
+
+// loadQuotaOverrides reads the per user quota limits from a JSON file
+// with the format {"<account>": {"max_bytes": 1024, "max_inodes": 10}}.
+// See getAccountID for the format of the accounts.
+// An empty file name means there are no overrides.
+func loadQuotaOverrides(fn string) (map[string]quotaLimits, error) {
+	overrides := map[string]quotaLimits{}
+	if fn == "" {
+		return overrides, nil
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// getQuotaLimits returns the quota limits of the user.
+func (s *server) getQuotaLimits(idt *authlib.Identity) quotaLimits {
+	if l, ok := s.c.quotaOverrides[s.getAccountID(idt)]; ok {
+		return l
+	}
+	return quotaLimits{MaxBytes: s.c.QuotaMaxBytes, MaxInodes: s.c.QuotaMaxInodes}
+}
+
+// computeUsage walks the tree p and returns the space it uses.
+// Links are not followed: what they point to is counted where it lives.
+func (s *server) computeUsage(p string) (usage, error) {
+	finfo, err := s.storage.Lstat(p)
+	if err != nil {
+		return usage{}, err
+	}
+	if finfo.Mode()&os.ModeSymlink != 0 {
+		return usage{}, nil
+	}
+
+	u := usage{inodes: 1}
+	if !finfo.IsDir() {
+		u.bytes = uint64(finfo.Size())
+		return u, nil
+	}
+
+	names, err := s.storage.List(p)
+	if err != nil {
+		return usage{}, err
+	}
+
+	for _, n := range names {
+		cu, err := s.computeUsage(path.Join(p, n))
+		if err != nil {
+			return usage{}, err
+		}
+		u.bytes += cu.bytes
+		u.inodes += cu.inodes
+	}
+	return u, nil
+}
+
+// getUsage returns the space used by the user home.
+// The trash and the previous versions of the files
+// of the user take space from it too.
+func (s *server) getUsage(idt *authlib.Identity) (usage, error) {
+	home := s.getHome(idt)
+	if u, ok := s.usages.get(home); ok {
+		return u, nil
+	}
+
+	u, err := s.computeUsage(home)
+	if err != nil {
+		return usage{}, err
+	}
+	for _, p := range []string{s.getTrash(idt), path.Join(versionsDir, s.getAccountID(idt))} {
+		au, err := s.computeUsage(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return usage{}, err
+		}
+		// the directory holding them is not a resource of the user
+		u.bytes += au.bytes
+		u.inodes += au.inodes - 1
+	}
+	s.usages.set(home, u)
+	return u, nil
+}
+
+// logUsage logs the space used by the user home.
+// It also leaves the usage cached for the next quota checks.
+func (s *server) logUsage(log *rus.Entry, idt *authlib.Identity) {
+	u, err := s.getUsage(idt)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	log.Infof("home %s uses %d bytes and %d inodes", s.getHome(idt), u.bytes, u.inodes)
+}
+
+// checkQuota returns a codes.ResourceExhausted error if adding u
+// to the user home exceeds its quota limits.
+func (s *server) checkQuota(idt *authlib.Identity, u usage) error {
+	l := s.getQuotaLimits(idt)
+	if l.MaxBytes == 0 && l.MaxInodes == 0 {
+		return nil
+	}
+
+	used, err := s.getUsage(idt)
+	if err != nil {
+		return err
+	}
+
+	if l.MaxBytes > 0 && used.bytes+u.bytes > l.MaxBytes {
+		return grpc.Errorf(codes.ResourceExhausted, "quota exceeded: %d bytes used of %d", used.bytes, l.MaxBytes)
+	}
+	if l.MaxInodes > 0 && used.inodes+u.inodes > l.MaxInodes {
+		return grpc.Errorf(codes.ResourceExhausted, "quota exceeded: %d inodes used of %d", used.inodes, l.MaxInodes)
+	}
+	return nil
+}
+
+func (s *server) GetQuota(ctx context.Context, req *pb.GetQuotaReq) (*pb.Quota, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.Quota{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	used, err := s.getUsage(idt)
+	if err != nil {
+		log.Error(err)
+		return &pb.Quota{}, err
+	}
+
+	l := s.getQuotaLimits(idt)
+
+	q := &pb.Quota{}
+	q.UsedBytes = used.bytes
+	q.MaxBytes = l.MaxBytes
+	q.UsedInodes = used.inodes
+	q.MaxInodes = l.MaxInodes
+	if l.MaxBytes > used.bytes {
+		q.AvailableBytes = l.MaxBytes - used.bytes
+	}
+	if l.MaxInodes > used.inodes {
+		q.AvailableInodes = l.MaxInodes - used.inodes
+	}
+
+	log.Infof("home %s uses %d bytes and %d inodes", s.getHome(idt), used.bytes, used.inodes)
+
+	return q, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestGetQuota(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.srv.c.QuotaMaxBytes, h.srv.c.QuotaMaxInodes = 100, 10
+	h.srv.c.quotaOverrides = map[string]quotaLimits{"other": {MaxBytes: 1000}}
+
+	h.writeFile(h.home+"/notes.txt", "hello")
+	h.writeFile(h.home+"/photos/a.jpg", "abc")
+
+	q, err := h.client.GetQuota(h.ctx, &pb.GetQuotaReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// home, notes.txt, photos and a.jpg
+	if q.UsedBytes != 8 || q.UsedInodes != 4 {
+		t.Errorf("got %d bytes and %d inodes used, want 8 and 4", q.UsedBytes, q.UsedInodes)
+	}
+	if q.MaxBytes != 100 || q.AvailableBytes != 92 || q.MaxInodes != 10 || q.AvailableInodes != 6 {
+		t.Errorf("got quota %+v", q)
+	}
+
+	other := newTestToken(t, "other")
+	if _, err := h.client.Home(h.ctx, &pb.HomeReq{AccessToken: other}); err != nil {
+		t.Fatal(err)
+	}
+	q, err = h.client.GetQuota(h.ctx, &pb.GetQuotaReq{AccessToken: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.MaxBytes != 1000 || q.MaxInodes != 0 || q.UsedInodes != 1 {
+		t.Errorf("got quota %+v for other", q)
+	}
+
+	_, err = h.client.GetQuota(h.ctx, &pb.GetQuotaReq{AccessToken: "bad"})
+	if grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestQuotaEnforcement(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.srv.c.QuotaMaxBytes, h.srv.c.QuotaMaxInodes = 10, 5
+
+	h.writeFile(h.home+"/big.txt", "123456")
+	h.writeFile(h.home+"/small.txt", "1")
+
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{"mkdir", func() error {
+			_, err := h.client.Mkdir(h.ctx, &pb.MkdirReq{AccessToken: h.token, Path: h.home + "/a"})
+			return err
+		}, codes.OK},
+		{"cp within quota", func() error {
+			_, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: h.token, Src: h.home + "/small.txt", Dst: h.home + "/a/small.txt"})
+			return err
+		}, codes.OK},
+		{"cp exceeds bytes", func() error {
+			_, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: h.token, Src: h.home + "/big.txt", Dst: h.home + "/big-copy.txt"})
+			return err
+		}, codes.ResourceExhausted},
+		{"mkdir exceeds inodes", func() error {
+			_, err := h.client.Mkdir(h.ctx, &pb.MkdirReq{AccessToken: h.token, Path: h.home + "/b"})
+			return err
+		}, codes.ResourceExhausted},
+	}
+
+	for _, tt := range tests {
+		err := tt.call()
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+		}
+	}
+
+	if h.exists(h.home+"/big-copy.txt") || h.exists(h.home+"/b") {
+		t.Errorf("resources exceeding the quota have been created")
+	}
+
+	// resources in the trash still take space
+	if _, err := h.client.Rm(h.ctx, &pb.RmReq{AccessToken: h.token, Path: h.home + "/big.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: h.token, Src: h.home + "/small.txt", Dst: h.home + "/small-copy.txt"})
+	if grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got %v after rm, want %v", grpc.Code(err), codes.ResourceExhausted)
+	}
+
+	// purging them frees space
+	list, err := h.client.ListTrash(h.ctx, &pb.ListTrashReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range list.Entries {
+		if _, err := h.client.PurgeTrash(h.ctx, &pb.PurgeTrashReq{AccessToken: h.token, Key: e.Key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h.client.Mkdir(h.ctx, &pb.MkdirReq{AccessToken: h.token, Path: h.home + "/b"}); err != nil {
+		t.Errorf("got %v after freeing space", err)
+	}
+}
+
+func TestQuotaSkipsLinks(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/a.txt", "123")
+	if err := os.Symlink("a.txt", path.Join(h.dataDir, h.home+"/link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".", path.Join(h.dataDir, h.home+"/loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := h.client.GetQuota(h.ctx, &pb.GetQuotaReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.UsedBytes != 3 || q.UsedInodes != 2 {
+		t.Errorf("got %d bytes and %d inodes used, want 3 and 2", q.UsedBytes, q.UsedInodes)
+	}
+}
+
+func TestLoadQuotaOverrides(t *testing.T) {
+	f, err := ioutil.TempFile("", "quotas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(`{"demo": {"max_bytes": 1024, "max_inodes": 10}}`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	overrides, err := loadQuotaOverrides(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := overrides["demo"]; l.MaxBytes != 1024 || l.MaxInodes != 10 {
+		t.Errorf("got %+v for demo", l)
+	}
+
+	overrides, err = loadQuotaOverrides("")
+	if err != nil || len(overrides) != 0 {
+		t.Errorf("got %v and %v without file", overrides, err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	rus "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// maxSymlinks is the maximum number of symbolic links followed
+// to resolve a path, the same limit Linux has.
+const maxSymlinks = 40
+
+// errPathEscape is returned when a path resolves outside of its jail.
+// It has its own code so clients can tell it apart from denied accesses.
+var errPathEscape = grpc.Errorf(codes.OutOfRange, "path escapes its root")
+
+// getJail returns the logical container p must never leave once resolved:
+// the home p is under or the root of the namespace for the rest of paths.
+func getJail(layout homeLayout, p string) string {
+	if owner := getOwner(layout, p); owner != nil {
+		return layout.home(owner)
+	}
+	return "/"
+}
+
+// resolvePath resolves the logical path p to a physical path under root.
+// Every element is checked with lstat and symbolic links are followed by
+// hand, so a link can never take the path out of its jail. The last element
+// is not followed when follow is false, like O_NOFOLLOW does.
+// Absolute link targets point to the host filesystem and are always rejected.
+// Elements that do not exist yet are taken literally so paths to be
+// created can be resolved too, but nothing after a missing element can
+// go up: like the kernel, a ".." below a missing element fails with ENOENT.
+func resolvePath(root string, layout homeLayout, p string, follow bool) (string, error) {
+	p = path.Clean("/" + p)
+	jail := getJail(layout, p)
+
+	cur := "/"
+	pending := strings.Split(p, "/")
+	links := 0
+	missing := false
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			// Only link targets can go up, p is already clean.
+			if missing {
+				return "", &os.PathError{Op: "resolve", Path: p, Err: syscall.ENOENT}
+			}
+			cur = path.Dir(cur)
+			continue
+		}
+
+		next := path.Join(cur, name)
+		if missing {
+			cur = next
+			continue
+		}
+		finfo, err := os.Lstat(path.Join(root, next))
+		if os.IsNotExist(err) {
+			missing = true
+			cur = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if finfo.Mode()&os.ModeSymlink == 0 || (!follow && len(pending) == 0) {
+			cur = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", &os.PathError{Op: "resolve", Path: p, Err: syscall.ELOOP}
+		}
+
+		target, err := os.Readlink(path.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			auditPathEscape(p, next, target)
+			return "", errPathEscape
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	if !isUnder(cur, jail) {
+		auditPathEscape(p, cur, "")
+		return "", errPathEscape
+	}
+	return path.Join(root, cur), nil
+}
+
+// openPath opens the logical path p under root for reading.
+// The file is opened without following links and p is resolved again once
+// it is open, so a link swapped into the path between resolving and opening
+// is caught instead of being read through.
+func openPath(root string, layout homeLayout, p string) (*os.File, error) {
+	pp, err := resolvePath(root, layout, p, true)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(pp, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	finfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := recheckPath(root, layout, p, true, finfo); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// recheckPath resolves p again and checks it still leads to the file
+// described by finfo, which was obtained from an earlier resolution of p.
+func recheckPath(root string, layout homeLayout, p string, follow bool, finfo os.FileInfo) error {
+	pp, err := resolvePath(root, layout, p, follow)
+	if err != nil {
+		return err
+	}
+	again, err := os.Lstat(pp)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(finfo, again) {
+		auditPathEscape(p, pp, "")
+		return errPathEscape
+	}
+	return nil
+}
+
+// checkParent checks that the parent of p, whose physical path is pp,
+// has not been swapped since p was resolved without following
+// its last element. It narrows the window in which a change of the
+// tree can redirect an operation on pp, but cannot close it.
+func checkParent(root string, layout homeLayout, p, pp string) error {
+	finfo, err := os.Lstat(path.Dir(pp))
+	if err != nil {
+		return err
+	}
+	return recheckPath(root, layout, path.Dir(path.Clean("/"+p)), true, finfo)
+}
+
+// auditPathEscape logs an attempt to resolve p out of its jail.
+func auditPathEscape(p, resolved, target string) {
+	rus.WithFields(rus.Fields{
+		"type":     "audit",
+		"path":     p,
+		"resolved": resolved,
+		"target":   target,
+	}).Warn("path escapes its root")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	root, err := ioutil.TempDir("", "localfs-meta-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout, _ := newHomeLayout(homeLayoutLetter, false)
+	home := "/local/users/d/demo"
+	for _, p := range []string{home + "/photos/2015", "/local/users/d/demo2/secret"} {
+		if err := os.MkdirAll(path.Join(root, p), dirPerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		home + "/album":        "photos/2015",
+		home + "/photos/up":    "../album",
+		home + "/neighbour":    "../demo2/secret",
+		home + "/host":         "/etc",
+		home + "/loop":         "loop",
+		home + "/photos/round": "../../demo2/../demo/photos",
+		home + "/dangling":     "nonexist/../neighbour",
+	}
+	for p, target := range links {
+		if err := os.Symlink(target, path.Join(root, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		follow   bool
+		resolved string
+		err      error
+	}{
+		{"plain", home + "/photos", true, home + "/photos", nil},
+		{"missing", home + "/photos/new/file", true, home + "/photos/new/file", nil},
+		{"dot dot", home + "/../../../../etc", true, "/etc", nil},
+		{"link in home", home + "/album", true, home + "/photos/2015", nil},
+		{"link to link", home + "/photos/up", true, home + "/photos/2015", nil},
+		{"link in the middle", home + "/album/new", true, home + "/photos/2015/new", nil},
+		{"link through other home", home + "/photos/round", true, home + "/photos", nil},
+		{"link to other home", home + "/neighbour", true, "", errPathEscape},
+		{"link below other home", home + "/neighbour/x", false, "", errPathEscape},
+		{"absolute link", home + "/host", true, "", errPathEscape},
+		{"no follow", home + "/neighbour", false, home + "/neighbour", nil},
+		{"no follow absolute", home + "/host", false, home + "/host", nil},
+	}
+
+	for _, tt := range tests {
+		pp, err := resolvePath(root, layout, tt.path, tt.follow)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && pp != path.Join(root, tt.resolved) {
+			t.Errorf("%s: got %s, want %s", tt.name, pp, path.Join(root, tt.resolved))
+		}
+	}
+
+	_, err = resolvePath(root, layout, home+"/loop", true)
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.ELOOP {
+		t.Errorf("loop: got error %v, want %v", err, syscall.ELOOP)
+	}
+
+	// Nothing can go up from below a missing element.
+	_, err = resolvePath(root, layout, home+"/dangling/x", true)
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.ENOENT {
+		t.Errorf("dangling: got error %v, want %v", err, syscall.ENOENT)
+	}
+}
+
+func TestRecheckPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "localfs-meta-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout, _ := newHomeLayout(homeLayoutLetter, false)
+	home := "/local/users/d/demo"
+	for _, p := range []string{home + "/a", home + "/b"} {
+		if err := os.MkdirAll(path.Join(root, p), dirPerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := openPath(root, layout, home+"/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	finfo, err := f.Stat()
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a is swapped for another dir once it has been opened.
+	if err := os.Rename(path.Join(root, home+"/a"), path.Join(root, home+"/old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b", path.Join(root, home+"/a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := recheckPath(root, layout, home+"/a", true, finfo); err != errPathEscape {
+		t.Errorf("got error %v, want %v", err, errPathEscape)
+	}
+	if err := recheckPath(root, layout, home+"/old", true, finfo); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+}
+
+func TestSymlinkEscape(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/photos/a.jpg", "a")
+	h.writeFile(h.otherHome+"/secret.txt", "secret")
+	if err := os.Symlink("../../o/other", path.Join(h.dataDir, h.home+"/other")); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := func(p string, children bool) error {
+		_, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: p, Children: children})
+		return err
+	}
+	cp := func(src, dst string) error {
+		_, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: h.token, Src: src, Dst: dst})
+		return err
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{"stat link", stat(h.home+"/other", false), codes.OutOfRange},
+		{"stat through link", stat(h.home+"/other/secret.txt", false), codes.OutOfRange},
+		{"copy through link", cp(h.home+"/other/secret.txt", h.home+"/stolen.txt"), codes.OutOfRange},
+		{"copy into link", cp(h.home+"/photos/a.jpg", h.home+"/other/a.jpg"), codes.OutOfRange},
+		{"list home", stat(h.home, true), codes.OK},
+		{"stat sibling home", stat("/local/users/d/demo2", true), codes.PermissionDenied},
+	}
+
+	for _, tt := range tests {
+		if grpc.Code(tt.err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(tt.err), tt.code, tt.err)
+		}
+	}
+
+	if h.exists(h.otherHome + "/a.jpg") {
+		t.Errorf("file has been copied to the other home")
+	}
+
+	// Links inside a copied tree are copied as links, never followed.
+	if err := os.Symlink("../../../o/other/secret.txt", path.Join(h.dataDir, h.home+"/photos/leak")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp(h.home+"/photos", h.home+"/backup"); err != nil {
+		t.Fatal(err)
+	}
+	finfo, err := os.Lstat(path.Join(h.dataDir, h.home+"/backup/leak"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("link has been copied as %v", finfo.Mode())
+	}
+
+	// The link itself can be removed.
+	if _, err := h.client.Rm(h.ctx, &pb.RmReq{AccessToken: h.token, Path: h.home + "/other"}); err != nil {
+		t.Fatal(err)
+	}
+	if !h.exists(h.otherHome + "/secret.txt") {
+		t.Errorf("link target has been removed")
+	}
+}
@@ -10,10 +10,9 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"mime"
+	"google.golang.org/grpc/credentials"
 	"os"
 	"path"
-	"strings"
 	"time"
 )
 
@@ -26,23 +25,17 @@ var (
 	permissionDenied     = grpc.Errorf(codes.PermissionDenied, "access denied")
 )
 
-type newServerParams struct {
-	dataDir            string
-	tmpDir             string
-	prop               string
-	propMaxActive      int
-	propMaxIdle        int
-	propMaxConcurrency int
-	sharedSecret       string
-}
-
-func newServer(p *newServerParams) *server {
+func newServer(c *config) (*server, error) {
 	poolOptions := resource_pool.Options{}
-	poolOptions.MaxActiveHandles = int32(p.propMaxActive)
-	poolOptions.MaxIdleHandles = uint32(p.propMaxIdle)
-	poolOptions.OpenMaxConcurrency = p.propMaxConcurrency
+	poolOptions.MaxActiveHandles = int32(c.PropMaxActive)
+	poolOptions.MaxIdleHandles = uint32(c.PropMaxIdle)
+	poolOptions.OpenMaxConcurrency = c.PropMaxConcurrency
 	poolOptions.Open = func(resourceLocation string) (interface{}, error) {
-		con, err := grpc.Dial(resourceLocation, grpc.WithInsecure())
+		opt := grpc.WithInsecure()
+		if c.propTLS != nil {
+			opt = grpc.WithTransportCredentials(credentials.NewTLS(c.propTLS))
+		}
+		con, err := grpc.Dial(resourceLocation, opt)
 		if err != nil {
 			rus.Error(err)
 			return nil, err
@@ -64,62 +57,78 @@ func newServer(p *newServerParams) *server {
 		return nil
 	}
 	pool := resource_pool.NewSimpleResourcePool(poolOptions)
-	pool.Register(p.prop)
+	pool.Register(c.Prop)
+	metrics.setGauge("localfs_meta_prop_pool_active_handles",
+		"Connections to prop in use or idle.", func() float64 {
+			return float64(pool.NumActive())
+		})
+	metrics.setGauge("localfs_meta_prop_pool_idle_handles",
+		"Idle connections to prop.", func() float64 {
+			return float64(pool.NumIdle())
+		})
 	s := &server{}
-	s.p = p
+	s.c = c
 	s.grpcPool = pool
-	return s
+	s.layout = c.layout
+	if s.layout == nil {
+		s.layout, _ = newHomeLayout(homeLayoutLetter, false)
+	}
+	s.tokens = c.tokens
+	if s.tokens == nil {
+		tokens, err := newTokenValidator(tokenOptions{algorithms: []string{"HS256"}, secret: c.SharedSecret, allowNoExpiry: c.JWTAllowNoExpiry})
+		if err != nil {
+			pool.EnterLameDuckMode()
+			return nil, err
+		}
+		s.tokens = tokens
+	}
+	s.storage = c.storage
+	if s.storage == nil {
+		s.storage = newLocalStorage(c.DataDir, c.TmpDir, s.layout)
+	}
+	s.storage = newTimedStorage(s.storage)
+	s.drainer = newDrainer()
+	s.propBreaker = newCircuitBreaker("prop", c.PropBreakerFailures, time.Duration(c.PropBreakerCooldown)*time.Second)
+	metrics.setGauge("localfs_meta_prop_breaker_state",
+		"State of the circuit breaker to prop: 0 closed, 1 half-open, 2 open.", func() float64 {
+			return float64(s.propBreaker.getState())
+		})
+	s.usages = newUsageCache()
+	s.shares = newShareIndex()
+	if err := s.loadShares(); err != nil {
+		rus.Error(err)
+	}
+	return s, nil
 }
 
 type server struct {
-	p        *newServerParams
-	grpcPool resource_pool.ResourcePool
+	c           *config
+	grpcPool    resource_pool.ResourcePool
+	layout      homeLayout
+	storage     storage
+	usages      *usageCache
+	shares      *shareIndex
+	tokens      *tokenValidator
+	drainer     *drainer
+	propBreaker *circuitBreaker
 }
 
 func (s *server) Home(ctx context.Context, req *pb.HomeReq) (*pb.Void, error) {
 
-	traceID, err := getTraceID(ctx)
-	if err != nil {
-		rus.Error(err)
-		return &pb.Void{}, err
-	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newTraceContext(ctx, traceID)
-
-	log.Info("request started")
-
-	// Time request
-	reqStart := time.Now()
-
-	defer func() {
-		// Compute request duration
-		reqDur := time.Since(reqStart)
-
-		// Log access info
-		log.WithFields(rus.Fields{
-			"method":   "home",
-			"type":     "grpcaccess",
-			"duration": reqDur.Seconds(),
-		}).Info("request finished")
-
-	}()
+	log := getLog(ctx)
 
-	idt, err := authlib.ParseToken(req.AccessToken, s.p.sharedSecret)
-	if err != nil {
-		log.Error(err)
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
 		return &pb.Void{}, unauthenticatedError
 	}
 
 	log.Infof("%s", idt)
 
-	home := getHome(idt)
+	home := s.getHome(idt)
 
 	log.Infof("user home is %s", home)
 
-	pp := s.getPhysicalPath(home)
-
-	log.Infof("user physical home is %s", pp)
-
 	resource, err := s.grpcPool.Get("")
 	if err != nil {
 		log.Error(err)
@@ -134,28 +143,39 @@ func (s *server) Home(ctx context.Context, req *pb.HomeReq) (*pb.Void, error) {
 		return &pb.Void{}, err
 	}
 	con := handle.(*grpc.ClientConn)
-	log.Infof("created connection to %s", s.p.prop)
+	log.Infof("created connection to %s", s.c.Prop)
 
-	client := proppb.NewPropClient(con)
+	client := s.newPropClient(con)
 
-	_, err = os.Stat(pp)
+	_, err = s.storage.Stat(home)
 
 	// Create home dir if not exists
 	if os.IsNotExist(err) {
 
-		log.Infof("user physical home %s does not exist", pp)
+		log.Infof("user home %s does not exist", home)
 
-		err = os.MkdirAll(pp, dirPerm)
+		// The home of a user whose idp changed is moved from the old one.
+		migrated, err := s.migrateHome(ctx, getAccessToken(ctx), idt, client, log)
 		if err != nil {
 			log.Error(err)
 			return &pb.Void{}, err
 		}
 
-		log.Infof("user physical home created at %s", pp)
+		if !migrated {
+			err = s.storage.MkdirAll(home)
+			if err != nil {
+				log.Error(err)
+				return &pb.Void{}, err
+			}
+
+			log.Infof("user home created at %s", home)
+		}
+
+		s.logUsage(log, idt)
 
 		in := &proppb.GetReq{}
 		in.Path = home
-		in.AccessToken = req.AccessToken
+		in.AccessToken = getAccessToken(ctx)
 		in.ForceCreation = true
 
 		_, err = client.Get(ctx, in)
@@ -163,7 +183,7 @@ func (s *server) Home(ctx context.Context, req *pb.HomeReq) (*pb.Void, error) {
 			return &pb.Void{}, nil
 		}
 
-		log.Info("home saved to %s", s.p.prop)
+		log.Infof("home saved to %s", s.c.Prop)
 
 		return &pb.Void{}, nil
 	}
@@ -173,11 +193,13 @@ func (s *server) Home(ctx context.Context, req *pb.HomeReq) (*pb.Void, error) {
 		return &pb.Void{}, err
 	}
 
-	log.Infof("user physical home at %s already created")
+	log.Infof("user home at %s already created", home)
+
+	s.logUsage(log, idt)
 
 	in := &proppb.GetReq{}
 	in.Path = home
-	in.AccessToken = req.AccessToken
+	in.AccessToken = getAccessToken(ctx)
 	in.ForceCreation = true
 
 	_, err = client.Get(ctx, in)
@@ -190,35 +212,11 @@ func (s *server) Home(ctx context.Context, req *pb.HomeReq) (*pb.Void, error) {
 
 func (s *server) Mkdir(ctx context.Context, req *pb.MkdirReq) (*pb.Void, error) {
 
-	traceID, err := getTraceID(ctx)
-	if err != nil {
-		rus.Error(err)
-		return &pb.Void{}, err
-	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newTraceContext(ctx, traceID)
-
-	log.Info("request started")
-
-	// Time request
-	reqStart := time.Now()
-
-	defer func() {
-		// Compute request duration
-		reqDur := time.Since(reqStart)
-
-		// Log access info
-		log.WithFields(rus.Fields{
-			"method":   "mkdir",
-			"type":     "grpcaccess",
-			"duration": reqDur.Seconds(),
-		}).Info("request finished")
+	log := getLog(ctx)
 
-	}()
-
-	idt, err := authlib.ParseToken(req.AccessToken, s.p.sharedSecret)
-	if err != nil {
-		log.Error(err)
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
 		return &pb.Void{}, unauthenticatedError
 	}
 
@@ -228,26 +226,34 @@ func (s *server) Mkdir(ctx context.Context, req *pb.MkdirReq) (*pb.Void, error)
 
 	log.Infof("path is %s", p)
 
-	if !isUnderHome(p, idt) {
-		log.Error(permissionDenied)
-		return &pb.Void{}, permissionDenied
+	if p == s.getHome(idt) {
+		return &pb.Void{}, grpc.Errorf(codes.PermissionDenied, "cannot create directory")
 	}
 
-	if p == getHome(idt) {
-		return &pb.Void{}, grpc.Errorf(codes.PermissionDenied, "cannot create directory")
+	err := s.checkPermissions(path.Dir(p), idt, permCreate)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
 	}
 
-	pp := s.getPhysicalPath(p)
+	// The space is taken from the home the dir is created in.
+	owner := s.getOwner(p)
 
-	log.Infof("physical path is %s", pp)
+	err = s.checkQuota(owner, usage{inodes: 1})
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
 
-	err = os.Mkdir(pp, dirPerm)
+	err = s.storage.Mkdir(p)
 	if err != nil {
 		log.Error(err)
 		return &pb.Void{}, err
 	}
 
-	log.Infof("created dir %s", pp)
+	s.usages.add(s.getHome(owner), usage{inodes: 1})
+
+	log.Infof("created dir %s", p)
 
 	resource, err := s.grpcPool.Get("")
 	if err != nil {
@@ -263,13 +269,13 @@ func (s *server) Mkdir(ctx context.Context, req *pb.MkdirReq) (*pb.Void, error)
 		return &pb.Void{}, err
 	}
 	con := handle.(*grpc.ClientConn)
-	log.Infof("created connection to %s", s.p.prop)
+	log.Infof("created connection to %s", s.c.Prop)
 
-	client := proppb.NewPropClient(con)
+	client := s.newPropClient(con)
 
 	in := &proppb.PutReq{}
 	in.Path = p
-	in.AccessToken = req.AccessToken
+	in.AccessToken = getAccessToken(ctx)
 
 	_, err = client.Put(ctx, in)
 	if err != nil {
@@ -284,35 +290,11 @@ func (s *server) Mkdir(ctx context.Context, req *pb.MkdirReq) (*pb.Void, error)
 
 func (s *server) Stat(ctx context.Context, req *pb.StatReq) (*pb.Metadata, error) {
 
-	traceID, err := getTraceID(ctx)
-	if err != nil {
-		rus.Error(err)
-		return &pb.Metadata{}, err
-	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newTraceContext(ctx, traceID)
-
-	log.Info("request started")
+	log := getLog(ctx)
 
-	// Time request
-	reqStart := time.Now()
-
-	defer func() {
-		// Compute request duration
-		reqDur := time.Since(reqStart)
-
-		// Log access info
-		log.WithFields(rus.Fields{
-			"method":   "stat",
-			"type":     "grpcaccess",
-			"duration": reqDur.Seconds(),
-		}).Info("request finished")
-
-	}()
-
-	idt, err := authlib.ParseToken(req.AccessToken, s.p.sharedSecret)
-	if err != nil {
-		log.Error(err)
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
 		return &pb.Metadata{}, unauthenticatedError
 	}
 
@@ -322,44 +304,21 @@ func (s *server) Stat(ctx context.Context, req *pb.StatReq) (*pb.Metadata, error
 
 	log.Infof("path is %s", p)
 
-	// The hierarchy is /local/users/d/demo
-	// All paths in the hierarchy above the user home directory must be
-	// accessible for all logged in users
-	if isCommonDomain(p) {
-
-	} else { // it must be under /local/users/{letter}
-		if isUnderOtherHome(p, idt) {
-			if req.Children == true {
-				// TODO(labkode) Sharing
-				return &pb.Metadata{}, permissionDenied
-			}
-		} else {
-			// asset is under logged in user home directory
-			if !isUnderHome(p, idt) {
-				log.WithField("criticial", "").Errorf("path %s has not been handled correclty or fake path", p)
-				return &pb.Metadata{}, permissionDenied
-			}
-		}
+	err := s.checkStatAccess(p, idt, req.Children, log)
+	if err != nil {
+		log.Error(err)
+		return &pb.Metadata{}, err
 	}
 
-	/*
-		if !isUnderHome(p, idt) { // constrained to /local/users/d/demo/...
-			log.Error(permissionDenied)
-			return &pb.Metadata{}, permissionDenied
-		}
-	*/
-
-	pp := s.getPhysicalPath(p)
-
-	log.Infof("physical path is %s", pp)
-
-	parentMeta, err := s.getMeta(pp)
+	parentMeta, err := s.getMeta(p)
 	if err != nil {
 		log.Error(err)
 		return &pb.Metadata{}, err
 	}
 
-	log.Infof("stated parent %s", pp)
+	parentMeta.Permissions = s.getPermissions(p, idt)
+
+	log.Infof("stated parent %s", p)
 
 	resource, err := s.grpcPool.Get("")
 	if err != nil {
@@ -375,13 +334,13 @@ func (s *server) Stat(ctx context.Context, req *pb.StatReq) (*pb.Metadata, error
 		return &pb.Metadata{}, err
 	}
 	con := handle.(*grpc.ClientConn)
-	log.Infof("created connection to %s", s.p.prop)
+	log.Infof("created connection to %s", s.c.Prop)
 
-	client := proppb.NewPropClient(con)
+	client := s.newPropClient(con)
 
 	in := &proppb.GetReq{}
 	in.Path = p
-	in.AccessToken = req.AccessToken
+	in.AccessToken = getAccessToken(ctx)
 	in.ForceCreation = true
 
 	rec, err := client.Get(ctx, in)
@@ -395,54 +354,52 @@ func (s *server) Stat(ctx context.Context, req *pb.StatReq) (*pb.Metadata, error
 	parentMeta.Modified = rec.Modified
 	parentMeta.Checksum = rec.Checksum
 
-	if !parentMeta.IsContainer || req.Children == false {
-		return parentMeta, nil
-	}
+	checksumType := s.getChecksumType(req.ChecksumType)
+
+	// The checksum tells about the content, so it needs read access.
+	// Only owners make the file be read to compute it, other
+	// users just get the cached one.
+	if !parentMeta.IsContainer && parentMeta.Permissions&permRead == 0 {
+		parentMeta.Checksum = ""
+	} else if !parentMeta.IsContainer {
+		var checksum string
+		if s.isUnderHome(p, idt) {
+			checksum, err = s.getChecksum(p, checksumType)
+		} else {
+			checksum, err = s.getCachedChecksum(p, checksumType)
+		}
+		if err != nil {
+			log.Error(err)
+			return &pb.Metadata{}, err
+		}
+		if checksum != "" {
+			parentMeta.Checksum = checksum
+		}
 
-	dir, err := os.Open(pp)
-	if err != nil {
-		log.Error(err)
-		return &pb.Metadata{}, err
+		log.Infof("checksum of %s is %s", p, parentMeta.Checksum)
 	}
 
-	log.Infof("opened dir %s", pp)
+	if !parentMeta.IsContainer || req.Children == false {
+		return parentMeta, nil
+	}
 
-	defer dir.Close()
+	opts := listOptions{}
+	opts.prefix = req.Prefix
+	opts.sort = req.Sort
+	opts.cursor = req.Cursor
+	opts.limit = int(req.Limit)
+	opts.permissions = s.getChildrenPermissions(p, idt)
 
-	names, err := dir.Readdirnames(0)
+	next, err := s.listChildren(ctx, client, parentMeta.Path, opts, checksumType, getAccessToken(ctx), log, func(m *pb.Metadata) error {
+		parentMeta.Children = append(parentMeta.Children, m)
+		log.Infof("added %s to parent", m.Path)
+		return nil
+	})
 	if err != nil {
 		log.Error(err)
 		return &pb.Metadata{}, err
 	}
-
-	log.Infof("dir %s has %d entries", pp, len(names))
-
-	for _, n := range names {
-		cp := path.Join(parentMeta.Path, path.Clean(n))
-		cpp := s.getPhysicalPath(cp)
-		m, err := s.getMeta(cpp)
-		if err != nil {
-			log.Error(err)
-		} else {
-			in := &proppb.GetReq{}
-			in.Path = cp
-			in.AccessToken = req.AccessToken
-			in.ForceCreation = true
-
-			rec, err := client.Get(ctx, in)
-			if err != nil {
-				log.Errorf("path %s has not been added because %s", p, err.Error())
-			} else {
-				m.Id = rec.Id
-				m.Etag = rec.Etag
-				m.Modified = rec.Modified
-				m.Checksum = rec.Checksum
-				parentMeta.Children = append(parentMeta.Children, m)
-
-				log.Infof("added %s to parent", m.Path)
-			}
-		}
-	}
+	parentMeta.NextCursor = next
 
 	log.Infof("added %d entries to parent", len(parentMeta.Children))
 
@@ -451,102 +408,121 @@ func (s *server) Stat(ctx context.Context, req *pb.StatReq) (*pb.Metadata, error
 
 func (s *server) Cp(ctx context.Context, req *pb.CpReq) (*pb.Void, error) {
 
-	traceID, err := getTraceID(ctx)
-	if err != nil {
-		rus.Error(err)
-		return &pb.Void{}, err
-	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newTraceContext(ctx, traceID)
-
-	log.Info("request started")
-
-	// Time request
-	reqStart := time.Now()
-
-	defer func() {
-		// Compute request duration
-		reqDur := time.Since(reqStart)
-
-		// Log access info
-		log.WithFields(rus.Fields{
-			"method":   "cp",
-			"type":     "grpcaccess",
-			"duration": reqDur.Seconds(),
-		}).Info("request finished")
+	log := getLog(ctx)
 
-	}()
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.Void{}, unauthenticatedError
+	}
 
-	idt, err := authlib.ParseToken(req.AccessToken, s.p.sharedSecret)
+	log.Infof("%s", idt)
 
+	err := s.copy(ctx, req, idt, log, nil)
 	if err != nil {
-		log.Error(err)
-		return &pb.Void{}, unauthenticatedError
+		return &pb.Void{}, err
 	}
 
-	log.Infof("%s", idt)
+	return &pb.Void{}, nil
+}
+
+// copy copies req.Src to req.Dst and saves the copy in prop.
+// If progress is set it is called with the data copied so far and the
+// total to copy, first before the copy starts and then while it runs.
+func (s *server) copy(ctx context.Context, req *pb.CpReq, idt *authlib.Identity, log *rus.Entry, progress func(copied copyStats, total usage)) error {
 
 	src := path.Clean(req.Src)
 	dst := path.Clean(req.Dst)
 
 	log.Infof("src is %s", src)
-	log.Info("dst is %s", dst)
-
-	if !isUnderHome(src, idt) {
-		log.Error(permissionDenied)
-		return &pb.Void{}, permissionDenied
-	}
+	log.Infof("dst is %s", dst)
 
-	if !isUnderHome(dst, idt) {
-		log.Error(permissionDenied)
-		return &pb.Void{}, permissionDenied
+	if src == s.getHome(idt) || dst == s.getHome(idt) {
+		return grpc.Errorf(codes.PermissionDenied, "cannot copy from/to home directory")
 	}
 
-	if src == getHome(idt) || dst == getHome(idt) {
-		return &pb.Void{}, grpc.Errorf(codes.PermissionDenied, "cannot copy from/to home directory")
+	err := s.checkDstPermissions(src, dst, idt, permRead)
+	if err != nil {
+		log.Error(err)
+		return err
 	}
 
-	psrc := s.getPhysicalPath(src)
-	pdst := s.getPhysicalPath(dst)
-
-	log.Infof("physical src is %s", psrc)
-	log.Infof("physical dst is %s", pdst)
+	// The copy is saved in the home of the destination.
+	owner := s.getOwner(dst)
 
 	statReq := &pb.StatReq{}
-	statReq.AccessToken = req.AccessToken
 	statReq.Path = req.Src
+	statReq.ChecksumType = req.ChecksumType
 
 	meta, err := s.Stat(ctx, statReq)
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, err
+		return err
 	}
 
 	log.Infof("stated %s", src)
 
-	if meta.IsContainer {
-		err = copyDir(psrc, pdst)
+	srcUsage, err := s.computeUsage(src)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	err = s.checkQuota(owner, srcUsage)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	_, dstErr := s.storage.Stat(dst)
+
+	var version *pendingVersion
+	if !meta.IsContainer && src != dst {
+		version, err = s.versionBeforeOverwrite(dst, owner)
 		if err != nil {
 			log.Error(err)
-			return &pb.Void{}, err
+			return err
 		}
+	}
 
-		log.Infof("copied from dir %s to dir %s", psrc, pdst)
-	} else {
-		// It is a file
-		err = copyFile(psrc, pdst, int64(meta.Size))
-		if err != nil {
+	opts := copyOptions{}
+	opts.preserve = req.Preserve
+	if progress != nil {
+		progress(copyStats{}, srcUsage)
+		opts.progress = func(copied copyStats) {
+			progress(copied, srcUsage)
+		}
+	}
+
+	err = s.storage.Copy(ctx, src, dst, opts)
+	if err != nil {
+		if err := version.undo(); err != nil {
 			log.Error(err)
-			return &pb.Void{}, err
 		}
+		log.Error(err)
+		return err
+	}
+
+	if err := version.commit(); err != nil {
+		log.Error(err)
+	}
+
+	if os.IsNotExist(dstErr) {
+		s.usages.add(s.getHome(owner), srcUsage)
+	} else {
+		s.usages.invalidate(s.getHome(owner))
+	}
 
-		log.Infof("copied from file %s to file %s", psrc, pdst)
+	if meta.IsContainer {
+		log.Infof("copied from dir %s to dir %s", src, dst)
+	} else {
+		log.Infof("copied from file %s to file %s", src, dst)
 	}
 
 	resource, err := s.grpcPool.Get("")
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, err
+		return err
 	}
 
 	defer resource.Release()
@@ -554,59 +530,101 @@ func (s *server) Cp(ctx context.Context, req *pb.CpReq) (*pb.Void, error) {
 	handle, err := resource.Handle()
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, err
+		return err
 	}
 	con := handle.(*grpc.ClientConn)
-	log.Infof("created connection to %s", s.p.prop)
+	log.Infof("created connection to %s", s.c.Prop)
 
-	client := proppb.NewPropClient(con)
+	client := s.newPropClient(con)
 
 	in := &proppb.PutReq{}
 	in.Path = dst
-	in.AccessToken = req.AccessToken
+	in.AccessToken = getAccessToken(ctx)
+
+	if !meta.IsContainer {
+		checksum, err := s.getChecksum(dst, s.getChecksumType(req.ChecksumType))
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		in.Checksum = checksum
+
+		log.Infof("checksum of %s is %s", dst, checksum)
+	}
 
 	_, err = client.Put(ctx, in)
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, err
+		return err
 	}
 
-	log.Infof("copied resource %s saved in prop")
+	log.Infof("copied resource %s saved in prop", dst)
 
-	return &pb.Void{}, nil
+	return nil
 }
 
-func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
+// cpProgressInterval is the minimum time between two progress messages.
+const cpProgressInterval = 500 * time.Millisecond
 
-	traceID, err := getTraceID(ctx)
-	if err != nil {
-		rus.Error(err)
-		return &pb.Void{}, err
-	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newTraceContext(ctx, traceID)
+func (s *server) CpWithProgress(req *pb.CpReq, stream pb.Meta_CpWithProgressServer) error {
 
-	log.Info("request started")
+	ctx := stream.Context()
 
-	// Time request
-	reqStart := time.Now()
+	log := getLog(ctx)
 
-	defer func() {
-		// Compute request duration
-		reqDur := time.Since(reqStart)
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return unauthenticatedError
+	}
 
-		// Log access info
-		log.WithFields(rus.Fields{
-			"method":   "mv",
-			"type":     "grpcaccess",
-			"duration": reqDur.Seconds(),
-		}).Info("request finished")
+	log.Infof("%s", idt)
 
-	}()
+	last := &pb.CpProgress{}
+	var sent time.Time
+	progress := func(copied copyStats, total usage) {
+		last = &pb.CpProgress{}
+		last.CopiedBytes = copied.bytes
+		last.CopiedFiles = copied.files
+		last.TotalBytes = total.bytes
+		last.TotalFiles = total.inodes
+
+		if time.Since(sent) < cpProgressInterval {
+			return
+		}
+		sent = time.Now()
 
-	idt, err := authlib.ParseToken(req.AccessToken, s.p.sharedSecret)
+		// A client that is gone cancels the context,
+		// which aborts the copy.
+		if err := stream.Send(last); err != nil {
+			log.Error(err)
+		}
+	}
+
+	err := s.copy(ctx, req, idt, log, progress)
+	if err != nil {
+		return err
+	}
+
+	last.Done = true
+	err = stream.Send(last)
 	if err != nil {
 		log.Error(err)
+		return err
+	}
+
+	log.Infof("copied %d bytes and %d files", last.CopiedBytes, last.CopiedFiles)
+
+	return nil
+}
+
+func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
 		return &pb.Void{}, unauthenticatedError
 	}
 
@@ -616,35 +634,79 @@ func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
 	dst := path.Clean(req.Dst)
 
 	log.Infof("src is %s", src)
-	log.Info("dst is %s", dst)
+	log.Infof("dst is %s", dst)
 
-	if !isUnderHome(src, idt) {
-		log.Error(permissionDenied)
-		return &pb.Void{}, permissionDenied
+	if src == s.getHome(idt) || dst == s.getHome(idt) {
+		return &pb.Void{}, grpc.Errorf(codes.PermissionDenied, "cannot rename from/to home directory")
 	}
 
-	if !isUnderHome(dst, idt) {
-		log.Error(permissionDenied)
-		return &pb.Void{}, permissionDenied
+	err := s.checkDstPermissions(src, dst, idt, permDelete)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
 	}
 
-	if src == getHome(idt) || dst == getHome(idt) {
-		return &pb.Void{}, grpc.Errorf(codes.PermissionDenied, "cannot rename from/to home directory")
+	// The source is checked before anything is done to the destination.
+	_, err = s.storage.Stat(src)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
 	}
 
-	psrc := s.getPhysicalPath(src)
-	pdst := s.getPhysicalPath(dst)
+	srcOwner := s.getOwner(src)
+	dstOwner := s.getOwner(dst)
 
-	log.Infof("physical src is %s", psrc)
-	log.Infof("physical dst is %s", pdst)
+	// Moving to another home takes space from it.
+	if s.getHome(srcOwner) != s.getHome(dstOwner) {
+		srcUsage, err := s.computeUsage(src)
+		if err != nil {
+			log.Error(err)
+			return &pb.Void{}, err
+		}
+
+		err = s.checkQuota(dstOwner, srcUsage)
+		if err != nil {
+			log.Error(err)
+			return &pb.Void{}, err
+		}
+	}
 
-	err = os.Rename(psrc, pdst)
+	_, dstErr := s.storage.Stat(dst)
+
+	var version *pendingVersion
+	if src != dst {
+		version, err = s.versionBeforeOverwrite(dst, dstOwner)
+		if err != nil {
+			log.Error(err)
+			return &pb.Void{}, err
+		}
+	}
+
+	err = s.storage.Move(src, dst)
 	if err != nil {
+		if err := version.undo(); err != nil {
+			log.Error(err)
+		}
 		log.Error(err)
 		return &pb.Void{}, err
 	}
 
-	log.Infof("renamed from %s to %s", psrc, pdst)
+	if err := version.commit(); err != nil {
+		log.Error(err)
+	}
+
+	// An overwritten file is moved to the versions area
+	if !os.IsNotExist(dstErr) || s.getHome(srcOwner) != s.getHome(dstOwner) {
+		s.usages.invalidate(s.getHome(srcOwner))
+		s.usages.invalidate(s.getHome(dstOwner))
+	}
+
+	s.moveSharesUnder(src, dst, log)
+	if src != dst {
+		s.moveVersionsUnder(src, srcOwner, dst, dstOwner, log)
+	}
+
+	log.Infof("renamed from %s to %s", src, dst)
 
 	resource, err := s.grpcPool.Get("")
 	if err != nil {
@@ -660,14 +722,14 @@ func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
 		return &pb.Void{}, err
 	}
 	con := handle.(*grpc.ClientConn)
-	log.Infof("created connection to %s", s.p.prop)
+	log.Infof("created connection to %s", s.c.Prop)
 
-	client := proppb.NewPropClient(con)
+	client := s.newPropClient(con)
 
 	in := &proppb.MvReq{}
 	in.Src = src
 	in.Dst = dst
-	in.AccessToken = req.AccessToken
+	in.AccessToken = getAccessToken(ctx)
 
 	_, err = client.Mv(ctx, in)
 	if err != nil {
@@ -682,35 +744,11 @@ func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
 
 func (s *server) Rm(ctx context.Context, req *pb.RmReq) (*pb.Void, error) {
 
-	traceID, err := getTraceID(ctx)
-	if err != nil {
-		rus.Error(err)
-		return &pb.Void{}, err
-	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newTraceContext(ctx, traceID)
-
-	log.Info("request started")
-
-	// Time request
-	reqStart := time.Now()
+	log := getLog(ctx)
 
-	defer func() {
-		// Compute request duration
-		reqDur := time.Since(reqStart)
-
-		// Log access info
-		log.WithFields(rus.Fields{
-			"method":   "rm",
-			"type":     "grpcaccess",
-			"duration": reqDur.Seconds(),
-		}).Info("request finished")
-
-	}()
-
-	idt, err := authlib.ParseToken(req.AccessToken, s.p.sharedSecret)
-	if err != nil {
-		log.Error(err)
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
 		return &pb.Void{}, unauthenticatedError
 	}
 
@@ -720,26 +758,18 @@ func (s *server) Rm(ctx context.Context, req *pb.RmReq) (*pb.Void, error) {
 
 	log.Infof("path is %s", p)
 
-	if !isUnderHome(p, idt) {
-		log.Error(permissionDenied)
-		return &pb.Void{}, permissionDenied
-	}
-
-	if p == getHome(idt) {
+	if p == s.getHome(idt) {
 		return &pb.Void{}, grpc.Errorf(codes.PermissionDenied, "cannot remove home directory")
 	}
 
-	pp := s.getPhysicalPath(p)
-
-	log.Infof("physical path is %s", pp)
-
-	err = os.RemoveAll(pp)
+	err := s.checkPermissions(p, idt, permDelete)
 	if err != nil {
 		log.Error(err)
 		return &pb.Void{}, err
 	}
 
-	log.Infof("removed %s", pp)
+	// The removed resource goes to the trash of its owner.
+	owner := s.getOwner(p)
 
 	resource, err := s.grpcPool.Get("")
 	if err != nil {
@@ -755,12 +785,69 @@ func (s *server) Rm(ctx context.Context, req *pb.RmReq) (*pb.Void, error) {
 		return &pb.Void{}, err
 	}
 	con := handle.(*grpc.ClientConn)
-	log.Infof("created connection to %s", s.p.prop)
-	client := proppb.NewPropClient(con)
+	log.Infof("created connection to %s", s.c.Prop)
+	client := s.newPropClient(con)
+
+	// The propagator id is kept in the trash entry
+	// to know where a restored resource comes from.
+	getReq := &proppb.GetReq{}
+	getReq.Path = p
+	getReq.AccessToken = getAccessToken(ctx)
+
+	var id string
+	rec, err := client.Get(ctx, getReq)
+	if err != nil {
+		log.Errorf("path %s has no prop record because %s", p, err.Error())
+	} else {
+		id = rec.Id
+	}
+
+	// A trash entry keeps its information in attributes, so where
+	// the storage does not support them the resource is just removed.
+	key, err := s.moveToTrash(p, id, owner)
+	if err == errAttrNotSupported {
+		log.Warnf("%s is removed without going to the trash because attributes are not supported", p)
+		err = s.remove(p, owner, log)
+	}
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	// The versions go to the trash with the resource
+	// so they are back if the resource is restored.
+	if key != "" {
+		log.Infof("moved %s to trash entry %s", p, key)
+		s.moveVersionsUnder(p, owner, s.getTrashResource(key, p, owner), owner, log)
+	} else {
+		log.Infof("removed %s", p)
+	}
+
+	s.usages.invalidate(s.getHome(owner))
+
+	// The grants go away with the resource so they do not apply
+	// to a new resource created with the same path.
+	s.removeSharesUnder(p, log)
+
+	// The prop record goes to the trash with the resource
+	// so it keeps its id if the resource is restored.
+	if key != "" {
+		mvReq := &proppb.MvReq{}
+		mvReq.Src = p
+		mvReq.Dst = s.getTrashResource(key, p, owner)
+		mvReq.AccessToken = getAccessToken(ctx)
+
+		_, err = client.Mv(ctx, mvReq)
+		if err == nil {
+			log.Infof("paths with prefix %s moved to trash in prop", p)
+			return &pb.Void{}, nil
+		}
+		log.Errorf("paths with prefix %s have not been moved to trash in prop because %s", p, err.Error())
+	}
 
 	in := &proppb.RmReq{}
 	in.Path = p
-	in.AccessToken = req.AccessToken
+	in.AccessToken = getAccessToken(ctx)
 
 	_, err = client.Rm(ctx, in)
 	if err != nil {
@@ -773,38 +860,62 @@ func (s *server) Rm(ctx context.Context, req *pb.RmReq) (*pb.Void, error) {
 	return &pb.Void{}, nil
 }
 
-// getMeta return the metadata of path pp.
-func (s *server) getMeta(pp string) (*pb.Metadata, error) {
-
-	finfo, err := os.Stat(pp)
+// remove removes the resource p for good with the versions of its files.
+func (s *server) remove(p string, owner *authlib.Identity, log *rus.Entry) error {
+	files, err := s.getVersionedFiles(p, owner)
 	if err != nil {
-		return &pb.Metadata{}, err
+		return err
 	}
+	if err := s.storage.Remove(p); err != nil {
+		return err
+	}
+	s.removeVersions(p, owner, files, log)
+	return nil
+}
 
-	logicalPath := s.getLogicalPath(pp)
-
-	m := &pb.Metadata{}
-	m.Path = logicalPath
-	m.Size = uint32(finfo.Size())
-	m.IsContainer = finfo.IsDir()
-	m.Permissions = 0
-	m.MimeType = mime.TypeByExtension(path.Ext(m.Path))
+// checkStatAccess checks if the user can stat the path p
+// and list its children when children is true.
+func (s *server) checkStatAccess(p string, idt *authlib.Identity, children bool, log *rus.Entry) error {
+	if isHiddenPath(p) {
+		return permissionDenied
+	}
 
-	if m.MimeType == "" {
-		m.MimeType = "application/octet-stream"
+	// All paths in the hierarchy above the user home directories,
+	// as given by the home layout, must be accessible for all logged in users
+	if s.isCommonDomain(p) {
+		return nil
 	}
 
-	if m.IsContainer {
-		m.MimeType = "inode/container"
+	// it must be under the home of another user
+	if s.isUnderOtherHome(p, idt) {
+		if children {
+			return s.checkPermissions(p, idt, permRead)
+		}
+		return nil
 	}
 
-	return m, nil
+	// asset is under logged in user home directory
+	if !s.isUnderHome(p, idt) {
+		log.WithField("criticial", "").Errorf("path %s has not been handled correclty or fake path", p)
+		return permissionDenied
+	}
+	return nil
 }
 
-func (s *server) getPhysicalPath(p string) string {
-	return path.Join(s.p.dataDir, path.Clean(p))
-}
+// getMeta return the metadata of path p.
+func (s *server) getMeta(p string) (*pb.Metadata, error) {
 
-func (s *server) getLogicalPath(pp string) string {
-	return path.Clean(strings.TrimPrefix(pp, s.p.dataDir))
+	finfo, err := s.storage.Stat(p)
+	if err != nil {
+		return &pb.Metadata{}, err
+	}
+
+	m := &pb.Metadata{}
+	m.Path = path.Clean(p)
+	m.Size = uint32(finfo.Size())
+	m.IsContainer = finfo.IsDir()
+	m.Permissions = 0
+	m.MimeType = getMimeType(m.Path, m.IsContainer)
+
+	return m, nil
 }
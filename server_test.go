@@ -0,0 +1,451 @@
+package main
+
+import (
+	"flag"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	proppb "github.com/clawio/service-localfs-meta/proto/propagator"
+	"github.com/dgrijalva/jwt-go"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const testSecret = "secret"
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		rus.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// testHarness runs the meta server against an in-memory propagator.
+// Both services listen on local ports and the meta server stores its
+// data in a temporary directory.
+type testHarness struct {
+	t         *testing.T
+	dataDir   string
+	prop      *fakeProp
+	propSrv   *grpc.Server
+	metaSrv   *grpc.Server
+	srv       *server
+	con       *grpc.ClientConn
+	client    pb.MetaClient
+	ctx       context.Context
+	token     string
+	home      string
+	otherHome string
+}
+
+func newTestHarness(t *testing.T) *testHarness {
+	h := &testHarness{t: t}
+	h.ctx = context.Background()
+
+	dataDir, err := ioutil.TempDir("", "localfs-meta-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.dataDir = dataDir
+
+	tmpDir, err := ioutil.TempDir(dataDir, "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.prop = newFakeProp()
+	propLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.propSrv = grpc.NewServer()
+	proppb.RegisterPropServer(h.propSrv, h.prop)
+	go h.propSrv.Serve(propLis)
+
+	c := &config{}
+	c.DataDir = dataDir
+	c.TmpDir = tmpDir
+	c.Prop = propLis.Addr().String()
+	c.PropMaxActive = 16
+	c.PropMaxIdle = 16
+	c.PropMaxConcurrency = 16
+	c.PropBatchSize = 100
+	c.PropBatchConcurrency = 4
+	c.SharedSecret = testSecret
+	c.MaxVersions = 3
+	c.Checksum = "md5"
+	c.groups = map[string][]string{"friends": {"other"}}
+	h.srv, err = newServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metaLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.metaSrv = grpc.NewServer()
+	registerMetaServer(h.metaSrv, h.srv, h.srv.interceptor())
+	go h.metaSrv.Serve(metaLis)
+
+	con, err := grpc.Dial(metaLis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.con = con
+	h.client = pb.NewMetaClient(con)
+
+	h.token = newTestToken(t, "demo")
+	h.home = "/local/users/d/demo"
+	h.otherHome = "/local/users/o/other"
+
+	if _, err := h.client.Home(h.ctx, &pb.HomeReq{AccessToken: h.token}); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func (h *testHarness) close() {
+	h.con.Close()
+	h.metaSrv.Stop()
+	h.propSrv.Stop()
+	h.srv.grpcPool.EnterLameDuckMode()
+	os.RemoveAll(h.dataDir)
+}
+
+// invalidateUsages drops the cached usages after resources are
+// created behind the server.
+func (h *testHarness) invalidateUsages() {
+	h.srv.usages.invalidate(h.home)
+	h.srv.usages.invalidate(h.otherHome)
+}
+
+// writeFile creates a file with the given content at the logical path p.
+func (h *testHarness) writeFile(p, content string) {
+	defer h.invalidateUsages()
+	pp := path.Join(h.dataDir, p)
+	if err := os.MkdirAll(path.Dir(pp), dirPerm); err != nil {
+		h.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pp, []byte(content), 0644); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// mkdir creates the container at the logical path p.
+func (h *testHarness) mkdir(p string) {
+	defer h.invalidateUsages()
+	if err := os.MkdirAll(path.Join(h.dataDir, p), dirPerm); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// exists checks if the logical path p exists in the data directory.
+func (h *testHarness) exists(p string) bool {
+	_, err := os.Stat(path.Join(h.dataDir, p))
+	return err == nil
+}
+
+func newTestToken(t *testing.T, pid string) string {
+	return newTestIdpToken(t, "local", pid)
+}
+
+func newTestIdpToken(t *testing.T, idp, pid string) string {
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims["pid"] = pid
+	token.Claims["idp"] = idp
+	token.Claims["display_name"] = pid
+	token.Claims["email"] = pid + "@example.org"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	tokenString, err := token.SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenString
+}
+
+func TestHome(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	if !h.exists(h.home) {
+		t.Fatalf("home %s has not been created", h.home)
+	}
+	rec, ok := h.prop.record(h.home)
+	if !ok {
+		t.Fatalf("home %s has not been saved in prop", h.home)
+	}
+
+	// calling home again must keep the same record
+	if _, err := h.client.Home(h.ctx, &pb.HomeReq{AccessToken: h.token}); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := h.prop.record(h.home)
+	if again.Id != rec.Id {
+		t.Errorf("home id changed from %s to %s", rec.Id, again.Id)
+	}
+
+	_, err := h.client.Home(h.ctx, &pb.HomeReq{AccessToken: "bad"})
+	if grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestMkdir(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	tests := []struct {
+		name  string
+		token string
+		path  string
+		code  codes.Code
+	}{
+		{"under home", h.token, h.home + "/photos", codes.OK},
+		{"nested", h.token, h.home + "/photos/2015", codes.OK},
+		{"missing parent", h.token, h.home + "/a/b", codes.NotFound},
+		{"already exists", h.token, h.home + "/photos", codes.AlreadyExists},
+		{"home", h.token, h.home, codes.PermissionDenied},
+		{"other home", h.token, h.otherHome + "/photos", codes.PermissionDenied},
+		{"common domain", h.token, "/local/users/d", codes.PermissionDenied},
+		{"bad token", "bad", h.home + "/docs", codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		_, err := h.client.Mkdir(h.ctx, &pb.MkdirReq{AccessToken: tt.token, Path: tt.path})
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code != codes.OK {
+			continue
+		}
+		if !h.exists(tt.path) {
+			t.Errorf("%s: %s has not been created", tt.name, tt.path)
+		}
+		if _, ok := h.prop.record(tt.path); !ok {
+			t.Errorf("%s: %s has not been saved in prop", tt.name, tt.path)
+		}
+	}
+}
+
+func TestStat(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/notes.txt", "hello")
+	h.mkdir(h.home + "/photos")
+	h.writeFile(h.otherHome+"/secret.txt", "secret")
+
+	tests := []struct {
+		name        string
+		token       string
+		path        string
+		children    bool
+		code        codes.Code
+		isContainer bool
+		size        uint32
+		mimeType    string
+		numChildren int
+	}{
+		{"file", h.token, h.home + "/notes.txt", false, codes.OK, false, 5, "text/plain; charset=utf-8", 0},
+		{"home", h.token, h.home, false, codes.OK, true, 0, "inode/container", 0},
+		{"home with children", h.token, h.home, true, codes.OK, true, 0, "inode/container", 2},
+		{"common domain", h.token, "/local/users", true, codes.OK, true, 0, "inode/container", 2},
+		{"other home", h.token, h.otherHome, false, codes.OK, true, 0, "inode/container", 0},
+		{"other home with children", h.token, h.otherHome, true, codes.PermissionDenied, false, 0, "", 0},
+		{"not found", h.token, h.home + "/missing", false, codes.NotFound, false, 0, "", 0},
+		{"bad token", "bad", h.home, false, codes.Unauthenticated, false, 0, "", 0},
+	}
+
+	for _, tt := range tests {
+		req := &pb.StatReq{AccessToken: tt.token, Path: tt.path, Children: tt.children}
+		m, err := h.client.Stat(h.ctx, req)
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code != codes.OK {
+			continue
+		}
+		if m.Path != tt.path {
+			t.Errorf("%s: got path %s, want %s", tt.name, m.Path, tt.path)
+		}
+		if m.IsContainer != tt.isContainer {
+			t.Errorf("%s: got is_container %t, want %t", tt.name, m.IsContainer, tt.isContainer)
+		}
+		if !tt.isContainer && m.Size != tt.size {
+			t.Errorf("%s: got size %d, want %d", tt.name, m.Size, tt.size)
+		}
+		if m.MimeType != tt.mimeType {
+			t.Errorf("%s: got mime type %s, want %s", tt.name, m.MimeType, tt.mimeType)
+		}
+		if len(m.Children) != tt.numChildren {
+			t.Errorf("%s: got %d children, want %d", tt.name, len(m.Children), tt.numChildren)
+		}
+		rec, _ := h.prop.record(tt.path)
+		if m.Id == "" || m.Id != rec.Id {
+			t.Errorf("%s: got id %s, want %s", tt.name, m.Id, rec.Id)
+		}
+		if m.Etag == "" {
+			t.Errorf("%s: etag is empty", tt.name)
+		}
+	}
+}
+
+func TestCp(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/notes.txt", "hello")
+	h.writeFile(h.home+"/photos/a.jpg", "a")
+	h.writeFile(h.home+"/photos/2015/b.jpg", "b")
+	h.writeFile(h.otherHome+"/secret.txt", "secret")
+
+	tests := []struct {
+		name  string
+		token string
+		src   string
+		dst   string
+		code  codes.Code
+		files []string
+	}{
+		{"file", h.token, h.home + "/notes.txt", h.home + "/notes-copy.txt", codes.OK, []string{h.home + "/notes-copy.txt"}},
+		{"dir", h.token, h.home + "/photos", h.home + "/backup", codes.OK, []string{h.home + "/backup/a.jpg", h.home + "/backup/2015/b.jpg"}},
+		{"missing src", h.token, h.home + "/missing", h.home + "/other", codes.NotFound, nil},
+		{"from home", h.token, h.home, h.home + "/home", codes.PermissionDenied, nil},
+		{"from other home", h.token, h.otherHome + "/secret.txt", h.home + "/secret.txt", codes.PermissionDenied, nil},
+		{"to other home", h.token, h.home + "/notes.txt", h.otherHome + "/notes.txt", codes.PermissionDenied, nil},
+		{"bad token", "bad", h.home + "/notes.txt", h.home + "/bad.txt", codes.Unauthenticated, nil},
+	}
+
+	for _, tt := range tests {
+		_, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: tt.token, Src: tt.src, Dst: tt.dst})
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code != codes.OK {
+			if h.exists(tt.dst) {
+				t.Errorf("%s: %s must not exist", tt.name, tt.dst)
+			}
+			continue
+		}
+		if !h.exists(tt.src) {
+			t.Errorf("%s: source %s has been removed", tt.name, tt.src)
+		}
+		for _, f := range tt.files {
+			if !h.exists(f) {
+				t.Errorf("%s: %s has not been copied", tt.name, f)
+			}
+		}
+		if _, ok := h.prop.record(tt.dst); !ok {
+			t.Errorf("%s: %s has not been saved in prop", tt.name, tt.dst)
+		}
+	}
+}
+
+func TestMv(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/notes.txt", "hello")
+	h.writeFile(h.home+"/photos/a.jpg", "a")
+	h.writeFile(h.otherHome+"/secret.txt", "secret")
+
+	tests := []struct {
+		name  string
+		token string
+		src   string
+		dst   string
+		code  codes.Code
+	}{
+		{"file", h.token, h.home + "/notes.txt", h.home + "/renamed.txt", codes.OK},
+		{"dir", h.token, h.home + "/photos", h.home + "/pictures", codes.OK},
+		{"missing src", h.token, h.home + "/missing", h.home + "/other", codes.NotFound},
+		{"home", h.token, h.home, h.home + "/home", codes.PermissionDenied},
+		{"from other home", h.token, h.otherHome + "/secret.txt", h.home + "/secret.txt", codes.PermissionDenied},
+		{"to other home", h.token, h.home + "/renamed.txt", h.otherHome + "/notes.txt", codes.PermissionDenied},
+		{"bad token", "bad", h.home + "/renamed.txt", h.home + "/bad.txt", codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		var before proppb.Record
+		if tt.code == codes.OK {
+			// make sure the source is known by prop
+			if _, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: tt.src}); err != nil {
+				t.Fatal(err)
+			}
+			before, _ = h.prop.record(tt.src)
+		}
+
+		_, err := h.client.Mv(h.ctx, &pb.MvReq{AccessToken: tt.token, Src: tt.src, Dst: tt.dst})
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code != codes.OK {
+			continue
+		}
+		if h.exists(tt.src) || !h.exists(tt.dst) {
+			t.Errorf("%s: %s has not been renamed to %s", tt.name, tt.src, tt.dst)
+		}
+		if _, ok := h.prop.record(tt.src); ok {
+			t.Errorf("%s: %s is still in prop", tt.name, tt.src)
+		}
+		after, ok := h.prop.record(tt.dst)
+		if !ok || after.Id != before.Id {
+			t.Errorf("%s: got id %s for %s, want %s", tt.name, after.Id, tt.dst, before.Id)
+		}
+	}
+}
+
+func TestRm(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/notes.txt", "hello")
+	h.writeFile(h.home+"/photos/a.jpg", "a")
+	h.writeFile(h.otherHome+"/secret.txt", "secret")
+
+	tests := []struct {
+		name  string
+		token string
+		path  string
+		code  codes.Code
+	}{
+		{"file", h.token, h.home + "/notes.txt", codes.OK},
+		{"dir", h.token, h.home + "/photos", codes.OK},
+		{"home", h.token, h.home, codes.PermissionDenied},
+		{"other home", h.token, h.otherHome + "/secret.txt", codes.PermissionDenied},
+		{"bad token", "bad", h.home + "/notes.txt", codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		_, err := h.client.Rm(h.ctx, &pb.RmReq{AccessToken: tt.token, Path: tt.path})
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code != codes.OK {
+			continue
+		}
+		if h.exists(tt.path) {
+			t.Errorf("%s: %s has not been removed", tt.name, tt.path)
+		}
+		if _, ok := h.prop.record(tt.path); ok {
+			t.Errorf("%s: %s is still in prop", tt.name, tt.path)
+		}
+	}
+
+	if !h.exists(h.otherHome + "/secret.txt") {
+		t.Errorf("file in other home has been removed")
+	}
+}
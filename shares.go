@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"github.com/nu7hatch/gouuid"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sharesDir is the container where share grants are kept.
+// Every grant is saved as an empty container /.shares/<id>
+// with the grant information in its attributes.
+const sharesDir = "/.shares"
+
+const (
+	shareOwnerAttr       = "clawio.share.owner"
+	sharePathAttr        = "clawio.share.path"
+	shareGranteeAttr     = "clawio.share.grantee"
+	shareGranteeTypeAttr = "clawio.share.grantee_type"
+	sharePermissionAttr  = "clawio.share.permission"
+	shareCreatedAttr     = "clawio.share.created"
+	shareExpiresAttr     = "clawio.share.expires"
+	sharePasswordAttr    = "clawio.share.password"
+	shareIdentityAttr    = "clawio.share.identity"
+)
+
+const (
+	granteeTypeUser  = "user"
+	granteeTypeGroup = "group"
+	granteeTypeLink  = "link"
+
+	sharePermRead      = "read"
+	sharePermReadWrite = "readwrite"
+)
+
+var shareNotFound = grpc.Errorf(codes.NotFound, "share not found")
+
+// isSharesPath checks if the path is inside the shares area.
+func isSharesPath(p string) bool {
+	p = path.Clean(p)
+	return p == sharesDir || strings.HasPrefix(p, sharesDir+"/")
+}
+
+// isUnder checks if p is base or a descendant of base.
+func isUnder(p, base string) bool {
+	p = path.Clean(p)
+	base = path.Clean(base)
+	return p == base || strings.HasPrefix(p, strings.TrimSuffix(base, "/")+"/")
+}
+
+// loadGroups reads the members of every group from a JSON file
+// with the format {"<group>": ["<account>", "<account>"]}.
+// See getAccountID for the format of the accounts.
+// An empty file name means there are no groups.
+func loadGroups(fn string) (map[string][]string, error) {
+	groups := map[string][]string{}
+	if fn == "" {
+		return groups, nil
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// shareIndex keeps in memory all the share grants
+// so access checks do not need to read them from the storage.
+type shareIndex struct {
+	mu     sync.Mutex
+	shares map[string]*pb.Share
+}
+
+func newShareIndex() *shareIndex {
+	return &shareIndex{shares: map[string]*pb.Share{}}
+}
+
+func (i *shareIndex) add(sh *pb.Share) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.shares[sh.Id] = sh
+}
+
+func (i *shareIndex) remove(id string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.shares, id)
+}
+
+func (i *shareIndex) get(id string) (*pb.Share, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	sh, ok := i.shares[id]
+	return sh, ok
+}
+
+// list returns the shares that match fn, oldest first.
+func (i *shareIndex) list(fn func(sh *pb.Share) bool) []*pb.Share {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	shares := []*pb.Share{}
+	for _, sh := range i.shares {
+		if fn(sh) {
+			shares = append(shares, sh)
+		}
+	}
+	sort.Sort(byCreation(shares))
+	return shares
+}
+
+type byCreation []*pb.Share
+
+func (s byCreation) Len() int      { return len(s) }
+func (s byCreation) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCreation) Less(i, j int) bool {
+	if s[i].Created != s[j].Created {
+		return s[i].Created < s[j].Created
+	}
+	return s[i].Id < s[j].Id
+}
+
+// loadShares reads all the share grants from the storage into the index.
+func (s *server) loadShares() error {
+	ids, err := s.storage.List(sharesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, id := range ids {
+		sh, err := s.readShare(id)
+		if err != nil {
+			rus.Errorf("share %s has not been loaded because %s", id, err.Error())
+			continue
+		}
+		s.shares.add(sh)
+	}
+	return nil
+}
+
+// readShare reads the share grant id from the storage.
+func (s *server) readShare(id string) (*pb.Share, error) {
+	entry := path.Join(sharesDir, id)
+
+	attrs := map[string]string{}
+	for _, name := range []string{shareOwnerAttr, sharePathAttr, shareGranteeAttr, shareGranteeTypeAttr, sharePermissionAttr, shareCreatedAttr} {
+		val, err := s.storage.GetAttr(entry, name)
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = string(val)
+	}
+
+	created, err := strconv.ParseUint(attrs[shareCreatedAttr], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	// Expiration and password are only saved for links.
+	var expires uint64
+	val, err := s.storage.GetAttr(entry, shareExpiresAttr)
+	if err == nil {
+		expires, err = strconv.ParseUint(string(val), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != errAttrNotFound {
+		return nil, err
+	}
+
+	password, err := s.storage.GetAttr(entry, sharePasswordAttr)
+	if err != nil && err != errAttrNotFound {
+		return nil, err
+	}
+
+	sh := &pb.Share{}
+	sh.Id = id
+	sh.Owner = attrs[shareOwnerAttr]
+	sh.Path = attrs[sharePathAttr]
+	sh.Grantee = attrs[shareGranteeAttr]
+	sh.GranteeType = attrs[shareGranteeTypeAttr]
+	sh.Permission = attrs[sharePermissionAttr]
+	sh.Created = uint32(created)
+	sh.Expires = uint32(expires)
+	sh.PasswordProtected = len(password) > 0
+	return sh, nil
+}
+
+// saveShare saves the share grant in the storage and in the index.
+// extra are attributes saved with the share that are not kept in the index.
+func (s *server) saveShare(sh *pb.Share, extra map[string]string) error {
+	entry := path.Join(sharesDir, sh.Id)
+
+	if err := s.storage.MkdirAll(entry); err != nil {
+		return err
+	}
+
+	attrs := map[string]string{
+		shareOwnerAttr:       sh.Owner,
+		sharePathAttr:        sh.Path,
+		shareGranteeAttr:     sh.Grantee,
+		shareGranteeTypeAttr: sh.GranteeType,
+		sharePermissionAttr:  sh.Permission,
+		shareCreatedAttr:     strconv.FormatUint(uint64(sh.Created), 10),
+	}
+	for k, v := range extra {
+		attrs[k] = v
+	}
+	for k, v := range attrs {
+		if err := s.storage.SetAttr(entry, k, []byte(v)); err != nil {
+			s.storage.Remove(entry)
+			return err
+		}
+	}
+
+	s.shares.add(sh)
+	return nil
+}
+
+// deleteShare removes the share grant from the storage and from the index.
+func (s *server) deleteShare(id string) error {
+	if err := s.storage.Remove(path.Join(sharesDir, id)); err != nil {
+		return err
+	}
+	s.shares.remove(id)
+	return nil
+}
+
+// removeSharesUnder removes the share grants on p and on its descendants.
+func (s *server) removeSharesUnder(p string, log *rus.Entry) {
+	for _, sh := range s.shares.list(func(sh *pb.Share) bool { return isUnder(sh.Path, p) }) {
+		if err := s.deleteShare(sh.Id); err != nil {
+			log.Errorf("share %s has not been removed because %s", sh.Id, err.Error())
+		}
+	}
+}
+
+// moveSharesUnder moves the share grants on src and on its descendants to dst.
+func (s *server) moveSharesUnder(src, dst string, log *rus.Entry) {
+	for _, sh := range s.shares.list(func(sh *pb.Share) bool { return isUnder(sh.Path, src) }) {
+		moved := *sh
+		moved.Path = path.Join(dst, strings.TrimPrefix(sh.Path, src))
+
+		// A grant moved to another home is not valid anymore.
+		owner := s.getOwner(moved.Path)
+		if owner == nil || s.getAccountID(owner) != sh.Owner {
+			if err := s.deleteShare(sh.Id); err != nil {
+				log.Errorf("share %s has not been removed because %s", sh.Id, err.Error())
+			}
+			continue
+		}
+
+		if err := s.storage.SetAttr(path.Join(sharesDir, sh.Id), sharePathAttr, []byte(moved.Path)); err != nil {
+			log.Errorf("share %s has not been moved because %s", sh.Id, err.Error())
+			continue
+		}
+		s.shares.add(&moved)
+	}
+}
+
+// isGrantee checks if the share grant is given to the user.
+func (s *server) isGrantee(sh *pb.Share, idt *authlib.Identity) bool {
+	switch sh.GranteeType {
+	case granteeTypeUser:
+		return sh.Grantee == s.getAccountID(idt)
+	case granteeTypeGroup:
+		for _, member := range s.c.groups[sh.Grantee] {
+			if member == s.getAccountID(idt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *server) CreateShare(ctx context.Context, req *pb.CreateShareReq) (*pb.Share, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.Share{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	p := path.Clean(req.Path)
+
+	log.Infof("path is %s", p)
+
+	if !s.isUnderHome(p, idt) {
+		log.Error(permissionDenied)
+		return &pb.Share{}, permissionDenied
+	}
+
+	granteeType := req.GranteeType
+	if granteeType == "" {
+		granteeType = granteeTypeUser
+	}
+	if granteeType != granteeTypeUser && granteeType != granteeTypeGroup {
+		return &pb.Share{}, grpc.Errorf(codes.InvalidArgument, "grantee type %s is not supported", granteeType)
+	}
+
+	if req.Grantee == "" {
+		return &pb.Share{}, grpc.Errorf(codes.InvalidArgument, "grantee is empty")
+	}
+	if granteeType == granteeTypeUser && req.Grantee == s.getAccountID(idt) {
+		return &pb.Share{}, grpc.Errorf(codes.InvalidArgument, "cannot share with yourself")
+	}
+
+	if req.Permission != sharePermRead && req.Permission != sharePermReadWrite {
+		return &pb.Share{}, grpc.Errorf(codes.InvalidArgument, "permission %s is not supported", req.Permission)
+	}
+
+	_, err := s.storage.Stat(p)
+	if err != nil {
+		log.Error(err)
+		return &pb.Share{}, err
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		log.Error(err)
+		return &pb.Share{}, err
+	}
+
+	sh := &pb.Share{}
+	sh.Id = u.String()
+	sh.Owner = s.getAccountID(idt)
+	sh.Path = p
+	sh.Grantee = req.Grantee
+	sh.GranteeType = granteeType
+	sh.Permission = req.Permission
+	sh.Created = uint32(time.Now().Unix())
+
+	err = s.saveShare(sh, nil)
+	if err != nil {
+		log.Error(err)
+		return &pb.Share{}, err
+	}
+
+	log.Infof("shared %s with %s %s with permission %s", p, granteeType, req.Grantee, req.Permission)
+
+	return sh, nil
+}
+
+func (s *server) ListShares(ctx context.Context, req *pb.ListSharesReq) (*pb.ShareList, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.ShareList{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	list := &pb.ShareList{}
+	list.Shares = s.shares.list(func(sh *pb.Share) bool {
+		return sh.Owner == s.getAccountID(idt) || s.isGrantee(sh, idt)
+	})
+
+	log.Infof("user %s has %d shares", s.getAccountID(idt), len(list.Shares))
+
+	return list, nil
+}
+
+func (s *server) RemoveShare(ctx context.Context, req *pb.RemoveShareReq) (*pb.Void, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.Void{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	// Other users' shares are not found to not disclose them.
+	sh, ok := s.shares.get(req.Id)
+	if !ok || sh.Owner != s.getAccountID(idt) {
+		log.Error(shareNotFound)
+		return &pb.Void{}, shareNotFound
+	}
+
+	err := s.deleteShare(sh.Id)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	log.Infof("removed share %s of %s", sh.Id, sh.Path)
+
+	return &pb.Void{}, nil
+}
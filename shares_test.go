@@ -0,0 +1,212 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"testing"
+)
+
+// share creates a share of p and fails the test on error.
+func (h *testHarness) share(p, grantee, granteeType, perm string) *pb.Share {
+	req := &pb.CreateShareReq{AccessToken: h.token, Path: p, Grantee: grantee, GranteeType: granteeType, Permission: perm}
+	sh, err := h.client.CreateShare(h.ctx, req)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return sh
+}
+
+func TestCreateShare(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/photos/a.jpg", "a")
+	h.writeFile(h.otherHome+"/secret.txt", "secret")
+
+	tests := []struct {
+		name        string
+		token       string
+		path        string
+		grantee     string
+		granteeType string
+		perm        string
+		code        codes.Code
+	}{
+		{"user", h.token, h.home + "/photos", "other", "", "read", codes.OK},
+		{"group", h.token, h.home + "/photos", "friends", "group", "readwrite", codes.OK},
+		{"other home", h.token, h.otherHome + "/secret.txt", "third", "", "read", codes.PermissionDenied},
+		{"missing path", h.token, h.home + "/missing", "other", "", "read", codes.NotFound},
+		{"yourself", h.token, h.home + "/photos", "demo", "user", "read", codes.InvalidArgument},
+		{"no grantee", h.token, h.home + "/photos", "", "", "read", codes.InvalidArgument},
+		{"bad grantee type", h.token, h.home + "/photos", "other", "robot", "read", codes.InvalidArgument},
+		{"bad permission", h.token, h.home + "/photos", "other", "", "admin", codes.InvalidArgument},
+		{"bad token", "bad", h.home + "/photos", "other", "", "read", codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		req := &pb.CreateShareReq{AccessToken: tt.token, Path: tt.path, Grantee: tt.grantee, GranteeType: tt.granteeType, Permission: tt.perm}
+		sh, err := h.client.CreateShare(h.ctx, req)
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code != codes.OK {
+			continue
+		}
+		if sh.Id == "" || sh.Owner != "demo" || sh.Path != tt.path {
+			t.Errorf("%s: got share %+v", tt.name, sh)
+		}
+	}
+
+	// shares are loaded again when the server starts
+	srv, err := newServer(h.srv.c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.grpcPool.EnterLameDuckMode()
+	if got := len(srv.shares.list(func(*pb.Share) bool { return true })); got != 2 {
+		t.Errorf("got %d shares loaded, want 2", got)
+	}
+}
+
+func TestListAndRemoveShares(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/photos/a.jpg", "a")
+	sh := h.share(h.home+"/photos", "other", "user", "read")
+	h.share(h.home+"/photos", "friends", "group", "read")
+
+	other := newTestToken(t, "other")
+	third := newTestToken(t, "third")
+
+	tests := []struct {
+		name  string
+		token string
+		count int
+	}{
+		{"owner", h.token, 2},
+		{"grantee", other, 2},
+		{"not grantee", third, 0},
+	}
+	for _, tt := range tests {
+		list, err := h.client.ListShares(h.ctx, &pb.ListSharesReq{AccessToken: tt.token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Shares) != tt.count {
+			t.Errorf("%s: got %d shares, want %d", tt.name, len(list.Shares), tt.count)
+		}
+	}
+
+	_, err := h.client.RemoveShare(h.ctx, &pb.RemoveShareReq{AccessToken: other, Id: sh.Id})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.NotFound)
+	}
+	if _, err := h.client.RemoveShare(h.ctx, &pb.RemoveShareReq{AccessToken: h.token, Id: sh.Id}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := h.client.ListShares(h.ctx, &pb.ListSharesReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Shares) != 1 {
+		t.Errorf("got %d shares, want 1", len(list.Shares))
+	}
+
+	// the shares area is not reachable from the namespace
+	_, err = h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: sharesDir, Children: true})
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.PermissionDenied)
+	}
+}
+
+func TestShareAccess(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	other := newTestToken(t, "other")
+	third := newTestToken(t, "third")
+	if _, err := h.client.Home(h.ctx, &pb.HomeReq{AccessToken: other}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.writeFile(h.home+"/photos/a.jpg", "a")
+	h.writeFile(h.home+"/docs/b.txt", "b")
+	h.writeFile(h.home+"/private/c.txt", "c")
+	h.share(h.home+"/photos", "other", "user", "read")
+	h.share(h.home+"/docs", "friends", "group", "readwrite")
+
+	stat := func(token, p string) error {
+		_, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: token, Path: p, Children: true})
+		return err
+	}
+	mkdir := func(token, p string) error {
+		_, err := h.client.Mkdir(h.ctx, &pb.MkdirReq{AccessToken: token, Path: p})
+		return err
+	}
+	cp := func(token, src, dst string) error {
+		_, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: token, Src: src, Dst: dst})
+		return err
+	}
+	mv := func(token, src, dst string) error {
+		_, err := h.client.Mv(h.ctx, &pb.MvReq{AccessToken: token, Src: src, Dst: dst})
+		return err
+	}
+	rm := func(token, p string) error {
+		_, err := h.client.Rm(h.ctx, &pb.RmReq{AccessToken: token, Path: p})
+		return err
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{"list read share", stat(other, h.home+"/photos"), codes.OK},
+		{"list not shared", stat(other, h.home+"/private"), codes.PermissionDenied},
+		{"list not grantee", stat(third, h.home+"/photos"), codes.PermissionDenied},
+		{"copy from read share", cp(other, h.home+"/photos/a.jpg", h.otherHome+"/a.jpg"), codes.OK},
+		{"copy not shared", cp(other, h.home+"/private/c.txt", h.otherHome+"/c.txt"), codes.PermissionDenied},
+		{"mkdir in read share", mkdir(other, h.home+"/photos/new"), codes.PermissionDenied},
+		{"rm in read share", rm(other, h.home+"/photos/a.jpg"), codes.PermissionDenied},
+		{"mkdir in group share", mkdir(other, h.home+"/docs/new"), codes.OK},
+		{"copy to group share", cp(other, h.otherHome+"/a.jpg", h.home+"/docs/a.jpg"), codes.OK},
+		{"mv in group share", mv(other, h.home+"/docs/b.txt", h.home+"/docs/b2.txt"), codes.OK},
+		{"mv out of share", mv(other, h.home+"/docs/b2.txt", h.home+"/b2.txt"), codes.PermissionDenied},
+		{"rm in group share", rm(other, h.home+"/docs/a.jpg"), codes.OK},
+		{"rm shared root", rm(other, h.home+"/docs"), codes.PermissionDenied},
+		{"mkdir not grantee", mkdir(third, h.home+"/docs/third"), codes.PermissionDenied},
+	}
+
+	for _, tt := range tests {
+		if grpc.Code(tt.err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(tt.err), tt.code, tt.err)
+		}
+	}
+
+	// resources removed by a grantee go to the trash of the owner
+	list, err := h.client.ListTrash(h.ctx, &pb.ListTrashReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 1 || list.Entries[0].Path != h.home+"/docs/a.jpg" {
+		t.Errorf("got trash entries %v, want %s", list.Entries, h.home+"/docs/a.jpg")
+	}
+
+	// grants follow a moved resource and go away with a removed one
+	if err := mv(h.token, h.home+"/docs", h.home+"/documents"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mkdir(other, h.home+"/documents/moved"); err != nil {
+		t.Errorf("got %v after moving the share", err)
+	}
+	if err := rm(h.token, h.home+"/documents"); err != nil {
+		t.Fatal(err)
+	}
+	h.mkdir(h.home + "/documents")
+	if err := mkdir(other, h.home+"/documents/removed"); grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("got %v after removing the share, want %v", grpc.Code(err), codes.PermissionDenied)
+	}
+}
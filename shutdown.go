@@ -0,0 +1,147 @@
+package main
+
+import (
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"net"
+	"sync"
+	"time"
+)
+
+// shutdownCancelGrace is how long the calls canceled at shutdown have
+// to return before the connections are closed under them.
+const shutdownCancelGrace = 5 * time.Second
+
+var errShuttingDown = grpc.Errorf(codes.Unavailable, "server is shutting down")
+
+// drainer keeps track of the calls in flight so the server can wait
+// for them before it stops, and rejects new calls once it is draining.
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	calls    map[*inflightCall]struct{}
+	wg       sync.WaitGroup
+}
+
+// inflightCall is a call being handled.
+type inflightCall struct {
+	method string
+	start  time.Time
+	log    *rus.Entry
+	cancel context.CancelFunc
+}
+
+func newDrainer() *drainer {
+	return &drainer{calls: map[*inflightCall]struct{}{}}
+}
+
+// interceptor runs the call with a context that is canceled if the call
+// is still running when the drain times out.
+func (d *drainer) interceptor(ctx context.Context, req interface{}, info *unaryServerInfo, handler unaryHandler) (interface{}, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	call := &inflightCall{method: getMethodName(info.fullMethod), start: time.Now(), log: getLog(ctx), cancel: cancel}
+
+	d.mu.Lock()
+	if d.draining {
+		d.mu.Unlock()
+		return nil, errShuttingDown
+	}
+	d.calls[call] = struct{}{}
+	d.wg.Add(1)
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.calls, call)
+		d.mu.Unlock()
+		d.wg.Done()
+	}()
+
+	return handler(ctx, req)
+}
+
+// startDraining rejects the calls received from now on.
+func (d *drainer) startDraining() {
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+}
+
+// drain rejects new calls and waits up to timeout for the calls in flight.
+// It returns the calls still running when the timeout expires.
+func (d *drainer) drain(timeout time.Duration) []*inflightCall {
+	d.startDraining()
+
+	if d.wait(timeout) {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	calls := []*inflightCall{}
+	for call := range d.calls {
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// wait waits up to timeout for the calls in flight to end.
+// It returns false if some are still running.
+func (d *drainer) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// isDraining checks if the server is shutting down.
+func (d *drainer) isDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// shutdown stops the server gracefully: new calls on open connections are
+// rejected, the listener is closed so no new connections are accepted
+// and the calls in flight have up to timeout to end. The ones that overrun
+// are canceled and logged. Finally the connections and the pool of
+// connections to prop are closed.
+// The server is draining before the listener is closed, so the
+// error returned by Serve is already known to be part of the shutdown.
+func (s *server) shutdown(g *grpc.Server, lis net.Listener, timeout time.Duration) {
+	s.drainer.startDraining()
+	lis.Close()
+
+	start := time.Now()
+	left := s.drainer.drain(timeout)
+	for _, call := range left {
+		call.log.WithFields(rus.Fields{
+			"method":   call.method,
+			"duration": time.Since(call.start).Seconds(),
+		}).Warn("request interrupted by shutdown")
+		call.cancel()
+	}
+	if len(left) > 0 && !s.drainer.wait(shutdownCancelGrace) {
+		rus.Error("some interrupted requests have not returned")
+	}
+
+	g.Stop()
+	s.grpcPool.EnterLameDuckMode()
+
+	rus.WithFields(rus.Fields{
+		"interrupted": len(left),
+		"duration":    time.Since(start).Seconds(),
+	}).Info("server stopped")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1alpha"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	d := newDrainer()
+	info := &unaryServerInfo{fullMethod: "/metadata.Meta/Cp"}
+
+	started := make(chan struct{})
+	finished := make(chan error, 2)
+
+	// A call that ends in time and one that only ends when canceled.
+	release := make(chan struct{})
+	go func() {
+		_, err := d.interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			started <- struct{}{}
+			<-release
+			return nil, nil
+		})
+		finished <- err
+	}()
+	go func() {
+		_, err := d.interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			started <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		finished <- err
+	}()
+	<-started
+	<-started
+
+	close(release)
+	left := d.drain(50 * time.Millisecond)
+	if len(left) != 1 || left[0].method != "cp" {
+		t.Fatalf("got %d calls left, want the cp that does not end", len(left))
+	}
+	if err := <-finished; err != nil {
+		t.Fatal(err)
+	}
+
+	// New calls are rejected while draining.
+	_, err := d.interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Fatal("call has been handled while draining")
+		return nil, nil
+	})
+	if grpc.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want Unavailable", err)
+	}
+
+	left[0].cancel()
+	if err := <-finished; err != context.Canceled {
+		t.Fatalf("got %v, want the call canceled", err)
+	}
+	if !d.wait(time.Second) {
+		t.Fatal("canceled call is still in flight")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grpc.NewServer()
+	registerMetaServer(g, h.srv, h.srv.interceptor())
+	served := make(chan error, 1)
+	go func() {
+		served <- g.Serve(lis)
+	}()
+
+	con, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	client := pb.NewMetaClient(con)
+	if _, err := client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.srv.shutdown(g, lis, time.Second)
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("server is still serving")
+	}
+	if !h.srv.drainer.isDraining() {
+		t.Fatal("server is not draining")
+	}
+	if _, err := h.srv.grpcPool.Get(""); err == nil {
+		t.Fatal("pool of connections to prop is still open")
+	}
+
+	checker := newHealthChecker(h.srv, 0)
+	checker.shutdown()
+	checker.update()
+	res, err := checker.Check(h.ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("got %s after shutdown, want NOT_SERVING", res.Status)
+	}
+}
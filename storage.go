@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// xattrPrefix is prepended to the attribute names when they are saved
+// as extended attributes in the local filesystem.
+const xattrPrefix = "user."
+
+// internalAttrPrefix is the namespace of the attributes the service keeps
+// for itself, like ACLs, checksums or trash and share records. They are
+// never handed over to another resource, not even by a preserving copy.
+const internalAttrPrefix = "clawio."
+
+var (
+	errAttrNotFound     = errors.New("attribute not found")
+	errAttrNotSupported = errors.New("attributes are not supported")
+)
+
+// storage is the interface implemented by storage drivers.
+// All the paths received and returned by a driver are logical paths,
+// i.e /local/users/d/demo/myfile.txt. Mapping a logical path to the place
+// where the data really lives is up to the driver.
+type storage interface {
+	// Stat returns the file info of p.
+	// Errors must satisfy os.IsNotExist when p does not exist.
+	Stat(p string) (os.FileInfo, error)
+
+	// Lstat returns the file info of p. If p is a symbolic link
+	// the info of the link is returned, not the one of its target.
+	Lstat(p string) (os.FileInfo, error)
+
+	// Open returns a reader for the content of the file p.
+	Open(p string) (io.ReadCloser, error)
+
+	// List returns the names of the entries inside the container p.
+	List(p string) ([]string, error)
+
+	// OpenDir opens the container p to read its entries in chunks.
+	OpenDir(p string) (dirReader, error)
+
+	// Mkdir creates the container p. The parent must exist.
+	Mkdir(p string) error
+
+	// MkdirAll creates the container p and all the missing parents.
+	MkdirAll(p string) error
+
+	// Copy copies src to dst. If src is a container it is copied recursively
+	// and atomically: if the copy fails or ctx is done nothing is left in dst.
+	Copy(ctx context.Context, src, dst string, opts copyOptions) error
+
+	// Move renames src to dst.
+	Move(src, dst string) error
+
+	// Remove removes p and all its children.
+	Remove(p string) error
+
+	// GetAttr returns the value of the attribute name of p.
+	// If the attribute is not set errAttrNotFound is returned.
+	GetAttr(p, name string) ([]byte, error)
+
+	// SetAttr sets the attribute name of p to value.
+	SetAttr(p, name string, value []byte) error
+}
+
+// localStorage is the default storage driver.
+// It stores the resources in the local filesystem under a root directory.
+// tmpDir is used to stage copies and must be in the same
+// filesystem as root so staged trees can be renamed into place.
+// The home layout tells which home a path must not leave when resolved.
+type localStorage struct {
+	root   string
+	tmpDir string
+	layout homeLayout
+}
+
+func newLocalStorage(root, tmpDir string, layout homeLayout) *localStorage {
+	return &localStorage{root: root, tmpDir: tmpDir, layout: layout}
+}
+
+func (l *localStorage) Stat(p string) (os.FileInfo, error) {
+	pp, err := l.getPhysicalPath(p, true)
+	if err != nil {
+		return nil, err
+	}
+	// The last element has been followed already, so pp is
+	// not followed again in case it has been swapped for a link.
+	finfo, err := os.Lstat(pp)
+	if err != nil {
+		return nil, err
+	}
+	if err := recheckPath(l.root, l.layout, p, true, finfo); err != nil {
+		return nil, err
+	}
+	return finfo, nil
+}
+
+func (l *localStorage) Lstat(p string) (os.FileInfo, error) {
+	pp, err := l.getPhysicalPath(p, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(pp)
+}
+
+func (l *localStorage) Open(p string) (io.ReadCloser, error) {
+	return openPath(l.root, l.layout, p)
+}
+
+func (l *localStorage) List(p string) ([]string, error) {
+	dir, err := openPath(l.root, l.layout, p)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	return dir.Readdirnames(0)
+}
+
+func (l *localStorage) OpenDir(p string) (dirReader, error) {
+	dir, err := openPath(l.root, l.layout, p)
+	if err != nil {
+		return nil, err
+	}
+	return &localDirReader{dir}, nil
+}
+
+func (l *localStorage) Mkdir(p string) error {
+	pp, err := l.getPhysicalPath(p, false)
+	if err != nil {
+		return err
+	}
+	if err := checkParent(l.root, l.layout, p, pp); err != nil {
+		return err
+	}
+	return os.Mkdir(pp, dirPerm)
+}
+
+func (l *localStorage) MkdirAll(p string) error {
+	pp, err := l.getPhysicalPath(p, true)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(pp, dirPerm)
+}
+
+func (l *localStorage) Copy(ctx context.Context, src, dst string, opts copyOptions) error {
+	psrc, err := l.getPhysicalPath(src, true)
+	if err != nil {
+		return err
+	}
+	pdst, err := l.getPhysicalPath(dst, true)
+	if err != nil {
+		return err
+	}
+
+	finfo, err := os.Stat(psrc)
+	if err != nil {
+		return err
+	}
+
+	c := &copier{ctx: ctx, progress: opts.progress, preserve: opts.preserve}
+
+	if !finfo.IsDir() {
+		return c.copyFile(psrc, pdst)
+	}
+
+	if _, err := os.Lstat(pdst); err == nil {
+		return &os.PathError{Op: "copy", Path: dst, Err: syscall.EEXIST}
+	}
+
+	// The tree is staged in the tmp dir and renamed into place
+	// once it is complete, so a failed copy leaves nothing behind.
+	stage, err := ioutil.TempDir(l.tmpDir, "copy")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+
+	staged := path.Join(stage, path.Base(pdst))
+	if err := c.copyDir(psrc, staged); err != nil {
+		return err
+	}
+	return os.Rename(staged, pdst)
+}
+
+// Move renames src to dst. Links are renamed, not their targets.
+func (l *localStorage) Move(src, dst string) error {
+	psrc, err := l.getPhysicalPath(src, false)
+	if err != nil {
+		return err
+	}
+	pdst, err := l.getPhysicalPath(dst, false)
+	if err != nil {
+		return err
+	}
+	if err := checkParent(l.root, l.layout, src, psrc); err != nil {
+		return err
+	}
+	if err := checkParent(l.root, l.layout, dst, pdst); err != nil {
+		return err
+	}
+	return os.Rename(psrc, pdst)
+}
+
+// Remove removes p. Links are removed, not their targets.
+func (l *localStorage) Remove(p string) error {
+	pp, err := l.getPhysicalPath(p, false)
+	if err != nil {
+		return err
+	}
+	if err := checkParent(l.root, l.layout, p, pp); err != nil {
+		return err
+	}
+	return os.RemoveAll(pp)
+}
+
+func (l *localStorage) GetAttr(p, name string) ([]byte, error) {
+	pp, err := l.getPhysicalPath(p, true)
+	if err != nil {
+		return nil, err
+	}
+	return getXattr(pp, name)
+}
+
+func (l *localStorage) SetAttr(p, name string, value []byte) error {
+	pp, err := l.getPhysicalPath(p, true)
+	if err != nil {
+		return err
+	}
+	return setXattr(pp, name, value)
+}
+
+// getPhysicalPath returns the path of p in the local filesystem.
+// See resolvePath for how symbolic links are handled.
+func (l *localStorage) getPhysicalPath(p string, follow bool) (string, error) {
+	return resolvePath(l.root, l.layout, p, follow)
+}
+
+// copyOptions are the options of a copy.
+type copyOptions struct {
+	// progress, if set, is called with the data copied so far
+	// every time a chunk of data or an entry has been copied.
+	progress func(copyStats)
+
+	// preserve keeps the mode bits, the access and modification
+	// times and the user extended attributes of the copied resources.
+	preserve bool
+}
+
+// dirReader reads the entries of a container in chunks.
+type dirReader interface {
+	// Read returns at most n entry names. It returns io.EOF
+	// when there are no more entries.
+	Read(n int) ([]string, error)
+	Close() error
+}
+
+type localDirReader struct {
+	dir *os.File
+}
+
+func (r *localDirReader) Read(n int) ([]string, error) {
+	return r.dir.Readdirnames(n)
+}
+
+func (r *localDirReader) Close() error {
+	return r.dir.Close()
+}
+
+// timedStorage measures the latency of the operations of a storage
+// that touch the filesystem the most.
+type timedStorage struct {
+	storage
+}
+
+func newTimedStorage(s storage) *timedStorage {
+	return &timedStorage{s}
+}
+
+func (t *timedStorage) Stat(p string) (os.FileInfo, error) {
+	defer fsDuration.since(time.Now(), "stat")
+	return t.storage.Stat(p)
+}
+
+func (t *timedStorage) Lstat(p string) (os.FileInfo, error) {
+	defer fsDuration.since(time.Now(), "stat")
+	return t.storage.Lstat(p)
+}
+
+func (t *timedStorage) List(p string) ([]string, error) {
+	defer fsDuration.since(time.Now(), "readdir")
+	return t.storage.List(p)
+}
+
+func (t *timedStorage) OpenDir(p string) (dirReader, error) {
+	r, err := t.storage.OpenDir(p)
+	if err != nil {
+		return nil, err
+	}
+	return &timedDirReader{r}, nil
+}
+
+func (t *timedStorage) Copy(ctx context.Context, src, dst string, opts copyOptions) error {
+	defer fsDuration.since(time.Now(), "copy")
+	return t.storage.Copy(ctx, src, dst, opts)
+}
+
+func (t *timedStorage) Move(src, dst string) error {
+	defer fsDuration.since(time.Now(), "rename")
+	return t.storage.Move(src, dst)
+}
+
+func (t *timedStorage) Remove(p string) error {
+	defer fsDuration.since(time.Now(), "removeall")
+	return t.storage.Remove(p)
+}
+
+type timedDirReader struct {
+	dirReader
+}
+
+func (r *timedDirReader) Read(n int) ([]string, error) {
+	defer fsDuration.since(time.Now(), "readdir")
+	return r.dirReader.Read(n)
+}
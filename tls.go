@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	rus "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often the certificate files are checked for changes.
+const certReloadInterval = 30 * time.Second
+
+// alpnProtos are the protocols negotiated with ALPN, as gRPC expects.
+var alpnProtos = []string{"h2"}
+
+// certReloader keeps a certificate and a CA bundle loaded from disk and
+// reloads them when the files change, so certificates can be renewed
+// without restarting the service. Any of the files can be empty.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// newCertReloader returns a reloader with the files already loaded.
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("certificate and key files must be set together")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads all the files.
+func (r *certReloader) load() error {
+	modTimes := map[string]time.Time{}
+	for _, fn := range []string{r.certFile, r.keyFile, r.caFile} {
+		if fn == "" {
+			continue
+		}
+		finfo, err := os.Stat(fn)
+		if err != nil {
+			return err
+		}
+		modTimes[fn] = finfo.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		data, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = cert
+	r.pool = pool
+	r.modTimes = modTimes
+	return nil
+}
+
+// changed checks if any of the files has been modified since they were loaded.
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for fn, modTime := range r.modTimes {
+		finfo, err := os.Stat(fn)
+		if err != nil || !finfo.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload loads the files again if they have changed. If they cannot be
+// loaded, i.e. because the certificate has been written but not the key
+// yet, the certificates loaded before are kept.
+func (r *certReloader) reload() error {
+	if !r.changed() {
+		return nil
+	}
+	if err := r.load(); err != nil {
+		return err
+	}
+	rus.Infof("certificates reloaded from %s %s %s", r.certFile, r.keyFile, r.caFile)
+	return nil
+}
+
+// watch reloads the files every interval until stop is closed.
+func (r *certReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.reload(); err != nil {
+				rus.Errorf("certificates have not been reloaded because %s", err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (r *certReloader) getCert() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+func (r *certReloader) getPool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
+
+// newServerTLSConfig returns the TLS config of the gRPC server.
+// The certificate is taken from the reloader on every handshake.
+// If the reloader has a CA bundle, clients must present a certificate
+// signed by it.
+func newServerTLSConfig(r *certReloader) *tls.Config {
+	config := &tls.Config{}
+	config.MinVersion = tls.VersionTLS12
+	config.NextProtos = alpnProtos
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return r.getCert(), nil
+	}
+	if r.caFile != "" {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := config.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = r.getPool()
+			return c, nil
+		}
+	}
+	return config
+}
+
+// newClientTLSConfig returns the TLS config of the connections to prop.
+// The server certificate is verified against the CA bundle of the reloader,
+// or the system roots if it has none, every time a connection is made,
+// so renewed bundles apply to new connections. If the reloader has a
+// certificate it is presented to the server.
+func newClientTLSConfig(r *certReloader, serverName string) *tls.Config {
+	config := &tls.Config{}
+	config.MinVersion = tls.VersionTLS12
+	config.ServerName = serverName
+
+	// The built-in verification is replaced by verifyPeer to use the
+	// current CA bundle, the chain is still fully verified.
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return verifyPeer(rawCerts, r.getPool(), serverName)
+	}
+	if r.certFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.getCert(), nil
+		}
+	}
+	return config
+}
+
+// verifyPeer verifies the certificate chain sent by a server for serverName.
+// A nil pool means the system roots.
+func verifyPeer(rawCerts [][]byte, roots *x509.CertPool, serverName string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server has not sent any certificate")
+	}
+
+	certs := []*x509.Certificate{}
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	opts := x509.VerifyOptions{}
+	opts.Roots = roots
+	opts.DNSName = serverName
+	opts.Intermediates = x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	proppb "github.com/clawio/service-localfs-meta/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// testCA signs the certificates used in the TLS tests.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	n    int64
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{t: t, dir: dir, cert: cert, key: key, n: 1}
+	ca.write("ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+// issue writes a certificate for localhost and 127.0.0.1 signed by
+// the CA and its key to <name>.pem and <name>-key.pem.
+func (ca *testCA) issue(name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.n++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.n),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return ca.write(name+".pem", "CERTIFICATE", der), ca.write(name+"-key.pem", "EC PRIVATE KEY", keyDer)
+}
+
+func (ca *testCA) write(name, typ string, der []byte) string {
+	fn := path.Join(ca.dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return fn
+}
+
+func (ca *testCA) caFile() string {
+	return path.Join(ca.dir, "ca.pem")
+}
+
+func newTestReloader(t *testing.T, certFile, keyFile, caFile string) *certReloader {
+	r, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// TestMutualTLS runs meta and prop with client certificates required
+// on both and checks a request goes through them.
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfs-meta-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir)
+	serverCert, serverKey := ca.issue("server")
+	clientCert, clientKey := ca.issue("client")
+
+	serverReloader := newTestReloader(t, serverCert, serverKey, ca.caFile())
+	clientReloader := newTestReloader(t, clientCert, clientKey, ca.caFile())
+	serverCreds := grpc.Creds(credentials.NewTLS(newServerTLSConfig(serverReloader)))
+
+	prop := newFakeProp()
+	propLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	propSrv := grpc.NewServer(serverCreds)
+	proppb.RegisterPropServer(propSrv, prop)
+	go propSrv.Serve(propLis)
+	defer propSrv.Stop()
+
+	c := &config{}
+	c.DataDir = dir
+	c.TmpDir = dir
+	c.Prop = propLis.Addr().String()
+	c.PropMaxActive = 4
+	c.PropMaxIdle = 4
+	c.PropMaxConcurrency = 4
+	c.PropBatchSize = 100
+	c.PropBatchConcurrency = 1
+	c.SharedSecret = testSecret
+	c.Checksum = "md5"
+	c.propTLS = newClientTLSConfig(clientReloader, "localhost")
+	srv, err := newServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.grpcPool.EnterLameDuckMode()
+
+	metaLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaSrv := grpc.NewServer(serverCreds)
+	registerMetaServer(metaSrv, srv, srv.interceptor())
+	go metaSrv.Serve(metaLis)
+	defer metaSrv.Stop()
+
+	creds := credentials.NewTLS(newClientTLSConfig(clientReloader, "localhost"))
+	con, err := grpc.Dial(metaLis.Addr().String(), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+
+	token := newTestToken(t, "demo")
+	client := pb.NewMetaClient(con)
+	if _, err := client.Home(context.Background(), &pb.HomeReq{AccessToken: token}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Mkdir(context.Background(), &pb.MkdirReq{AccessToken: token, Path: "/local/users/d/demo/photos"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := prop.record("/local/users/d/demo/photos"); !ok {
+		t.Fatal("mkdir has not been propagated over TLS")
+	}
+
+	// Without a client certificate the handshake is rejected.
+	anonymous := newTestReloader(t, "", "", ca.caFile())
+	creds = credentials.NewTLS(newClientTLSConfig(anonymous, "localhost"))
+	anonCon, err := grpc.Dial(metaLis.Addr().String(), grpc.WithTransportCredentials(creds))
+	if err == nil {
+		defer anonCon.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err = pb.NewMetaClient(anonCon).Home(ctx, &pb.HomeReq{AccessToken: token})
+	}
+	if err == nil {
+		t.Fatal("client without certificate has been accepted")
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfs-meta-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issue("server")
+	r := newTestReloader(t, certFile, keyFile, "")
+	before := r.getCert().Certificate[0]
+
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r.getCert().Certificate[0], before) {
+		t.Fatal("certificate reloaded without changes")
+	}
+
+	// A certificate without its key keeps the old one.
+	ioutil.WriteFile(certFile, []byte("broken"), 0600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if err := r.reload(); err == nil {
+		t.Fatal("broken certificate has been loaded")
+	}
+	if !bytes.Equal(r.getCert().Certificate[0], before) {
+		t.Fatal("old certificate has not been kept")
+	}
+
+	ca.issue("server")
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(r.getCert().Certificate[0], before) {
+		t.Fatal("renewed certificate has not been loaded")
+	}
+
+	if _, err := newCertReloader(certFile, "", ""); err == nil {
+		t.Fatal("certificate without key has been accepted")
+	}
+}
+
+func TestVerifyPeer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfs-meta-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issue("server")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	if err := verifyPeer(cert.Certificate, roots, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPeer(cert.Certificate, roots, "prop.example.org"); err == nil {
+		t.Fatal("certificate for another name has been accepted")
+	}
+	if err := verifyPeer(cert.Certificate, x509.NewCertPool(), "localhost"); err == nil {
+		t.Fatal("certificate of unknown ca has been accepted")
+	}
+	if err := verifyPeer(nil, roots, "localhost"); err == nil {
+		t.Fatal("empty chain has been accepted")
+	}
+}
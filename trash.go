@@ -0,0 +1,345 @@
+package main
+
+import (
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	proppb "github.com/clawio/service-localfs-meta/proto/propagator"
+	"github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trashDir is the container where removed resources are kept.
+// Every user has its own trash at /.trash/<pid>. Each removed resource is
+// saved inside an entry container /.trash/<pid>/<key>/<name> and the entry
+// container keeps the information needed to restore it in its attributes.
+const trashDir = "/.trash"
+
+const (
+	trashPathAttr    = "clawio.trash.path"
+	trashDeletedAttr = "clawio.trash.deleted"
+	trashIDAttr      = "clawio.trash.id"
+)
+
+var trashEntryNotFound = grpc.Errorf(codes.NotFound, "trash entry not found")
+
+// isTrashPath checks if the path is inside the trash area.
+// The trash area is never exposed through the logical namespace.
+func isTrashPath(p string) bool {
+	p = path.Clean(p)
+	return p == trashDir || strings.HasPrefix(p, trashDir+"/")
+}
+
+// getTrash returns the trash container of the user.
+func (s *server) getTrash(idt *authlib.Identity) string {
+	return path.Join(trashDir, s.getAccountID(idt))
+}
+
+// getTrashResource returns where the resource p removed to
+// the trash entry key is kept.
+func (s *server) getTrashResource(key, p string, idt *authlib.Identity) string {
+	return path.Join(s.getTrash(idt), key, path.Base(p))
+}
+
+// moveToTrash moves the resource p to the user trash and records its
+// original path, the deletion time and the propagator id.
+func (s *server) moveToTrash(p, id string, idt *authlib.Identity) (string, error) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	key := u.String()
+	entry := path.Join(s.getTrash(idt), key)
+
+	if err := s.storage.MkdirAll(entry); err != nil {
+		return "", err
+	}
+
+	deleted := strconv.FormatInt(time.Now().Unix(), 10)
+	attrs := map[string]string{
+		trashPathAttr:    p,
+		trashDeletedAttr: deleted,
+		trashIDAttr:      id,
+	}
+	for k, v := range attrs {
+		if err := s.storage.SetAttr(entry, k, []byte(v)); err != nil {
+			s.storage.Remove(entry)
+			return "", err
+		}
+	}
+
+	if err := s.storage.Move(p, s.getTrashResource(key, p, idt)); err != nil {
+		s.storage.Remove(entry)
+		return "", err
+	}
+	return key, nil
+}
+
+// getTrashEntry returns the trash entry saved under key.
+func (s *server) getTrashEntry(key string, idt *authlib.Identity) (*pb.TrashEntry, error) {
+	key = path.Clean(key)
+	if key == "." || key == "/" || strings.Contains(key, "/") {
+		return nil, trashEntryNotFound
+	}
+
+	entry := path.Join(s.getTrash(idt), key)
+
+	p, err := s.storage.GetAttr(entry, trashPathAttr)
+	if err != nil {
+		if os.IsNotExist(err) || err == errAttrNotFound {
+			return nil, trashEntryNotFound
+		}
+		return nil, err
+	}
+	deleted, err := s.storage.GetAttr(entry, trashDeletedAttr)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.storage.GetAttr(entry, trashIDAttr)
+	if err != nil {
+		return nil, err
+	}
+	d, err := strconv.ParseUint(string(deleted), 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &pb.TrashEntry{}
+	e.Key = key
+	e.Path = string(p)
+	e.Deleted = uint32(d)
+	e.Id = string(id)
+
+	finfo, err := s.storage.Stat(path.Join(entry, path.Base(e.Path)))
+	if err != nil {
+		return nil, err
+	}
+	e.Size = uint32(finfo.Size())
+	e.IsContainer = finfo.IsDir()
+
+	return e, nil
+}
+
+func (s *server) ListTrash(ctx context.Context, req *pb.ListTrashReq) (*pb.TrashList, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.TrashList{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	trash := s.getTrash(idt)
+
+	keys, err := s.storage.List(trash)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &pb.TrashList{}, nil
+		}
+		log.Error(err)
+		return &pb.TrashList{}, err
+	}
+
+	log.Infof("trash %s has %d entries", trash, len(keys))
+
+	list := &pb.TrashList{}
+	for _, key := range keys {
+		e, err := s.getTrashEntry(key, idt)
+		if err != nil {
+			log.Errorf("trash entry %s has not been added because %s", key, err.Error())
+			continue
+		}
+		list.Entries = append(list.Entries, e)
+	}
+
+	return list, nil
+}
+
+func (s *server) RestoreTrash(ctx context.Context, req *pb.RestoreTrashReq) (*pb.Void, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.Void{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	e, err := s.getTrashEntry(req.Key, idt)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	dst := e.Path
+	if req.Dst != "" {
+		dst = path.Clean(req.Dst)
+	}
+
+	log.Infof("restoring trash entry %s to %s", e.Key, dst)
+
+	if !s.isUnderHome(dst, idt) {
+		log.Error(permissionDenied)
+		return &pb.Void{}, permissionDenied
+	}
+
+	if dst == s.getHome(idt) {
+		return &pb.Void{}, grpc.Errorf(codes.PermissionDenied, "cannot restore to home directory")
+	}
+
+	_, err = s.storage.Stat(dst)
+	if err == nil {
+		return &pb.Void{}, grpc.Errorf(codes.AlreadyExists, "%s already exists", dst)
+	}
+	if !os.IsNotExist(err) {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	entry := path.Join(s.getTrash(idt), e.Key)
+	trashed := s.getTrashResource(e.Key, e.Path, idt)
+
+	err = s.storage.Move(trashed, dst)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	log.Infof("restored %s to %s", e.Key, dst)
+
+	s.moveVersionsUnder(trashed, idt, dst, idt, log)
+
+	s.usages.invalidate(s.getHome(idt))
+
+	err = s.storage.Remove(entry)
+	if err != nil {
+		log.Error(err)
+	}
+
+	resource, err := s.grpcPool.Get("")
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	defer resource.Release()
+
+	handle, err := resource.Handle()
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+	con := handle.(*grpc.ClientConn)
+	log.Infof("created connection to %s", s.c.Prop)
+
+	client := s.newPropClient(con)
+
+	// The prop record was moved to the trash with the resource, moving
+	// it back keeps the id the resource had before being removed.
+	// The put below creates a new record for the entries whose record
+	// did not make it to the trash.
+	mvReq := &proppb.MvReq{}
+	mvReq.Src = trashed
+	mvReq.Dst = dst
+	mvReq.AccessToken = getAccessToken(ctx)
+
+	_, err = client.Mv(ctx, mvReq)
+	if err != nil {
+		log.Errorf("prop record of trash entry %s has not been restored because %s", e.Key, err.Error())
+	}
+
+	in := &proppb.PutReq{}
+	in.Path = dst
+	in.AccessToken = getAccessToken(ctx)
+
+	_, err = client.Put(ctx, in)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	log.Infof("restored resource %s saved in prop", dst)
+
+	return &pb.Void{}, nil
+}
+
+func (s *server) PurgeTrash(ctx context.Context, req *pb.PurgeTrashReq) (*pb.Void, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.Void{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	e, err := s.getTrashEntry(req.Key, idt)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	trashed := s.getTrashResource(e.Key, e.Path, idt)
+	files, err := s.getVersionedFiles(trashed, idt)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	err = s.storage.Remove(path.Join(s.getTrash(idt), e.Key))
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	log.Infof("purged trash entry %s", e.Key)
+
+	s.removeVersions(trashed, idt, files, log)
+
+	s.usages.invalidate(s.getHome(idt))
+
+	resource, err := s.grpcPool.Get("")
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	defer resource.Release()
+
+	handle, err := resource.Handle()
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+	con := handle.(*grpc.ClientConn)
+	log.Infof("created connection to %s", s.c.Prop)
+
+	client := s.newPropClient(con)
+
+	in := &proppb.RmReq{}
+	in.Path = trashed
+	in.AccessToken = getAccessToken(ctx)
+
+	_, err = client.Rm(ctx, in)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	log.Infof("prop record of trash entry %s removed", e.Key)
+
+	return &pb.Void{}, nil
+}
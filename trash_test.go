@@ -0,0 +1,217 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"testing"
+)
+
+// rmToTrash removes p and returns the trash entry created for it.
+func (h *testHarness) rmToTrash(p string) *pb.TrashEntry {
+	if _, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: p}); err != nil {
+		h.t.Fatal(err)
+	}
+	if _, err := h.client.Rm(h.ctx, &pb.RmReq{AccessToken: h.token, Path: p}); err != nil {
+		h.t.Fatal(err)
+	}
+	list, err := h.client.ListTrash(h.ctx, &pb.ListTrashReq{AccessToken: h.token})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	for _, e := range list.Entries {
+		if e.Path == p {
+			return e
+		}
+	}
+	h.t.Fatalf("%s not found in trash", p)
+	return nil
+}
+
+func TestRmMovesToTrash(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/photos/a.jpg", "a")
+	if _, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: h.home + "/photos"}); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ := h.prop.record(h.home + "/photos")
+
+	e := h.rmToTrash(h.home + "/photos")
+	if e.Id != rec.Id {
+		t.Errorf("got id %s, want %s", e.Id, rec.Id)
+	}
+	if !e.IsContainer {
+		t.Errorf("trash entry must be a container")
+	}
+	if e.Deleted == 0 {
+		t.Errorf("deletion time is not set")
+	}
+	if h.exists(h.home + "/photos") {
+		t.Errorf("%s has not been removed", h.home+"/photos")
+	}
+
+	// the trash must not be reachable from the namespace
+	m, err := h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: "/", Children: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range m.Children {
+		if isTrashPath(c.Path) {
+			t.Errorf("trash %s is listed", c.Path)
+		}
+	}
+	_, err = h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: trashDir + "/demo"})
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.PermissionDenied)
+	}
+
+	// other users cannot see the entry
+	other := newTestToken(t, "other")
+	list, err := h.client.ListTrash(h.ctx, &pb.ListTrashReq{AccessToken: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 0 {
+		t.Errorf("got %d entries in other trash, want 0", len(list.Entries))
+	}
+}
+
+func TestRestoreTrash(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/notes.txt", "hello")
+	h.writeFile(h.home+"/todo.txt", "todo")
+	notes := h.rmToTrash(h.home + "/notes.txt")
+	todo := h.rmToTrash(h.home + "/todo.txt")
+	h.writeFile(h.home+"/todo.txt", "new todo")
+
+	tests := []struct {
+		name  string
+		token string
+		key   string
+		dst   string
+		code  codes.Code
+		path  string
+	}{
+		{"other user", newTestToken(t, "other"), notes.Key, "", codes.NotFound, ""},
+		{"missing key", h.token, "missing", "", codes.NotFound, ""},
+		{"bad key", h.token, "../demo", "", codes.NotFound, ""},
+		{"outside home", h.token, notes.Key, h.otherHome + "/notes.txt", codes.PermissionDenied, ""},
+		{"original path", h.token, notes.Key, "", codes.OK, h.home + "/notes.txt"},
+		{"already restored", h.token, notes.Key, "", codes.NotFound, ""},
+		{"original path exists", h.token, todo.Key, "", codes.AlreadyExists, ""},
+		{"new path", h.token, todo.Key, h.home + "/old-todo.txt", codes.OK, h.home + "/old-todo.txt"},
+		{"bad token", "bad", todo.Key, "", codes.Unauthenticated, ""},
+	}
+
+	for _, tt := range tests {
+		req := &pb.RestoreTrashReq{AccessToken: tt.token, Key: tt.key, Dst: tt.dst}
+		_, err := h.client.RestoreTrash(h.ctx, req)
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code != codes.OK {
+			continue
+		}
+		if !h.exists(tt.path) {
+			t.Errorf("%s: %s has not been restored", tt.name, tt.path)
+		}
+		if _, ok := h.prop.record(tt.path); !ok {
+			t.Errorf("%s: %s has not been saved in prop", tt.name, tt.path)
+		}
+	}
+
+	list, err := h.client.ListTrash(h.ctx, &pb.ListTrashReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 0 {
+		t.Errorf("got %d entries in trash, want 0", len(list.Entries))
+	}
+}
+
+func TestRestoreTrashKeepsID(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	p := h.home + "/notes.txt"
+	h.writeFile(p, "hello")
+	e := h.rmToTrash(p)
+	if _, ok := h.prop.record(p); ok {
+		t.Errorf("%s is still in prop", p)
+	}
+
+	if _, err := h.client.RestoreTrash(h.ctx, &pb.RestoreTrashReq{AccessToken: h.token, Key: e.Key}); err != nil {
+		t.Fatal(err)
+	}
+	rec, ok := h.prop.record(p)
+	if !ok || rec.Id != e.Id {
+		t.Errorf("got id %s, want %s", rec.Id, e.Id)
+	}
+}
+
+func TestRmWithoutAttributes(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.srv.storage = &noAttrStorage{h.srv.storage}
+	p := h.home + "/notes.txt"
+	h.writeFile(p, "hello")
+
+	if _, err := h.client.Rm(h.ctx, &pb.RmReq{AccessToken: h.token, Path: p}); err != nil {
+		t.Fatal(err)
+	}
+	if h.exists(p) {
+		t.Errorf("%s has not been removed", p)
+	}
+	if _, ok := h.prop.record(p); ok {
+		t.Errorf("%s is still in prop", p)
+	}
+}
+
+// noAttrStorage is a storage that does not support attributes.
+type noAttrStorage struct {
+	storage
+}
+
+func (s *noAttrStorage) GetAttr(p, name string) ([]byte, error) {
+	return nil, errAttrNotSupported
+}
+
+func (s *noAttrStorage) SetAttr(p, name string, value []byte) error {
+	return errAttrNotSupported
+}
+
+func TestPurgeTrash(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/notes.txt", "hello")
+	e := h.rmToTrash(h.home + "/notes.txt")
+
+	_, err := h.client.PurgeTrash(h.ctx, &pb.PurgeTrashReq{AccessToken: newTestToken(t, "other"), Key: e.Key})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.NotFound)
+	}
+
+	if _, err := h.client.PurgeTrash(h.ctx, &pb.PurgeTrashReq{AccessToken: h.token, Key: e.Key}); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := h.client.ListTrash(h.ctx, &pb.ListTrashReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 0 {
+		t.Errorf("got %d entries in trash, want 0", len(list.Entries))
+	}
+
+	_, err = h.client.RestoreTrash(h.ctx, &pb.RestoreTrashReq{AccessToken: h.token, Key: e.Key})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.NotFound)
+	}
+}
@@ -1,77 +1,77 @@
 package main
 
 import (
-	"github.com/clawio/service-auth/lib"
 	"github.com/nu7hatch/gouuid"
 	"golang.org/x/net/context"
 	metadata "google.golang.org/grpc/metadata"
 	"io"
+	"mime"
 	"os"
 	"path"
 	"strings"
 )
 
-// getHome returns the user home directory.
-// the logical home has this layout.
-// local/users/<letter>/<pid>
-// Example: /local/users/o/ourense
-// idt.Pid must be always non-empty
-func getHome(idt *lib.Identity) string {
-
-	pid := path.Clean(idt.Pid)
-
-	if pid == "" {
-		panic("idt.Pid must not be empty")
-	}
-
-	return path.Join("/local", "users", string(pid[0]), pid)
+// isHiddenPath checks if the path is inside one of the areas the service
+// keeps for itself, like the trash, the versions or the shares.
+// These areas are never exposed in the logical namespace.
+func isHiddenPath(p string) bool {
+	return isTrashPath(p) || isVersionsPath(p) || isSharesPath(p)
 }
 
-// isUnderHome checks is the path is under a user home dir or not.
-func isUnderHome(p string, idt *lib.Identity) bool {
-
-	p = path.Clean(p)
+// getMimeType returns the mime type of the path p.
+func getMimeType(p string, isContainer bool) string {
+	if isContainer {
+		return "inode/container"
+	}
 
-	if strings.HasPrefix(p, getHome(idt)) {
-		return true
+	mimeType := mime.TypeByExtension(path.Ext(p))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
 	}
+	return mimeType
+}
 
-	return false
+// copyStats is the amount of data copied so far.
+type copyStats struct {
+	bytes uint64
+	files uint64
 }
-func isUnderOtherHome(p string, idt *lib.Identity) bool {
-	home := getHome(idt)
-	homeTokens := strings.Split(home, "/")
 
-	tokens := strings.Split(p, "/")
+// copier copies physical trees keeping count of the data copied.
+// The copy is aborted as soon as ctx is done.
+type copier struct {
+	ctx      context.Context
+	stats    copyStats
+	progress func(copyStats)
+	preserve bool
+}
 
-	// /local/users/d/labrador/myfiles
-	if len(tokens) < 5 { // not a home dir
-		return false
+func (c *copier) report() {
+	if c.progress != nil {
+		c.progress(c.stats)
 	}
-	if tokens[3] == homeTokens[3] && tokens[4] == homeTokens[4] {
-		return false // same user home
-	}
-
-	return true
 }
 
-// isCommonDomain checks if the path is the common domain
-// i.e /local/users/{letter}
-func isCommonDomain(p string) bool {
-	p = path.Clean(p)
-	tokens := strings.Split(p, "/")
+// copyWriter counts the bytes written to w and
+// checks for cancellation between writes.
+type copyWriter struct {
+	w io.Writer
+	c *copier
+}
 
-	if len(tokens) > 4 {
-		// is a home dir or an fake dir
-		return false
+func (cw *copyWriter) Write(b []byte) (int, error) {
+	if err := cw.c.ctx.Err(); err != nil {
+		return 0, err
 	}
-
-	return true
+	n, err := cw.w.Write(b)
+	cw.c.stats.bytes += uint64(n)
+	cw.c.report()
+	return n, err
 }
 
 // copyFile copies a file from src to dst.
 // src and dst are physycal paths.
-func copyFile(src, dst string, size int64) (err error) {
+func (c *copier) copyFile(src, dst string) (err error) {
 
 	reader, err := os.Open(src)
 	if err != nil {
@@ -79,27 +79,107 @@ func copyFile(src, dst string, size int64) (err error) {
 	}
 	defer reader.Close()
 
+	finfo, err := reader.Stat()
+	if err != nil {
+		return err
+	}
+
 	writer, err := os.Create(dst)
 	if err != nil {
 		return err
 	}
 	defer writer.Close()
 
-	_, err = io.CopyN(writer, reader, size)
+	done, err := c.fastCopy(writer, reader, finfo.Size())
 	if err != nil {
 		return err
 	}
+	if !done {
+		_, err = io.Copy(&copyWriter{writer, c}, reader)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The file is closed before preserving the times
+	// so they are not changed by a late write.
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	if c.preserve {
+		err = preserveAttrs(src, dst, finfo)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.stats.files++
+	c.report()
+	return nil
+}
+
+// preserveModeMask are the mode bits kept by a copy that preserves attributes.
+const preserveModeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// preserveAttrs sets the user extended attributes, the mode bits and the
+// access and modification times of src to dst.
+// The internal attributes of the service are not copied.
+// src and dst are physycal paths and finfo is the info of src.
+func preserveAttrs(src, dst string, finfo os.FileInfo) error {
+	names, err := listXattrs(src)
+	if err != nil && err != errAttrNotSupported {
+		return err
+	}
+	for _, n := range names {
+		if strings.HasPrefix(n, internalAttrPrefix) {
+			continue
+		}
+		val, err := getXattr(src, n)
+		if err != nil {
+			return err
+		}
+		if err := setXattr(dst, n, val); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Chmod(dst, finfo.Mode()&preserveModeMask); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fileAtime(finfo), finfo.ModTime())
+}
+
+// copyLink copies the symbolic link src to dst.
+func (c *copier) copyLink(src, dst string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Symlink(target, dst); err != nil {
+		return err
+	}
+	c.stats.files++
+	c.report()
 	return nil
 }
 
 // copyDir copies a dir from src to dst.
 // src and dst are physycal paths.
-func copyDir(src, dst string) (err error) {
+func (c *copier) copyDir(src, dst string) (err error) {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+
 	err = os.Mkdir(dst, dirPerm)
 	if err != nil {
 		return err
 	}
 
+	c.stats.files++
+	c.report()
+
 	directory, err := os.Open(src)
 	if err != nil {
 		return err
@@ -107,26 +187,46 @@ func copyDir(src, dst string) (err error) {
 	defer directory.Close()
 
 	objects, err := directory.Readdir(-1)
+	if err != nil {
+		return err
+	}
 
 	for _, obj := range objects {
 
 		_src := path.Join(src, obj.Name())
 		_dst := path.Join(dst, obj.Name())
 
-		if obj.IsDir() {
+		if obj.Mode()&os.ModeSymlink != 0 {
+			// Links are copied as they are, never followed,
+			// reading them goes through the path resolver.
+			err = c.copyLink(_src, _dst)
+			if err != nil {
+				return err
+			}
+		} else if obj.IsDir() {
 			// create sub-directories - recursively
-			err = copyDir(_src, _dst)
+			err = c.copyDir(_src, _dst)
 			if err != nil {
 				return err
 			}
 		} else {
 			// perform copy
-			err = copyFile(_src, _dst, obj.Size())
+			err = c.copyFile(_src, _dst)
 			if err != nil {
 				return err
 			}
 		}
 	}
+
+	// The attributes of a dir are preserved once its children are
+	// copied, as copying them changes its modification time.
+	if c.preserve {
+		finfo, err := directory.Stat()
+		if err != nil {
+			return err
+		}
+		return preserveAttrs(src, dst, finfo)
+	}
 	return
 }
 
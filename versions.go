@@ -0,0 +1,486 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	proppb "github.com/clawio/service-localfs-meta/proto/propagator"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// versionsDir is the container where previous versions of files are kept.
+// The versions of a file are saved in /.versions/<pid>/<hash of path>/<n>
+// where n is the version number, starting at 1 for the oldest one.
+// They are moved with the file when it is moved, trashed or restored.
+const versionsDir = "/.versions"
+
+var versionNotFound = grpc.Errorf(codes.NotFound, "version not found")
+
+// isVersionsPath checks if the path is inside the versions area.
+func isVersionsPath(p string) bool {
+	p = path.Clean(p)
+	return p == versionsDir || strings.HasPrefix(p, versionsDir+"/")
+}
+
+// getVersionsDir returns the container where the versions of p are saved.
+func (s *server) getVersionsDir(p string, idt *authlib.Identity) string {
+	sum := sha1.Sum([]byte(path.Clean(p)))
+	return path.Join(versionsDir, s.getAccountID(idt), hex.EncodeToString(sum[:]))
+}
+
+// getVersionKeys returns the version numbers saved in dir, oldest first.
+func (s *server) getVersionKeys(dir string) ([]int, error) {
+	names, err := s.storage.List(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []int{}, nil
+		}
+		return nil, err
+	}
+
+	keys := []int{}
+	for _, n := range names {
+		k, err := strconv.Atoi(n)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys, nil
+}
+
+// getVersionPath returns the path where the version key of p is saved.
+func (s *server) getVersionPath(p, key string, idt *authlib.Identity) (string, error) {
+	k, err := strconv.Atoi(key)
+	if err != nil || k <= 0 {
+		return "", versionNotFound
+	}
+
+	vp := path.Join(s.getVersionsDir(p, idt), strconv.Itoa(k))
+
+	_, err = s.storage.Stat(vp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", versionNotFound
+		}
+		return "", err
+	}
+	return vp, nil
+}
+
+// saveVersion moves the current content of the file p to a new version
+// and returns it. The oldest versions are not removed until the new
+// version is committed.
+func (s *server) saveVersion(p string, idt *authlib.Identity) (*pendingVersion, error) {
+	dir := s.getVersionsDir(p, idt)
+
+	keys, err := s.getVersionKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.storage.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+
+	next := 1
+	if len(keys) > 0 {
+		next = keys[len(keys)-1] + 1
+	}
+
+	vp := path.Join(dir, strconv.Itoa(next))
+	if err := s.storage.Move(p, vp); err != nil {
+		return nil, err
+	}
+	return &pendingVersion{s: s, p: p, vp: vp, dir: dir}, nil
+}
+
+// pruneVersions removes the oldest versions saved in dir
+// that exceed the retention count.
+func (s *server) pruneVersions(dir string) error {
+	keys, err := s.getVersionKeys(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > s.c.MaxVersions {
+		if err := s.storage.Remove(path.Join(dir, strconv.Itoa(keys[0]))); err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
+
+// pendingVersion is a version saved before overwriting a file.
+// Once the overwrite is done it is committed, and if the overwrite
+// fails it is undone so the file is left as it was.
+// A nil pendingVersion does nothing, so callers don't have to
+// check whether a version has been saved at all.
+type pendingVersion struct {
+	s   *server
+	p   string
+	vp  string
+	dir string
+}
+
+// commit removes the oldest versions that exceed the retention count.
+func (v *pendingVersion) commit() error {
+	if v == nil {
+		return nil
+	}
+	return v.s.pruneVersions(v.dir)
+}
+
+// undo puts the saved content back in its file.
+func (v *pendingVersion) undo() error {
+	if v == nil {
+		return nil
+	}
+	return v.s.storage.Move(v.vp, v.p)
+}
+
+// versionBeforeOverwrite saves a new version of p if p is a file that
+// is going to be overwritten. It does nothing and returns a nil version
+// if versioning is disabled or there is no file to overwrite.
+func (s *server) versionBeforeOverwrite(p string, idt *authlib.Identity) (*pendingVersion, error) {
+	if s.c.MaxVersions <= 0 {
+		return nil, nil
+	}
+
+	finfo, err := s.storage.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if finfo.IsDir() {
+		return nil, nil
+	}
+
+	return s.saveVersion(p, idt)
+}
+
+// getVersionedFiles returns the paths relative to p of the files that
+// may have versions, an empty path meaning p itself. Links are not
+// followed. Nothing is walked if the owner has no versions at all.
+func (s *server) getVersionedFiles(p string, owner *authlib.Identity) ([]string, error) {
+	_, err := s.storage.Stat(path.Join(versionsDir, s.getAccountID(owner)))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := s.listFiles(p, "")
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	return files, err
+}
+
+// listFiles returns the paths relative to root of the files under
+// root/rel, the walk is done the same way usage is computed.
+func (s *server) listFiles(root, rel string) ([]string, error) {
+	p := path.Join(root, rel)
+	finfo, err := s.storage.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	if finfo.Mode()&os.ModeSymlink != 0 {
+		return []string{}, nil
+	}
+	if !finfo.IsDir() {
+		return []string{rel}, nil
+	}
+
+	names, err := s.storage.List(p)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, n := range names {
+		sub, err := s.listFiles(root, path.Join(rel, n))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+// mergeVersions moves the versions saved in src after the ones saved
+// in dst, so the versions of a moved file follow the ones of the file
+// it overwrote. The oldest versions that exceed the retention count
+// are removed.
+func (s *server) mergeVersions(src, dst string) error {
+	keys, err := s.getVersionKeys(src)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	dstKeys, err := s.getVersionKeys(dst)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.MkdirAll(dst); err != nil {
+		return err
+	}
+
+	next := 1
+	if len(dstKeys) > 0 {
+		next = dstKeys[len(dstKeys)-1] + 1
+	}
+	for _, k := range keys {
+		if err := s.storage.Move(path.Join(src, strconv.Itoa(k)), path.Join(dst, strconv.Itoa(next))); err != nil {
+			return err
+		}
+		next++
+	}
+
+	if err := s.storage.Remove(src); err != nil {
+		return err
+	}
+
+	// Versions are not pruned while versioning is disabled.
+	if s.c.MaxVersions <= 0 {
+		return nil
+	}
+	return s.pruneVersions(dst)
+}
+
+// moveVersionsUnder moves the versions of src and of its descendants
+// to dst. It is called once src has been moved to dst.
+func (s *server) moveVersionsUnder(src string, srcOwner *authlib.Identity, dst string, dstOwner *authlib.Identity, log *rus.Entry) {
+	files, err := s.getVersionedFiles(dst, srcOwner)
+	if err != nil {
+		log.Errorf("versions of %s have not been moved because %s", src, err.Error())
+		return
+	}
+	for _, rel := range files {
+		from := s.getVersionsDir(path.Join(src, rel), srcOwner)
+		to := s.getVersionsDir(path.Join(dst, rel), dstOwner)
+		if err := s.mergeVersions(from, to); err != nil {
+			log.Errorf("versions of %s have not been moved because %s", path.Join(src, rel), err.Error())
+		}
+	}
+}
+
+// removeVersions removes the versions of the files of p returned
+// by getVersionedFiles before p was removed.
+func (s *server) removeVersions(p string, owner *authlib.Identity, files []string, log *rus.Entry) {
+	for _, rel := range files {
+		err := s.storage.Remove(s.getVersionsDir(path.Join(p, rel), owner))
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("versions of %s have not been removed because %s", path.Join(p, rel), err.Error())
+		}
+	}
+}
+
+func (s *server) ListVersions(ctx context.Context, req *pb.ListVersionsReq) (*pb.VersionList, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.VersionList{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	p := path.Clean(req.Path)
+
+	log.Infof("path is %s", p)
+
+	if !s.isUnderHome(p, idt) {
+		log.Error(permissionDenied)
+		return &pb.VersionList{}, permissionDenied
+	}
+
+	dir := s.getVersionsDir(p, idt)
+
+	keys, err := s.getVersionKeys(dir)
+	if err != nil {
+		log.Error(err)
+		return &pb.VersionList{}, err
+	}
+
+	log.Infof("path %s has %d versions", p, len(keys))
+
+	list := &pb.VersionList{}
+	for _, k := range keys {
+		finfo, err := s.storage.Stat(path.Join(dir, strconv.Itoa(k)))
+		if err != nil {
+			log.Errorf("version %d has not been added because %s", k, err.Error())
+			continue
+		}
+
+		v := &pb.Version{}
+		v.Key = strconv.Itoa(k)
+		v.Path = p
+		v.Size = uint32(finfo.Size())
+		v.Modified = uint32(finfo.ModTime().Unix())
+		list.Versions = append(list.Versions, v)
+	}
+
+	return list, nil
+}
+
+func (s *server) StatVersion(ctx context.Context, req *pb.StatVersionReq) (*pb.Metadata, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.Metadata{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	p := path.Clean(req.Path)
+
+	log.Infof("path is %s", p)
+
+	if !s.isUnderHome(p, idt) {
+		log.Error(permissionDenied)
+		return &pb.Metadata{}, permissionDenied
+	}
+
+	vp, err := s.getVersionPath(p, req.Key, idt)
+	if err != nil {
+		log.Error(err)
+		return &pb.Metadata{}, err
+	}
+
+	finfo, err := s.storage.Stat(vp)
+	if err != nil {
+		log.Error(err)
+		return &pb.Metadata{}, err
+	}
+
+	log.Infof("stated version %s of %s", req.Key, p)
+
+	m := &pb.Metadata{}
+	m.Path = p
+	m.Size = uint32(finfo.Size())
+	m.IsContainer = false
+	m.MimeType = getMimeType(p, false)
+	m.Modified = uint32(finfo.ModTime().Unix())
+
+	return m, nil
+}
+
+func (s *server) RestoreVersion(ctx context.Context, req *pb.RestoreVersionReq) (*pb.Void, error) {
+
+	log := getLog(ctx)
+
+	idt, ok := authlib.FromContext(ctx)
+	if !ok {
+		log.Error(unauthenticatedError)
+		return &pb.Void{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	p := path.Clean(req.Path)
+
+	log.Infof("path is %s", p)
+
+	if !s.isUnderHome(p, idt) {
+		log.Error(permissionDenied)
+		return &pb.Void{}, permissionDenied
+	}
+
+	vp, err := s.getVersionPath(p, req.Key, idt)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	// The version is copied aside first because saving the current
+	// content as a new version can drop the version being restored.
+	tmp := vp + ".restore"
+	err = s.storage.Copy(ctx, vp, tmp, copyOptions{})
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	// The current content is kept as a new version
+	// so the restore can be undone.
+	version, err := s.versionBeforeOverwrite(p, idt)
+	if err != nil {
+		s.storage.Remove(tmp)
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	err = s.storage.Move(tmp, p)
+	if err != nil {
+		s.storage.Remove(tmp)
+		if err := version.undo(); err != nil {
+			log.Error(err)
+		}
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	if err := version.commit(); err != nil {
+		log.Error(err)
+	}
+
+	log.Infof("restored version %s of %s", req.Key, p)
+
+	s.usages.invalidate(s.getHome(idt))
+
+	resource, err := s.grpcPool.Get("")
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	defer resource.Release()
+
+	handle, err := resource.Handle()
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+	con := handle.(*grpc.ClientConn)
+	log.Infof("created connection to %s", s.c.Prop)
+
+	client := s.newPropClient(con)
+
+	in := &proppb.PutReq{}
+	in.Path = p
+	in.AccessToken = getAccessToken(ctx)
+
+	_, err = client.Put(ctx, in)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	log.Infof("restored resource %s saved in prop", p)
+
+	return &pb.Void{}, nil
+}
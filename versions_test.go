@@ -0,0 +1,327 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-meta/proto/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+// readFile returns the content of the file at the logical path p.
+func (h *testHarness) readFile(p string) string {
+	data, err := ioutil.ReadFile(path.Join(h.dataDir, p))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return string(data)
+}
+
+func (h *testHarness) listVersions(p string) []*pb.Version {
+	list, err := h.client.ListVersions(h.ctx, &pb.ListVersionsReq{AccessToken: h.token, Path: p})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return list.Versions
+}
+
+func TestCpKeepsVersions(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	dst := h.home + "/notes.txt"
+	h.writeFile(dst, "v1")
+
+	contents := []string{"v22", "v333", "v4444", "v55555"}
+	for _, c := range contents {
+		src := h.home + "/src.txt"
+		h.writeFile(src, c)
+		if _, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: h.token, Src: src, Dst: dst}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := h.readFile(dst); got != "v55555" {
+		t.Errorf("got content %s, want v55555", got)
+	}
+
+	// only the last 3 versions are kept
+	versions := h.listVersions(dst)
+	if len(versions) != 3 {
+		t.Fatalf("got %d versions, want 3", len(versions))
+	}
+	for i, v := range versions {
+		wantKey := []string{"2", "3", "4"}[i]
+		wantSize := uint32(len(contents[i]))
+		if v.Key != wantKey || v.Size != wantSize || v.Path != dst {
+			t.Errorf("got version %s with size %d, want %s with size %d", v.Key, v.Size, wantKey, wantSize)
+		}
+		if v.Modified == 0 {
+			t.Errorf("version %s has no modification time", v.Key)
+		}
+	}
+
+	// versions of other users are not reachable
+	other := newTestToken(t, "other")
+	_, err := h.client.ListVersions(h.ctx, &pb.ListVersionsReq{AccessToken: other, Path: dst})
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.PermissionDenied)
+	}
+	_, err = h.client.Stat(h.ctx, &pb.StatReq{AccessToken: h.token, Path: versionsDir})
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.PermissionDenied)
+	}
+}
+
+func TestMvKeepsVersions(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/a.txt", "old")
+	h.writeFile(h.home+"/b.txt", "new")
+
+	if _, err := h.client.Mv(h.ctx, &pb.MvReq{AccessToken: h.token, Src: h.home + "/b.txt", Dst: h.home + "/a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := h.listVersions(h.home + "/a.txt")
+	if len(versions) != 1 || versions[0].Size != 3 {
+		t.Fatalf("got %d versions, want 1", len(versions))
+	}
+}
+
+func TestFailedOverwriteKeepsFile(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	dst := h.home + "/important.txt"
+	h.writeFile(dst, "keep me")
+
+	_, err := h.client.Mv(h.ctx, &pb.MvReq{AccessToken: h.token, Src: h.home + "/missing", Dst: dst})
+	if err == nil {
+		t.Fatal("moving a missing file must fail")
+	}
+
+	if got := h.readFile(dst); got != "keep me" {
+		t.Errorf("got content %s, want keep me", got)
+	}
+	if versions := h.listVersions(dst); len(versions) != 0 {
+		t.Errorf("got %d versions, want 0", len(versions))
+	}
+}
+
+func TestVersionsTakeQuota(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.srv.c.QuotaMaxBytes = 11
+	dst := h.home + "/notes.txt"
+	h.writeFile(dst, "12345")
+	h.writeFile(h.home+"/src.txt", "abc")
+
+	// The overwritten content is kept as a version and still counts.
+	if _, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: h.token, Src: h.home + "/src.txt", Dst: dst}); err != nil {
+		t.Fatal(err)
+	}
+	q, err := h.client.GetQuota(h.ctx, &pb.GetQuotaReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.UsedBytes != 11 {
+		t.Errorf("got %d used bytes, want 11", q.UsedBytes)
+	}
+
+	_, err = h.client.Cp(h.ctx, &pb.CpReq{AccessToken: h.token, Src: h.home + "/src.txt", Dst: dst})
+	if grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.ResourceExhausted)
+	}
+}
+
+func TestStatVersion(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/notes.txt", "old")
+	h.writeFile(h.home+"/src.txt", "newer")
+	if _, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: h.token, Src: h.home + "/src.txt", Dst: h.home + "/notes.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		path  string
+		key   string
+		code  codes.Code
+	}{
+		{"version", h.token, h.home + "/notes.txt", "1", codes.OK},
+		{"missing version", h.token, h.home + "/notes.txt", "2", codes.NotFound},
+		{"bad key", h.token, h.home + "/notes.txt", "../1", codes.NotFound},
+		{"file without versions", h.token, h.home + "/src.txt", "1", codes.NotFound},
+		{"other user", newTestToken(t, "other"), h.home + "/notes.txt", "1", codes.PermissionDenied},
+	}
+
+	for _, tt := range tests {
+		m, err := h.client.StatVersion(h.ctx, &pb.StatVersionReq{AccessToken: tt.token, Path: tt.path, Key: tt.key})
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%s: got %v, want %v (%v)", tt.name, grpc.Code(err), tt.code, err)
+			continue
+		}
+		if tt.code != codes.OK {
+			continue
+		}
+		if m.Path != tt.path || m.Size != 3 || m.MimeType != "text/plain; charset=utf-8" {
+			t.Errorf("%s: got %s with size %d and mime type %s", tt.name, m.Path, m.Size, m.MimeType)
+		}
+	}
+}
+
+func TestRestoreVersion(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	p := h.home + "/notes.txt"
+	h.writeFile(p, "v1")
+	for _, c := range []string{"v2", "v3", "v4"} {
+		h.writeFile(h.home+"/src.txt", c)
+		if _, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: h.token, Src: h.home + "/src.txt", Dst: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// restoring the oldest version must work even if it
+	// falls out of the retention when the current content is saved.
+	if _, err := h.client.RestoreVersion(h.ctx, &pb.RestoreVersionReq{AccessToken: h.token, Path: p, Key: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.readFile(p); got != "v1" {
+		t.Errorf("got content %s, want v1", got)
+	}
+	if _, ok := h.prop.record(p); !ok {
+		t.Errorf("%s has not been saved in prop", p)
+	}
+
+	versions := h.listVersions(p)
+	if len(versions) != 3 || versions[2].Key != "4" {
+		t.Fatalf("got %d versions, want 3", len(versions))
+	}
+
+	_, err := h.client.RestoreVersion(h.ctx, &pb.RestoreVersionReq{AccessToken: h.token, Path: p, Key: "1"})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("got %v, want %v", grpc.Code(err), codes.NotFound)
+	}
+}
+
+// overwrite copies content over the file p so its old content becomes a version.
+func (h *testHarness) overwrite(p, content string) {
+	h.writeFile(h.home+"/src.txt", content)
+	if _, err := h.client.Cp(h.ctx, &pb.CpReq{AccessToken: h.token, Src: h.home + "/src.txt", Dst: p}); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func TestVersionsFollowMv(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	h.writeFile(h.home+"/a.txt", "v1")
+	h.overwrite(h.home+"/a.txt", "v22")
+	h.writeFile(h.home+"/docs/b.txt", "v1")
+	h.overwrite(h.home+"/docs/b.txt", "v22")
+
+	moves := []struct{ src, dst string }{
+		{h.home + "/a.txt", h.home + "/c.txt"},
+		{h.home + "/docs", h.home + "/papers"},
+	}
+	for _, m := range moves {
+		if _, err := h.client.Mv(h.ctx, &pb.MvReq{AccessToken: h.token, Src: m.src, Dst: m.dst}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		versions int
+	}{
+		{h.home + "/c.txt", 1},
+		{h.home + "/papers/b.txt", 1},
+		{h.home + "/a.txt", 0},
+		{h.home + "/docs/b.txt", 0},
+	}
+	for _, tt := range tests {
+		if got := len(h.listVersions(tt.path)); got != tt.versions {
+			t.Errorf("%s: got %d versions, want %d", tt.path, got, tt.versions)
+		}
+	}
+
+	// moving over a file keeps the versions of both
+	h.writeFile(h.home+"/d.txt", "v333")
+	if _, err := h.client.Mv(h.ctx, &pb.MvReq{AccessToken: h.token, Src: h.home + "/c.txt", Dst: h.home + "/d.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	versions := h.listVersions(h.home + "/d.txt")
+	if len(versions) != 2 || versions[0].Size != 4 || versions[1].Size != 2 {
+		t.Errorf("got %d versions, want 2", len(versions))
+	}
+}
+
+func TestVersionsFollowRm(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	p := h.home + "/docs/a.txt"
+	h.writeFile(p, "v1")
+	h.overwrite(p, "v22")
+
+	if _, err := h.client.Rm(h.ctx, &pb.RmReq{AccessToken: h.token, Path: h.home + "/docs"}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := h.client.ListTrash(h.ctx, &pb.ListTrashReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 1 {
+		t.Fatalf("got %d trash entries, want 1", len(list.Entries))
+	}
+	removed := list.Entries[0].Key
+
+	// a new file with the same path does not get the versions
+	h.writeFile(p, "new")
+	if got := len(h.listVersions(p)); got != 0 {
+		t.Errorf("got %d versions of the new file, want 0", got)
+	}
+	if _, err := h.client.Rm(h.ctx, &pb.RmReq{AccessToken: h.token, Path: h.home + "/docs"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the versions are back with the restored file
+	if _, err := h.client.RestoreTrash(h.ctx, &pb.RestoreTrashReq{AccessToken: h.token, Key: removed}); err != nil {
+		t.Fatal(err)
+	}
+	versions := h.listVersions(p)
+	if len(versions) != 1 || versions[0].Size != 2 {
+		t.Errorf("got %d versions of the restored file, want 1", len(versions))
+	}
+
+	// and they go away when the trash is purged
+	if _, err := h.client.Rm(h.ctx, &pb.RmReq{AccessToken: h.token, Path: h.home + "/docs"}); err != nil {
+		t.Fatal(err)
+	}
+	list, err = h.client.ListTrash(h.ctx, &pb.ListTrashReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range list.Entries {
+		if _, err := h.client.PurgeTrash(h.ctx, &pb.PurgeTrashReq{AccessToken: h.token, Key: e.Key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := h.client.GetQuota(h.ctx, &pb.GetQuotaReq{AccessToken: h.token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(len("v22")); q.UsedBytes != want {
+		t.Errorf("got %d used bytes, want %d", q.UsedBytes, want)
+	}
+}
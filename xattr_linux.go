@@ -0,0 +1,57 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"strings"
+)
+
+// getXattr returns the value of the user extended attribute name of pp.
+func getXattr(pp, name string) ([]byte, error) {
+	name = xattrPrefix + name
+	size, err := unix.Getxattr(pp, name, nil)
+	if err != nil {
+		return nil, xattrError(err)
+	}
+	buf := make([]byte, size)
+	size, err = unix.Getxattr(pp, name, buf)
+	if err != nil {
+		return nil, xattrError(err)
+	}
+	return buf[:size], nil
+}
+
+// setXattr sets the user extended attribute name of pp to value.
+func setXattr(pp, name string, value []byte) error {
+	return xattrError(unix.Setxattr(pp, xattrPrefix+name, value, 0))
+}
+
+// listXattrs returns the names of the user extended attributes of pp.
+func listXattrs(pp string) ([]string, error) {
+	size, err := unix.Listxattr(pp, nil)
+	if err != nil {
+		return nil, xattrError(err)
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(pp, buf)
+	if err != nil {
+		return nil, xattrError(err)
+	}
+
+	names := []string{}
+	for _, n := range strings.Split(string(buf[:size]), "\x00") {
+		if strings.HasPrefix(n, xattrPrefix) {
+			names = append(names, strings.TrimPrefix(n, xattrPrefix))
+		}
+	}
+	return names, nil
+}
+
+func xattrError(err error) error {
+	if err == unix.ENODATA {
+		return errAttrNotFound
+	}
+	if err == unix.ENOTSUP {
+		return errAttrNotSupported
+	}
+	return err
+}
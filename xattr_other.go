@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func getXattr(pp, name string) ([]byte, error) {
+	return nil, errAttrNotSupported
+}
+
+func setXattr(pp, name string, value []byte) error {
+	return errAttrNotSupported
+}
+
+func listXattrs(pp string) ([]string, error) {
+	return nil, errAttrNotSupported
+}